@@ -0,0 +1,136 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultBatchSize is used when the BatchSize of a batch handler is not set
+const DefaultBatchSize = 100
+
+// ErrBatchNotSupported returned when registering a batch handler to an adapter without batch consumption
+var ErrBatchNotSupported = errors.New("mq: batch handler is not supported by the adapter")
+
+// BatchHandler handle the messages together, e.g. to write them with a single query.
+// Return nil when every message succeeded, a *BatchError to fail only some of them,
+// any other error fails the whole batch. The messages are acknowledged or requeued by the adapter
+type BatchHandler func(ctx context.Context, messages []IMessage) error
+
+// BatchError carry the result of every message of the batch, Errors[i] is the error of messages[i], nil when it succeeded
+type BatchError struct {
+	Errors []error
+}
+
+// NewBatchError will create the result of a batch of n messages, all of them succeeded until Fail
+func NewBatchError(n int) *BatchError {
+	return &BatchError{Errors: make([]error, n)}
+}
+
+// Fail set the error of the message i, a Permanent error dead-letter the message without retrying
+func (e *BatchError) Fail(i int, err error) {
+	e.Errors[i] = err
+}
+
+// Err return nil when no message failed, so the handler can return it as is
+func (e *BatchError) Err() error {
+	for _, err := range e.Errors {
+		if err != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (e *BatchError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errors {
+		if err == nil {
+			continue
+		}
+
+		failed++
+		if first == nil {
+			first = err
+		}
+	}
+
+	return fmt.Sprintf("mq: %d of %d messages failed: %v", failed, len(e.Errors), first)
+}
+
+// BatchResults return the error of each of the n messages from the batch handler error,
+// an error other than *BatchError, or a *BatchError of another size, fails all of them
+func BatchResults(err error, n int) []error {
+	results := make([]error, n)
+	if err == nil {
+		return results
+	}
+
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) && len(batchErr.Errors) == n {
+		copy(results, batchErr.Errors)
+		return results
+	}
+
+	for i := range results {
+		results[i] = err
+	}
+
+	return results
+}
+
+// NextBatch collect up to size items, waiting at most wait after the first one,
+// wait <= 0 take only the items ready. It return false once in is closed and drained,
+// or when done is closed before the first item, a nil done never closes
+func NextBatch[T any](done <-chan struct{}, in <-chan T, size int, wait time.Duration) ([]T, bool) {
+	var item T
+	select {
+	case <-done:
+		return nil, false
+	case first, ok := <-in:
+		if !ok {
+			return nil, false
+		}
+		item = first
+	}
+
+	batch := make([]T, 0, size)
+	batch = append(batch, item)
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for len(batch) < size {
+		if timeout == nil {
+			select {
+			case item, ok := <-in:
+				if !ok {
+					return batch, true
+				}
+				batch = append(batch, item)
+			default:
+				return batch, true
+			}
+			continue
+		}
+
+		select {
+		case item, ok := <-in:
+			if !ok {
+				return batch, true
+			}
+			batch = append(batch, item)
+		case <-timeout:
+			return batch, true
+		}
+	}
+
+	return batch, true
+}
@@ -0,0 +1,146 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBatchResults(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	partial := NewBatchError(3)
+	partial.Fail(1, errFailed)
+
+	tests := []struct {
+		name string
+		err  error
+		want []error
+	}{
+		{
+			name: "Test batch succeeded",
+			err:  nil,
+			want: []error{nil, nil, nil},
+		}, {
+			name: "Test batch partially failed",
+			err:  partial,
+			want: []error{nil, errFailed, nil},
+		}, {
+			name: "Test wrapped batch error",
+			err:  fmt.Errorf("insert: %w", partial),
+			want: []error{nil, errFailed, nil},
+		}, {
+			name: "Test whole batch failed",
+			err:  errFailed,
+			want: []error{errFailed, errFailed, errFailed},
+		}, {
+			name: "Test batch error of another size",
+			err:  NewBatchError(2),
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BatchResults(tt.err, 3)
+			if len(got) != 3 {
+				t.Fatalf("BatchResults() len = %d, want 3", len(got))
+			}
+
+			for i, err := range got {
+				want := tt.err
+				if tt.want != nil {
+					want = tt.want[i]
+				}
+				if err != want {
+					t.Errorf("BatchResults()[%d] = %v, want %v", i, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchError_Err(t *testing.T) {
+	batchErr := NewBatchError(2)
+	if err := batchErr.Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
+	}
+
+	batchErr.Fail(0, errors.New("failed"))
+	if err := batchErr.Err(); err == nil || err.Error() != "mq: 1 of 2 messages failed: failed" {
+		t.Errorf("Err() = %v, want the batch error", err)
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		ready  []int
+		closed bool
+		size   int
+		wait   time.Duration
+		want   []int
+		wantOK bool
+	}{
+		{
+			name:   "Test batch full",
+			ready:  []int{1, 2, 3},
+			size:   2,
+			wait:   time.Second,
+			want:   []int{1, 2},
+			wantOK: true,
+		}, {
+			name:   "Test batch handed after wait",
+			ready:  []int{1},
+			size:   2,
+			wait:   10 * time.Millisecond,
+			want:   []int{1},
+			wantOK: true,
+		}, {
+			name:   "Test batch of the ready items without wait",
+			ready:  []int{1, 2},
+			size:   5,
+			want:   []int{1, 2},
+			wantOK: true,
+		}, {
+			name:   "Test last batch of a closed channel",
+			ready:  []int{1},
+			closed: true,
+			size:   2,
+			wait:   time.Second,
+			want:   []int{1},
+			wantOK: true,
+		}, {
+			name:   "Test closed and drained channel",
+			closed: true,
+			size:   2,
+			wait:   time.Second,
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := make(chan int, len(tt.ready))
+			for _, v := range tt.ready {
+				in <- v
+			}
+			if tt.closed {
+				close(in)
+			}
+
+			got, ok := NextBatch(nil, in, tt.size, tt.wait)
+			if ok != tt.wantOK || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("NextBatch() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNextBatch_Done(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+
+	if got, ok := NextBatch(done, make(chan int), 2, time.Second); ok || got != nil {
+		t.Errorf("NextBatch() = %v, %v, want nil, false", got, ok)
+	}
+}
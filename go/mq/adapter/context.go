@@ -0,0 +1,93 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrHandlerTimeout returned when the handler failed after the ConsumerHandler Timeout passed
+var ErrHandlerTimeout = errors.New("mq: handler timeout")
+
+// Metadata describe the message being handled, it is available in the handler context
+type Metadata struct {
+	Topic       string
+	Channel     string
+	MessageID   string
+	DeliveryTag uint64
+	Attempts    int32
+}
+
+// Fields return the metadata as log fields
+func (m Metadata) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"topic":        m.Topic,
+		"channel":      m.Channel,
+		"message_id":   m.MessageID,
+		"delivery_tag": m.DeliveryTag,
+		"attempts":     m.Attempts,
+	}
+}
+
+type metadataKey struct{}
+
+// WithMetadata will put the message metadata into the context
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFromContext will get the message metadata from the handler context
+func MetadataFromContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(metadataKey{}).(Metadata)
+	return md, ok
+}
+
+type contentTypeKey struct{}
+
+// WithContentType will set the content type of the messages published with the context,
+// the adapters without content type ignore it
+func WithContentType(ctx context.Context, contentType string) context.Context {
+	return context.WithValue(ctx, contentTypeKey{}, contentType)
+}
+
+// ContentTypeFromContext will get the content type set by WithContentType, empty when it is not set
+func ContentTypeFromContext(ctx context.Context) string {
+	contentType, _ := ctx.Value(contentTypeKey{}).(string)
+	return contentType
+}
+
+// Invoke call the handler with the message metadata in the context.
+// When Timeout is set the context is cancelled after it passed and a handler failing past the deadline
+// returns ErrHandlerTimeout. Invoke always waits for the handler, so a message is never handled twice at once
+// and a handler ignoring the context keeps holding its worker until it returns
+func (c ConsumerHandler) Invoke(ctx context.Context, md Metadata, message IMessage) error {
+	return c.invoke(ctx, md, func(ctx context.Context) error {
+		return c.Handler(ctx, message)
+	})
+}
+
+// InvokeBatch call the batch handler like Invoke, the metadata only carry the topic and the channel
+// and Timeout apply to the whole batch
+func (c ConsumerHandler) InvokeBatch(ctx context.Context, md Metadata, messages []IMessage) error {
+	return c.invoke(ctx, md, func(ctx context.Context) error {
+		return c.BatchHandler(ctx, messages)
+	})
+}
+
+func (c ConsumerHandler) invoke(ctx context.Context, md Metadata, fn func(ctx context.Context) error) error {
+	ctx = WithMetadata(ctx, md)
+
+	if c.Timeout <= 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s: %w", ErrHandlerTimeout, c.Timeout, err)
+	}
+
+	return err
+}
@@ -12,11 +12,36 @@ type IMessage interface {
 	Requeue(delay time.Duration)
 	GetAttempts() int32
 	GetBody() []byte
+
+	// GetID return the broker or publisher message id
+	GetID() string
+	// GetHeaders return a copy of the message headers, nil when the broker has none
+	GetHeaders() map[string]interface{}
+	GetCorrelationID() string
+	// GetTimestamp return the publish time, zero when unknown
+	GetTimestamp() time.Time
+	GetContentType() string
+	// Touch extend the message lease so it is not redelivered while still handled,
+	// it does nothing on brokers without lease
+	Touch()
+	// GetFirstSeen return when the message was delivered for the first time, it is kept across requeues
+	GetFirstSeen() time.Time
+	// GetLastError return the error of the previous attempt, empty on the first attempt or when the broker can't carry it
+	GetLastError() string
 }
 
 type IConsumerAdapter interface {
 	RegisterConsumerHandler(consumer ConsumerHandler) error
 	Run() error
+	// Shutdown stop consuming and wait for the in-flight handlers until the context is done,
+	// unfinished messages are given back to the broker and reported in *ShutdownError
+	Shutdown(ctx context.Context) error
+}
+
+type IPublisherAdapter interface {
+	Publish(ctx context.Context, topic string, body []byte) error
+	PublishWithDelay(ctx context.Context, topic string, body []byte, delay time.Duration) error
+	PublishBatch(ctx context.Context, topic string, bodies [][]byte) error
 }
 
 type ConsumerHandler struct {
@@ -28,9 +53,20 @@ type ConsumerHandler struct {
 	Enable      bool
 	URL         string
 
+	// Timeout cancel the handler context once passed, zero means no timeout
+	Timeout time.Duration
+
+	// BatchSize and BatchWait bound the batches of BatchHandler: a batch is handed once it has BatchSize messages
+	// or BatchWait passed since its first message, whichever comes first
+	BatchSize int
+	BatchWait time.Duration
+
 	extraConfig interface{}
 
 	Handler Handler
+
+	// BatchHandler is used instead of Handler when set, on the adapters supporting it
+	BatchHandler BatchHandler
 }
 
 func (c *ConsumerHandler) SetExtraConfig(extra interface{}) {
@@ -0,0 +1,410 @@
+package kafkaa
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/reyhanfahlevi/pkg/go/log"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+// Consumer run a single adapter.ConsumerHandler as a kafka consumer group member.
+// Messages of the same partition are always handled by the same worker to keep their order
+type Consumer struct {
+	dialer       Dialer
+	reader       Reader
+	retryReaders []Reader
+	writer       Writer
+	workers      []chan *Message
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	closed   bool
+	inFlight map[*Message]struct{}
+
+	// handlerCtx is the root of the handler contexts, it outlives ctx until the shutdown gave up waiting
+	handlerCtx    context.Context
+	handlerCancel context.CancelFunc
+
+	handler       adapter.ConsumerHandler
+	handlerConfig HandlerConfig
+	delayTiers    adapter.DelayTiers
+	retryPolicy   adapter.RetryPolicy
+	classify      func(err error) bool
+
+	// writeBackoff is the delay between the attempts to publish a retry or dead-letter message
+	writeBackoff adapter.RetryPolicy
+}
+
+// HandlerConfig is the kafka specific config parsed from adapter.ConsumerHandler ExtraConfig
+type HandlerConfig struct {
+	// Brokers address, the comma separated URL is used when empty
+	Brokers []string `json:"brokers,omitempty"`
+
+	// RetryTopic receive the messages requeued without delay, default: <topic>.<channel>.retry
+	RetryTopic string `json:"retry_topic,omitempty"`
+
+	// DelayTiers in milliseconds, every tier has its own retry topic <retry_topic>.<ms> so a long delay doesn't hold
+	// back the shorter ones. A requeue delay is rounded up to the next tier, default: 1s, 5s, 30s, 1m, 5m and 10m
+	DelayTiers []int64 `json:"delay_tiers,omitempty"`
+
+	// DeadLetterTopic receive the messages that reached max attempts, default: <topic>.<channel>.dlq
+	DeadLetterTopic string `json:"dead_letter_topic,omitempty"`
+}
+
+// ConsumerOptions option to modify the consumer
+type ConsumerOptions func(*Consumer)
+
+// WithDialer replace the kafka-go dialer used to create readers and writer
+func WithDialer(dialer Dialer) ConsumerOptions {
+	return func(c *Consumer) {
+		c.dialer = dialer
+	}
+}
+
+// WithRetryPolicy set the delay before the next attempt of a failed message,
+// default: exponential from 1 second up to 10 minutes with jitter
+func WithRetryPolicy(policy adapter.RetryPolicy) ConsumerOptions {
+	return func(c *Consumer) {
+		c.retryPolicy = policy
+	}
+}
+
+// WithErrorClassifier report the handler errors that are permanent besides adapter.Permanent ones,
+// they are dead-lettered without retrying
+func WithErrorClassifier(classify func(err error) bool) ConsumerOptions {
+	return func(c *Consumer) {
+		c.classify = classify
+	}
+}
+
+// NewConsumer will instantiate the kafka consumer for the handler,
+// the handler Channel is used as the consumer group id
+func NewConsumer(handler adapter.ConsumerHandler, opt ...ConsumerOptions) *Consumer {
+	c := &Consumer{
+		dialer:   kafkaDialer{},
+		inFlight: make(map[*Message]struct{}),
+		handler:  handler,
+		retryPolicy: adapter.ExponentialBackoff{
+			Base:   time.Second,
+			Max:    10 * time.Minute,
+			Jitter: true,
+		},
+		writeBackoff: adapter.ExponentialBackoff{
+			Base:   100 * time.Millisecond,
+			Max:    10 * time.Second,
+			Jitter: true,
+		},
+	}
+
+	for _, opt := range opt {
+		opt(c)
+	}
+
+	return c
+}
+
+// Run will join the consumer group of the topic and the retry topic and start the workers
+func (c *Consumer) Run() error {
+	if c.handler.BatchHandler != nil {
+		return adapter.ErrBatchNotSupported
+	}
+
+	if c.handler.Handler == nil {
+		return fmt.Errorf("no consumer handler specified")
+	}
+
+	if c.handler.Channel == "" {
+		return fmt.Errorf("consumer group id (channel) is required")
+	}
+
+	if c.handler.Concurrent < 1 {
+		c.handler.Concurrent = 1
+	}
+
+	if c.handler.MaxAttempts < 1 {
+		c.handler.MaxAttempts = 1
+	}
+
+	if c.handler.MaxInFlight < 1 {
+		c.handler.MaxInFlight = 1
+	}
+
+	handlerConfig := HandlerConfig{}
+	if err := c.handler.ParseExtraConfig(&handlerConfig); err != nil {
+		return fmt.Errorf("failed to parse extra config: %w", err)
+	}
+
+	if len(handlerConfig.Brokers) == 0 {
+		handlerConfig.Brokers = splitAddresses(c.handler.URL)
+	}
+
+	if len(handlerConfig.Brokers) == 0 {
+		return fmt.Errorf("no kafka broker specified")
+	}
+
+	if handlerConfig.RetryTopic == "" {
+		handlerConfig.RetryTopic = fmt.Sprintf("%s.%s.retry", c.handler.Topic, c.handler.Channel)
+	}
+
+	if handlerConfig.DeadLetterTopic == "" {
+		handlerConfig.DeadLetterTopic = fmt.Sprintf("%s.%s.dlq", c.handler.Topic, c.handler.Channel)
+	}
+
+	delayTiers, err := adapter.ParseDelayTiers(handlerConfig.DelayTiers)
+	if err != nil {
+		return fmt.Errorf("invalid %s config: %w", c.handler.Topic, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ctx != nil {
+		return fmt.Errorf("consumer already running")
+	}
+
+	c.handlerConfig = handlerConfig
+	c.delayTiers = delayTiers
+	c.reader = c.dialer.NewReader(handlerConfig.Brokers, c.handler.Topic, c.handler.Channel)
+
+	// the retry topic without delay also releases the messages requeued by the consumers without tiers
+	c.retryReaders = []Reader{c.dialer.NewReader(handlerConfig.Brokers, handlerConfig.RetryTopic, c.handler.Channel)}
+	for _, tier := range delayTiers {
+		c.retryReaders = append(c.retryReaders, c.dialer.NewReader(handlerConfig.Brokers, c.retryTopic(tier), c.handler.Channel))
+	}
+
+	c.writer = c.dialer.NewWriter(handlerConfig.Brokers)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.handlerCtx, c.handlerCancel = context.WithCancel(context.Background())
+
+	c.workers = make([]chan *Message, c.handler.Concurrent)
+	for i := range c.workers {
+		c.workers[i] = make(chan *Message, c.handler.MaxInFlight)
+
+		c.wg.Add(1)
+		go c.work(c.workers[i])
+	}
+
+	c.wg.Add(1 + len(c.retryReaders))
+	go c.fetch(c.reader, false)
+	for _, reader := range c.retryReaders {
+		go c.fetch(reader, true)
+	}
+
+	return nil
+}
+
+// retryTopic return the retry topic of the delay tier
+func (c *Consumer) retryTopic(tier time.Duration) string {
+	if tier <= 0 {
+		return c.handlerConfig.RetryTopic
+	}
+
+	return fmt.Sprintf("%s.%d", c.handlerConfig.RetryTopic, tier.Milliseconds())
+}
+
+func splitAddresses(url string) []string {
+	var addresses []string
+	for _, addr := range strings.Split(url, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addresses = append(addresses, addr)
+		}
+	}
+
+	return addresses
+}
+
+// fetch read the messages and dispatch them to the worker owning the partition,
+// retry messages are held until their retry time, the messages of a retry topic wait the same tier so none
+// is held back by a longer one
+func (c *Consumer) fetch(reader Reader, delayed bool) {
+	defer c.wg.Done()
+
+	for {
+		msg, err := reader.FetchMessage(c.ctx)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+
+			log.Error(errors.Wrapf(err, "failed to fetch message from %s", c.handler.Topic))
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		if delayed {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(time.Until(getRetryAt(msg))):
+			}
+		}
+
+		m := newMessage(msg, c, reader)
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case c.workers[c.workerIndex(msg.Topic, msg.Partition)] <- m:
+		}
+	}
+}
+
+func (c *Consumer) workerIndex(topic string, partition int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(topic + "/" + strconv.Itoa(partition)))
+	return int(h.Sum32() % uint32(len(c.workers)))
+}
+
+func (c *Consumer) work(messages chan *Message) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case msg := <-messages:
+			// a message given up on stopping is left uncommitted,
+			// committing a later message of its partition would lose it
+			if c.ctx.Err() != nil {
+				return
+			}
+
+			c.mu.Lock()
+			c.inFlight[msg] = struct{}{}
+			c.mu.Unlock()
+
+			c.handle(msg)
+
+			c.mu.Lock()
+			delete(c.inFlight, msg)
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *Consumer) handle(msg *Message) {
+	md := adapter.Metadata{
+		Topic:       msg.Topic,
+		Channel:     c.handler.Channel,
+		MessageID:   msg.id(),
+		DeliveryTag: uint64(msg.Offset),
+		Attempts:    msg.GetAttempts(),
+	}
+
+	err := c.handler.Invoke(c.handlerCtx, md, msg)
+	if err != nil {
+		log.ErrorWithFields(err.Error(), md.Fields())
+
+		if msg.hasResponded() {
+			return
+		}
+
+		msg.handleErr = err
+
+		if adapter.IsPermanent(err) || (c.classify != nil && c.classify(err)) {
+			msg.deadLetter()
+			return
+		}
+
+		msg.Requeue(c.retryPolicy.Backoff(msg.GetAttempts()))
+		return
+	}
+
+	msg.Finish()
+}
+
+// Shutdown stop fetching and wait for the in-flight handlers until the context is done.
+// Messages still in-flight after that are left uncommitted, so the group delivers them again,
+// and reported in *adapter.ShutdownError
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.cancel == nil || c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.cancel()
+	defer c.handlerCancel()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	var abandoned []adapter.AbandonedMessage
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.handlerCancel()
+		abandoned = c.abandonInFlight()
+	}
+
+	var errs []string
+	closers := []interface{ Close() error }{c.reader, c.writer}
+	for _, reader := range c.retryReaders {
+		closers = append(closers, reader)
+	}
+
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(abandoned) > 0 {
+		return &adapter.ShutdownError{Abandoned: abandoned}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close consumer: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (c *Consumer) abandonInFlight() []adapter.AbandonedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var abandoned []adapter.AbandonedMessage
+	for msg := range c.inFlight {
+		// responding here prevents the handler from committing the offset later
+		if !msg.respond() {
+			continue
+		}
+
+		abandoned = append(abandoned, adapter.AbandonedMessage{
+			Topic:     msg.Topic,
+			MessageID: msg.id(),
+			Attempts:  msg.attempts,
+		})
+	}
+
+	return abandoned
+}
+
+// Close stop fetching without waiting for the in-flight handlers,
+// messages not finished yet are delivered again to the group
+func (c *Consumer) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	return c.Shutdown(ctx)
+}
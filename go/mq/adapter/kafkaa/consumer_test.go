@@ -0,0 +1,435 @@
+package kafkaa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeBroker is an in-process broker with a single consumer group member per reader
+type fakeBroker struct {
+	mu         sync.Mutex
+	partitions int
+	logs       map[string][][]kafka.Message
+	committed  map[string]map[int]int64
+	notify     chan struct{}
+
+	// writeFailures is the number of the next writes failing
+	writeFailures int
+}
+
+func newFakeBroker(partitions int) *fakeBroker {
+	return &fakeBroker{
+		partitions: partitions,
+		logs:       map[string][][]kafka.Message{},
+		committed:  map[string]map[int]int64{},
+		notify:     make(chan struct{}),
+	}
+}
+
+func (b *fakeBroker) NewReader(brokers []string, topic, groupID string) Reader {
+	return &fakeReader{broker: b, topic: topic, position: map[int]int64{}}
+}
+
+func (b *fakeBroker) NewWriter(brokers []string) Writer {
+	return &fakeWriter{broker: b}
+}
+
+func (b *fakeBroker) produce(msgs ...kafka.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, msg := range msgs {
+		if b.logs[msg.Topic] == nil {
+			b.logs[msg.Topic] = make([][]kafka.Message, b.partitions)
+		}
+
+		h := fnv.New32a()
+		_, _ = h.Write(msg.Key)
+		partition := int(h.Sum32() % uint32(b.partitions))
+
+		msg.Partition = partition
+		msg.Offset = int64(len(b.logs[msg.Topic][partition]))
+		b.logs[msg.Topic][partition] = append(b.logs[msg.Topic][partition], msg)
+	}
+
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+func (b *fakeBroker) messages(topic string) []kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var msgs []kafka.Message
+	for _, partition := range b.logs[topic] {
+		msgs = append(msgs, partition...)
+	}
+
+	return msgs
+}
+
+func (b *fakeBroker) committedCount(topic string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var total int64
+	for _, offset := range b.committed[topic] {
+		total += offset
+	}
+
+	return total
+}
+
+type fakeReader struct {
+	broker   *fakeBroker
+	topic    string
+	position map[int]int64
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		r.broker.mu.Lock()
+		for partition, log := range r.broker.logs[r.topic] {
+			if r.position[partition] < int64(len(log)) {
+				msg := log[r.position[partition]]
+				r.position[partition]++
+				r.broker.mu.Unlock()
+				return msg, nil
+			}
+		}
+		notify := r.broker.notify
+		r.broker.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.broker.mu.Lock()
+	defer r.broker.mu.Unlock()
+
+	for _, msg := range msgs {
+		if r.broker.committed[msg.Topic] == nil {
+			r.broker.committed[msg.Topic] = map[int]int64{}
+		}
+		r.broker.committed[msg.Topic][msg.Partition] = msg.Offset + 1
+	}
+
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+type fakeWriter struct {
+	broker *fakeBroker
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.broker.mu.Lock()
+	if w.broker.writeFailures > 0 {
+		w.broker.writeFailures--
+		w.broker.mu.Unlock()
+		return errors.New("broker unavailable")
+	}
+	w.broker.mu.Unlock()
+
+	w.broker.produce(msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	return nil
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func runConsumer(t *testing.T, broker *fakeBroker, cfg adapter.ConsumerHandler) *Consumer {
+	t.Helper()
+
+	cfg.Channel = "group"
+	cfg.URL = "localhost:9092"
+	cfg.SetExtraConfig(map[string]interface{}{"delay_tiers": []int64{10}})
+	c := NewConsumer(cfg, WithDialer(broker))
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	return c
+}
+
+func TestConsumer_Finish(t *testing.T) {
+	broker := newFakeBroker(1)
+	broker.produce(
+		kafka.Message{Topic: "orders", Value: []byte("1")},
+		kafka.Message{Topic: "orders", Value: []byte("2")},
+		kafka.Message{Topic: "orders", Value: []byte("3")},
+	)
+
+	var mu sync.Mutex
+	var got []string
+	runConsumer(t, broker, adapter.ConsumerHandler{
+		Topic: "orders",
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			mu.Lock()
+			got = append(got, string(message.GetBody()))
+			mu.Unlock()
+			return nil
+		},
+	})
+
+	waitFor(t, func() bool { return broker.committedCount("orders") == 3 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("handled = %v, want [1 2 3]", got)
+	}
+}
+
+func TestConsumer_RequeueToRetryTopic(t *testing.T) {
+	broker := newFakeBroker(1)
+	broker.produce(kafka.Message{Topic: "orders", Value: []byte("1")})
+
+	var mu sync.Mutex
+	var attempts []int32
+	runConsumer(t, broker, adapter.ConsumerHandler{
+		Topic:       "orders",
+		MaxAttempts: 3,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			mu.Lock()
+			attempts = append(attempts, message.GetAttempts())
+			mu.Unlock()
+
+			if message.GetAttempts() == 1 {
+				message.RequeueWithoutBackoff(10 * time.Millisecond)
+				return errors.New("temporary failure")
+			}
+			return nil
+		},
+	})
+
+	waitFor(t, func() bool { return broker.committedCount("orders.group.retry.10") == 1 })
+
+	if got := broker.committedCount("orders"); got != 1 {
+		t.Errorf("committed orders = %d, want 1", got)
+	}
+
+	retried := broker.messages("orders.group.retry.10")
+	if len(retried) != 1 {
+		t.Fatalf("retry messages = %d, want 1", len(retried))
+	}
+	if v, _ := getHeader(retried[0], headerOriginalTopic); v != "orders" {
+		t.Errorf("original topic header = %q, want orders", v)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(attempts) != "[1 2]" {
+		t.Errorf("attempts = %v, want [1 2]", attempts)
+	}
+}
+
+func TestConsumer_DelayTiers(t *testing.T) {
+	broker := newFakeBroker(1)
+	broker.produce(
+		kafka.Message{Topic: "orders", Value: []byte("slow")},
+		kafka.Message{Topic: "orders", Value: []byte("fast")},
+	)
+
+	var retried int32
+	c := NewConsumer(adapter.ConsumerHandler{
+		Topic:       "orders",
+		Channel:     "group",
+		URL:         "localhost:9092",
+		MaxAttempts: 3,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			switch {
+			case message.GetAttempts() > 1:
+				atomic.AddInt32(&retried, 1)
+			case string(message.GetBody()) == "slow":
+				message.RequeueWithoutBackoff(time.Minute)
+			default:
+				message.RequeueWithoutBackoff(5 * time.Millisecond)
+			}
+			return nil
+		},
+	}, WithDialer(broker))
+	c.handler.SetExtraConfig(map[string]interface{}{"delay_tiers": []int64{10, 60000}})
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	// the fast message is not held back by the slow one requeued before it
+	waitFor(t, func() bool { return atomic.LoadInt32(&retried) == 1 })
+
+	if got := len(broker.messages("orders.group.retry.60000")); got != 1 {
+		t.Errorf("slow tier messages = %d, want 1", got)
+	}
+	if got := len(broker.messages("orders.group.retry.10")); got != 1 {
+		t.Errorf("fast tier messages = %d, want 1", got)
+	}
+}
+
+func TestConsumer_RequeueWriteFailure(t *testing.T) {
+	broker := newFakeBroker(1)
+	broker.writeFailures = 2
+	broker.produce(
+		kafka.Message{Topic: "orders", Value: []byte("1")},
+		kafka.Message{Topic: "orders", Value: []byte("2")},
+	)
+
+	var mu sync.Mutex
+	retriedBefore := -1
+	c := NewConsumer(adapter.ConsumerHandler{
+		Topic:       "orders",
+		Channel:     "group",
+		URL:         "localhost:9092",
+		MaxAttempts: 3,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			if string(message.GetBody()) == "1" {
+				return errors.New("temporary failure")
+			}
+
+			if message.GetAttempts() == 1 {
+				mu.Lock()
+				retriedBefore = len(broker.messages("orders.group.retry.10"))
+				mu.Unlock()
+			}
+			return nil
+		},
+	}, WithDialer(broker))
+	c.handler.SetExtraConfig(map[string]interface{}{"delay_tiers": []int64{10}})
+	c.writeBackoff = adapter.FixedBackoff{Delay: time.Millisecond}
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	waitFor(t, func() bool { return broker.committedCount("orders") == 2 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if retriedBefore != 1 {
+		t.Errorf("retry messages when the next message was handled = %d, want 1", retriedBefore)
+	}
+}
+
+func TestConsumer_DeadLetter(t *testing.T) {
+	broker := newFakeBroker(1)
+	broker.produce(kafka.Message{Topic: "orders", Value: []byte("1")})
+
+	runConsumer(t, broker, adapter.ConsumerHandler{
+		Topic:       "orders",
+		MaxAttempts: 2,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			message.Requeue(time.Millisecond)
+			return errors.New("always failing")
+		},
+	})
+
+	waitFor(t, func() bool { return len(broker.messages("orders.group.dlq")) == 1 })
+
+	dead := broker.messages("orders.group.dlq")[0]
+	if v, _ := getHeader(dead, headerAttempts); v != "2" {
+		t.Errorf("attempts header = %q, want 2", v)
+	}
+	if string(dead.Value) != "1" {
+		t.Errorf("dead letter body = %q, want 1", dead.Value)
+	}
+}
+
+func TestConsumer_ErrorClassifier(t *testing.T) {
+	errInvalid := errors.New("invalid")
+
+	broker := newFakeBroker(1)
+	broker.produce(kafka.Message{Topic: "orders", Value: []byte("1")})
+
+	c := NewConsumer(adapter.ConsumerHandler{
+		Topic:       "orders",
+		Channel:     "group",
+		URL:         "localhost:9092",
+		MaxAttempts: 5,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			return fmt.Errorf("decode: %w", errInvalid)
+		},
+	}, WithDialer(broker), WithErrorClassifier(func(err error) bool { return errors.Is(err, errInvalid) }))
+	c.handler.SetExtraConfig(map[string]interface{}{"delay_tiers": []int64{10}})
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	waitFor(t, func() bool { return len(broker.messages("orders.group.dlq")) == 1 })
+
+	if got := len(broker.messages("orders.group.retry.10")); got != 0 {
+		t.Errorf("retry messages = %d, want 0", got)
+	}
+}
+
+func TestConsumer_PartitionOrdering(t *testing.T) {
+	broker := newFakeBroker(3)
+	for i := 0; i < 30; i++ {
+		key := []byte("key-" + strconv.Itoa(i%3))
+		broker.produce(kafka.Message{Topic: "orders", Key: key, Value: []byte(strconv.Itoa(i))})
+	}
+
+	var mu sync.Mutex
+	seen := map[string][]int{}
+	runConsumer(t, broker, adapter.ConsumerHandler{
+		Topic:      "orders",
+		Concurrent: 3,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			msg := message.(*Message)
+			v, _ := strconv.Atoi(string(msg.Value))
+
+			// give other workers the chance to overtake
+			time.Sleep(time.Duration(v%4) * time.Millisecond)
+
+			mu.Lock()
+			seen[string(msg.Key)] = append(seen[string(msg.Key)], v)
+			mu.Unlock()
+			return nil
+		},
+	})
+
+	waitFor(t, func() bool { return broker.committedCount("orders") == 30 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	for key, values := range seen {
+		for i := 1; i < len(values); i++ {
+			if values[i] < values[i-1] {
+				t.Errorf("%s handled out of order: %v", key, values)
+				break
+			}
+		}
+	}
+}
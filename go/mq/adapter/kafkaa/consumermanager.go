@@ -0,0 +1,62 @@
+package kafkaa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+// ConsumerManager implement adapter.IConsumerAdapter for kafka
+type ConsumerManager struct {
+	consumers []*Consumer
+	opts      []ConsumerOptions
+}
+
+// NewManager will instantiate the kafka consumer manager,
+// the options are applied to every registered consumer
+func NewManager(opt ...ConsumerOptions) *ConsumerManager {
+	return &ConsumerManager{opts: opt}
+}
+
+// RegisterConsumerHandler will register the consumer handler, disabled handler is skipped
+func (c *ConsumerManager) RegisterConsumerHandler(consumer adapter.ConsumerHandler) error {
+	if !consumer.Enable {
+		return nil
+	}
+
+	c.consumers = append(c.consumers, NewConsumer(consumer, c.opts...))
+	return nil
+}
+
+// Run will start all registered consumers, when any of them fails the started ones are closed
+func (c *ConsumerManager) Run() error {
+	var errs []error
+	for _, conn := range c.consumers {
+		err := conn.Run()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s failed to start: %w", conn.handler.Topic, err))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	for _, conn := range c.consumers {
+		_ = conn.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// Shutdown stop all consumers concurrently and wait for their in-flight handlers until the context is done
+func (c *ConsumerManager) Shutdown(ctx context.Context) error {
+	targets := make([]adapter.Shutdowner, 0, len(c.consumers))
+	for _, conn := range c.consumers {
+		targets = append(targets, conn)
+	}
+
+	return adapter.ShutdownAll(ctx, targets...)
+}
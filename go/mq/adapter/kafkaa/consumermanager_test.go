@@ -0,0 +1,53 @@
+package kafkaa
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+func TestConsumerManager_Run(t *testing.T) {
+	handler := func(ctx context.Context, message adapter.IMessage) error { return nil }
+
+	m := NewManager(WithDialer(newFakeBroker(1)))
+	handlers := []adapter.ConsumerHandler{
+		{Topic: "orders", Channel: "billing", URL: "localhost:9092", Enable: true, Handler: handler},
+		{Topic: "payments", URL: "localhost:9092", Enable: true, Handler: handler},
+		{Topic: "refunds", Channel: "billing", URL: "localhost:9092", Enable: false, Handler: handler},
+		{Topic: "invoices", Channel: "billing", URL: "localhost:9092", Enable: true},
+	}
+	for _, h := range handlers {
+		if err := m.RegisterConsumerHandler(h); err != nil {
+			t.Fatalf("RegisterConsumerHandler() error = %v", err)
+		}
+	}
+
+	if len(m.consumers) != 3 {
+		t.Fatalf("registered = %d consumers, want 3", len(m.consumers))
+	}
+
+	err := m.Run()
+	if err == nil {
+		t.Fatal("Run() error = nil, want the startup errors")
+	}
+	for _, want := range []string{"payments failed to start", "invoices failed to start"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Run() error = %v, want containing %q", err, want)
+		}
+	}
+
+	// the started consumer is closed
+	started := m.consumers[0]
+	started.mu.Lock()
+	running, closed := started.ctx != nil, started.closed
+	started.mu.Unlock()
+
+	if !running {
+		t.Fatal("orders consumer not started")
+	}
+	if !closed {
+		t.Error("orders consumer still running after Run() failed")
+	}
+}
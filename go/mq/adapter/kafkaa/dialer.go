@@ -0,0 +1,49 @@
+package kafkaa
+
+import (
+	"context"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Reader is the part of kafka.Reader used by the consumer
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Writer is the part of kafka.Writer used to publish retry and dead-letter messages
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Dialer create the readers and writer of a consumer,
+// replace it with WithDialer to run the consumer against another broker implementation
+type Dialer interface {
+	NewReader(brokers []string, topic, groupID string) Reader
+	NewWriter(brokers []string) Writer
+}
+
+type kafkaDialer struct{}
+
+func (kafkaDialer) NewReader(brokers []string, topic, groupID string) Reader {
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers: brokers,
+		Topic:   topic,
+		GroupID: groupID,
+		// offsets are committed explicitly on Finish
+		CommitInterval: 0,
+		MaxWait:        time.Second,
+	})
+}
+
+func (kafkaDialer) NewWriter(brokers []string) Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}
+}
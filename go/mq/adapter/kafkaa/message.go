@@ -0,0 +1,276 @@
+package kafkaa
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/reyhanfahlevi/pkg/go/log"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	headerAttempts      = "attempts"
+	headerRetryAt       = "retry-at"
+	headerOriginalTopic = "original-topic"
+	headerFirstSeen     = "first-seen"
+	headerLastError     = "last-error"
+
+	headerCorrelationID = "correlation-id"
+	headerContentType   = "content-type"
+)
+
+// Message wrap the kafka message into adapter.IMessage.
+// Finish commits the offset, Requeue publishes the message to the retry topic and commits the offset
+type Message struct {
+	kafka.Message
+
+	consumer  *Consumer
+	reader    Reader
+	attempts  int32
+	firstSeen time.Time
+	lastError string
+	responded int32
+
+	// handleErr is the error of the current attempt, it is forwarded as the last error of the next one
+	handleErr error
+}
+
+func newMessage(msg kafka.Message, consumer *Consumer, reader Reader) *Message {
+	m := &Message{
+		Message:   msg,
+		consumer:  consumer,
+		reader:    reader,
+		attempts:  getAttempts(msg) + 1,
+		firstSeen: getTime(msg, headerFirstSeen),
+	}
+
+	if m.firstSeen.IsZero() {
+		m.firstSeen = time.Now()
+	}
+	m.lastError, _ = getHeader(msg, headerLastError)
+
+	return m
+}
+
+func (m *Message) respond() bool {
+	return atomic.CompareAndSwapInt32(&m.responded, 0, 1)
+}
+
+func (m *Message) hasResponded() bool {
+	return atomic.LoadInt32(&m.responded) == 1
+}
+
+// Finish commits the message offset
+func (m *Message) Finish() {
+	if !m.respond() {
+		return
+	}
+
+	m.commit()
+}
+
+// RequeueWithoutBackoff publish the message to the retry topic of the delay tier,
+// it will be delivered again once the delay rounded up to the tier passed
+func (m *Message) RequeueWithoutBackoff(delay time.Duration) {
+	m.Requeue(delay)
+}
+
+// Requeue publish the message to the retry topic of the delay tier,
+// or to the dead-letter topic when the max attempts is reached
+func (m *Message) Requeue(delay time.Duration) {
+	if !m.respond() {
+		return
+	}
+
+	if m.attempts >= m.consumer.handler.MaxAttempts {
+		m.forwardAndCommit(m.consumer.handlerConfig.DeadLetterTopic, 0)
+		return
+	}
+
+	tier := m.consumer.delayTiers.Round(delay)
+	m.forwardAndCommit(m.consumer.retryTopic(tier), tier)
+}
+
+// deadLetter publish the message to the dead-letter topic regardless of the attempts
+func (m *Message) deadLetter() {
+	if !m.respond() {
+		return
+	}
+
+	m.forwardAndCommit(m.consumer.handlerConfig.DeadLetterTopic, 0)
+}
+
+// forwardAndCommit publish the message to the topic then commit its offset. A failed write is retried while
+// holding the partition worker, since kafka commits are cumulative per partition and committing a later message
+// would lose this one. When the consumer stops first the offset is left uncommitted for the group to deliver it again
+func (m *Message) forwardAndCommit(topic string, delay time.Duration) {
+	c := m.consumer
+	msg := m.forward(topic, delay)
+
+	for attempts := int32(1); ; attempts++ {
+		err := c.writer.WriteMessages(context.Background(), msg)
+		if err == nil {
+			break
+		}
+
+		log.Error(errors.Wrapf(err, "failed to publish %s message to %s, attempts %d", m.Topic, topic, attempts))
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.writeBackoff.Backoff(attempts)):
+		}
+	}
+
+	m.commit()
+}
+
+func (m *Message) forward(topic string, delay time.Duration) kafka.Message {
+	lastError := m.lastError
+	if m.handleErr != nil {
+		lastError = m.handleErr.Error()
+	}
+
+	headers := make([]kafka.Header, 0, len(m.Headers)+5)
+	for _, h := range m.Headers {
+		switch h.Key {
+		case headerAttempts, headerRetryAt, headerOriginalTopic, headerFirstSeen, headerLastError:
+			continue
+		}
+		headers = append(headers, h)
+	}
+
+	headers = append(headers,
+		kafka.Header{Key: headerAttempts, Value: []byte(strconv.Itoa(int(m.attempts)))},
+		kafka.Header{Key: headerRetryAt, Value: []byte(strconv.FormatInt(time.Now().Add(delay).UnixMilli(), 10))},
+		kafka.Header{Key: headerOriginalTopic, Value: []byte(m.consumer.handler.Topic)},
+		kafka.Header{Key: headerFirstSeen, Value: []byte(strconv.FormatInt(m.firstSeen.UnixMilli(), 10))},
+	)
+	if lastError != "" {
+		headers = append(headers, kafka.Header{Key: headerLastError, Value: []byte(lastError)})
+	}
+
+	return kafka.Message{
+		Topic:   topic,
+		Key:     m.Key,
+		Value:   m.Value,
+		Headers: headers,
+	}
+}
+
+func (m *Message) id() string {
+	return fmt.Sprintf("%s/%d/%d", m.Topic, m.Partition, m.Offset)
+}
+
+func (m *Message) commit() {
+	err := m.reader.CommitMessages(context.Background(), m.Message)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "failed to commit %s offset %d", m.Topic, m.Offset))
+	}
+}
+
+// GetAttempts return number of how many this message enter the consumer
+func (m *Message) GetAttempts() int32 {
+	return m.attempts
+}
+
+// GetBody return body of message
+func (m *Message) GetBody() []byte {
+	return m.Value
+}
+
+// GetID return the topic/partition/offset of the message
+func (m *Message) GetID() string {
+	return m.id()
+}
+
+// GetHeaders return the kafka headers as string values, the last value wins on duplicated keys
+func (m *Message) GetHeaders() map[string]interface{} {
+	if len(m.Headers) == 0 {
+		return nil
+	}
+
+	headers := make(map[string]interface{}, len(m.Headers))
+	for _, h := range m.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+
+	return headers
+}
+
+// GetCorrelationID return the correlation-id header
+func (m *Message) GetCorrelationID() string {
+	v, _ := getHeader(m.Message, headerCorrelationID)
+	return v
+}
+
+// GetTimestamp return the kafka message time
+func (m *Message) GetTimestamp() time.Time {
+	return m.Time
+}
+
+// GetContentType return the content-type header
+func (m *Message) GetContentType() string {
+	v, _ := getHeader(m.Message, headerContentType)
+	return v
+}
+
+// Touch does nothing, kafka has no per message lease
+func (m *Message) Touch() {}
+
+// GetFirstSeen return when a consumer received the message for the first time, carried by the first-seen header
+func (m *Message) GetFirstSeen() time.Time {
+	return m.firstSeen
+}
+
+// GetLastError return the error of the previous attempt, carried by the last-error header
+func (m *Message) GetLastError() string {
+	return m.lastError
+}
+
+func getHeader(msg kafka.Message, key string) (string, bool) {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value), true
+		}
+	}
+
+	return "", false
+}
+
+func getAttempts(msg kafka.Message) int32 {
+	v, ok := getHeader(msg, headerAttempts)
+	if !ok {
+		return 0
+	}
+
+	attempts, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return 0
+	}
+
+	return int32(attempts)
+}
+
+func getRetryAt(msg kafka.Message) time.Time {
+	return getTime(msg, headerRetryAt)
+}
+
+// getTime parse the unix milliseconds header, zero when missing or invalid
+func getTime(msg kafka.Message, key string) time.Time {
+	v, ok := getHeader(msg, key)
+	if !ok {
+		return time.Time{}
+	}
+
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(ms)
+}
@@ -0,0 +1,484 @@
+package mema
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+// Broker is an in-memory broker implementing both adapter.IConsumerAdapter and adapter.IPublisherAdapter.
+// It is meant to test handlers without a real broker: time is virtual and only moves through Advance,
+// and every delivery, ack and dead-letter is recorded for inspection
+type Broker struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	seq     int64
+	running bool
+	closed  bool
+
+	consumers []*consumer
+	inFlight  map[*Message]struct{}
+	wg        sync.WaitGroup
+
+	// ctx is the root of the handler contexts, cancelled once the shutdown gave up waiting
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	delivered    []Record
+	acked        []Record
+	requeued     []Record
+	deadLettered []Record
+
+	retryPolicy adapter.RetryPolicy
+	classify    func(err error) bool
+}
+
+// Record is a snapshot of a message at the time of an event
+type Record struct {
+	ID       string
+	Topic    string
+	Channel  string
+	Body     []byte
+	Attempts int32
+	Time     time.Time
+}
+
+type entry struct {
+	id          string
+	topic       string
+	body        []byte
+	contentType string
+	readyAt     time.Time
+	attempts    int32
+	publishedAt time.Time
+	firstSeen   time.Time
+	lastError   string
+}
+
+type consumer struct {
+	handler adapter.ConsumerHandler
+	pending []*entry
+}
+
+// BrokerOptions option to modify the broker
+type BrokerOptions func(*Broker)
+
+// WithStartTime set the initial virtual time, default: 2000-01-01 UTC
+func WithStartTime(t time.Time) BrokerOptions {
+	return func(b *Broker) {
+		b.now = t
+	}
+}
+
+// WithRetryPolicy set the delay before the next attempt of a failed message,
+// default: exponential from 1 second up to 10 minutes without jitter so tests are deterministic
+func WithRetryPolicy(policy adapter.RetryPolicy) BrokerOptions {
+	return func(b *Broker) {
+		b.retryPolicy = policy
+	}
+}
+
+// WithErrorClassifier report the handler errors that are permanent besides adapter.Permanent ones,
+// they are dead-lettered without retrying
+func WithErrorClassifier(classify func(err error) bool) BrokerOptions {
+	return func(b *Broker) {
+		b.classify = classify
+	}
+}
+
+// NewBroker will instantiate the in-memory broker
+func NewBroker(opt ...BrokerOptions) *Broker {
+	b := &Broker{
+		now:      time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		inFlight: make(map[*Message]struct{}),
+		retryPolicy: adapter.ExponentialBackoff{
+			Base: time.Second,
+			Max:  10 * time.Minute,
+		},
+	}
+	b.cond = sync.NewCond(&b.mu)
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opt {
+		opt(b)
+	}
+
+	return b
+}
+
+// RegisterConsumerHandler will register the consumer handler, disabled handler is skipped.
+// Every consumer of a topic receive its own copy of the published messages
+func (b *Broker) RegisterConsumerHandler(handler adapter.ConsumerHandler) error {
+	if !handler.Enable {
+		return nil
+	}
+
+	if handler.BatchHandler != nil {
+		return adapter.ErrBatchNotSupported
+	}
+
+	if handler.Handler == nil {
+		return fmt.Errorf("no consumer handler specified")
+	}
+
+	if handler.Concurrent < 1 {
+		handler.Concurrent = 1
+	}
+
+	if handler.MaxAttempts < 1 {
+		handler.MaxAttempts = 1
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consumers = append(b.consumers, &consumer{handler: handler})
+	return nil
+}
+
+// Run start Concurrent workers for every registered consumer
+func (b *Broker) Run() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.running {
+		return fmt.Errorf("broker already running")
+	}
+	b.running = true
+
+	for _, c := range b.consumers {
+		for i := 0; i < c.handler.Concurrent; i++ {
+			b.wg.Add(1)
+			go b.work(c)
+		}
+	}
+
+	return nil
+}
+
+// Shutdown stop the workers and wait for the in-flight handlers until the context is done.
+// Messages still in-flight after that are put back to pending and reported in *adapter.ShutdownError
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	defer b.cancel()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var abandoned []adapter.AbandonedMessage
+	for m := range b.inFlight {
+		if m.responded {
+			continue
+		}
+		m.responded = true
+
+		m.entry.readyAt = b.now
+		m.consumer.pending = append(m.consumer.pending, m.entry)
+		abandoned = append(abandoned, adapter.AbandonedMessage{
+			Topic:     m.entry.topic,
+			MessageID: m.entry.id,
+			Attempts:  m.attempts,
+		})
+	}
+
+	if len(abandoned) > 0 {
+		return &adapter.ShutdownError{Abandoned: abandoned}
+	}
+
+	return nil
+}
+
+// Close stop the workers after their current message
+func (b *Broker) Close() error {
+	return b.Shutdown(context.Background())
+}
+
+// Publish will deliver the body to every consumer of the topic
+func (b *Broker) Publish(ctx context.Context, topic string, body []byte) error {
+	return b.PublishWithDelay(ctx, topic, body, 0)
+}
+
+// PublishWithDelay will deliver the body to every consumer of the topic once the virtual time passed the delay
+func (b *Broker) PublishWithDelay(ctx context.Context, topic string, body []byte, delay time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.enqueue(topic, body, adapter.ContentTypeFromContext(ctx), delay)
+	b.cond.Broadcast()
+	return nil
+}
+
+// PublishBatch will deliver all the bodies to every consumer of the topic
+func (b *Broker) PublishBatch(ctx context.Context, topic string, bodies [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, body := range bodies {
+		b.enqueue(topic, body, adapter.ContentTypeFromContext(ctx), 0)
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+func (b *Broker) enqueue(topic string, body []byte, contentType string, delay time.Duration) {
+	b.seq++
+	id := strconv.FormatInt(b.seq, 10)
+
+	for _, c := range b.consumers {
+		if c.handler.Topic != topic {
+			continue
+		}
+
+		c.pending = append(c.pending, &entry{
+			id:          id,
+			topic:       topic,
+			body:        append([]byte(nil), body...),
+			contentType: contentType,
+			readyAt:     b.now.Add(delay),
+			publishedAt: b.now,
+		})
+	}
+}
+
+// Now return the current virtual time
+func (b *Broker) Now() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.now
+}
+
+// Advance move the virtual time forward, delayed and requeued messages become ready once their time passed
+func (b *Broker) Advance(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.now = b.now.Add(d)
+	b.cond.Broadcast()
+}
+
+// Flush block until every ready message is handled, messages waiting for the virtual time are left pending.
+// It returns immediately when the broker is not running
+func (b *Broker) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.running && !b.closed && (len(b.inFlight) > 0 || b.hasReady()) {
+		b.cond.Wait()
+	}
+}
+
+// AdvanceAndFlush move the virtual time forward step by step until d passed, flushing after every step,
+// so backoff chains shorter than d are fully processed
+func (b *Broker) AdvanceAndFlush(d, step time.Duration) {
+	if step <= 0 {
+		step = d
+	}
+
+	b.Flush()
+	for passed := time.Duration(0); passed < d; passed += step {
+		b.Advance(step)
+		b.Flush()
+	}
+}
+
+func (b *Broker) hasReady() bool {
+	for _, c := range b.consumers {
+		if b.nextReady(c) >= 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextReady return the index of the earliest ready message of the consumer or -1
+func (b *Broker) nextReady(c *consumer) int {
+	idx := -1
+	for i, e := range c.pending {
+		if e.readyAt.After(b.now) {
+			continue
+		}
+		if idx < 0 || e.readyAt.Before(c.pending[idx].readyAt) {
+			idx = i
+		}
+	}
+
+	return idx
+}
+
+func (b *Broker) work(c *consumer) {
+	defer b.wg.Done()
+
+	for {
+		b.mu.Lock()
+		idx := b.nextReady(c)
+		for !b.closed && idx < 0 {
+			b.cond.Wait()
+			idx = b.nextReady(c)
+		}
+
+		if b.closed {
+			b.mu.Unlock()
+			return
+		}
+
+		e := c.pending[idx]
+		c.pending = append(c.pending[:idx], c.pending[idx+1:]...)
+		e.attempts++
+		if e.firstSeen.IsZero() {
+			e.firstSeen = b.now
+		}
+
+		msg := &Message{
+			entry:     e,
+			consumer:  c,
+			broker:    b,
+			attempts:  e.attempts,
+			firstSeen: e.firstSeen,
+			lastError: e.lastError,
+		}
+		b.inFlight[msg] = struct{}{}
+		b.record(&b.delivered, msg)
+		b.mu.Unlock()
+
+		b.handle(c, msg)
+
+		b.mu.Lock()
+		delete(b.inFlight, msg)
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	}
+}
+
+func (b *Broker) handle(c *consumer, msg *Message) {
+	err := c.handler.Invoke(b.ctx, adapter.Metadata{
+		Topic:     msg.entry.topic,
+		Channel:   c.handler.Channel,
+		MessageID: msg.entry.id,
+		Attempts:  msg.attempts,
+	}, msg)
+	if err != nil {
+		b.mu.Lock()
+		msg.entry.lastError = err.Error()
+		b.mu.Unlock()
+	}
+
+	if err != nil && (adapter.IsPermanent(err) || (b.classify != nil && b.classify(err))) {
+		msg.deadLetter()
+		return
+	}
+
+	if err != nil {
+		msg.Requeue(b.retryPolicy.Backoff(msg.GetAttempts()))
+		return
+	}
+
+	msg.Finish()
+}
+
+// respond run fn once per delivery under the broker lock
+func (b *Broker) respond(m *Message, fn func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if m.responded {
+		return
+	}
+	m.responded = true
+
+	fn()
+	b.cond.Broadcast()
+}
+
+func (b *Broker) record(records *[]Record, m *Message) {
+	*records = append(*records, Record{
+		ID:       m.entry.id,
+		Topic:    m.entry.topic,
+		Channel:  m.consumer.handler.Channel,
+		Body:     m.entry.body,
+		Attempts: m.attempts,
+		Time:     b.now,
+	})
+}
+
+// Delivered return every delivery of the topic, a requeued message is recorded once per attempt
+func (b *Broker) Delivered(topic string) []Record {
+	return b.filter(&b.delivered, topic)
+}
+
+// Acked return the finished messages of the topic
+func (b *Broker) Acked(topic string) []Record {
+	return b.filter(&b.acked, topic)
+}
+
+// Requeued return the requeued deliveries of the topic
+func (b *Broker) Requeued(topic string) []Record {
+	return b.filter(&b.requeued, topic)
+}
+
+// DeadLettered return the messages of the topic that reached the max attempts
+func (b *Broker) DeadLettered(topic string) []Record {
+	return b.filter(&b.deadLettered, topic)
+}
+
+// Pending return the number of messages of the topic waiting to be delivered, including the delayed ones
+func (b *Broker) Pending(topic string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for _, c := range b.consumers {
+		for _, e := range c.pending {
+			if e.topic == topic {
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+func (b *Broker) filter(records *[]Record, topic string) []Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var result []Record
+	for _, r := range *records {
+		if r.Topic == topic {
+			result = append(result, r)
+		}
+	}
+
+	return result
+}
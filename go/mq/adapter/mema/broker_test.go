@@ -0,0 +1,375 @@
+package mema
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+func newRunningBroker(t *testing.T, handlers ...adapter.ConsumerHandler) *Broker {
+	t.Helper()
+
+	return runBroker(t, NewBroker(), handlers...)
+}
+
+func runBroker(t *testing.T, b *Broker, handlers ...adapter.ConsumerHandler) *Broker {
+	t.Helper()
+
+	for _, h := range handlers {
+		h.Enable = true
+		if err := b.RegisterConsumerHandler(h); err != nil {
+			t.Fatalf("RegisterConsumerHandler() error = %v", err)
+		}
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	t.Cleanup(func() { _ = b.Close() })
+
+	return b
+}
+
+func TestBroker_Finish(t *testing.T) {
+	b := newRunningBroker(t, adapter.ConsumerHandler{
+		Topic: "orders",
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			return nil
+		},
+	})
+
+	_ = b.PublishBatch(context.Background(), "orders", [][]byte{[]byte("1"), []byte("2")})
+	b.Flush()
+
+	if got := len(b.Acked("orders")); got != 2 {
+		t.Errorf("acked = %d, want 2", got)
+	}
+	if got := b.Pending("orders"); got != 0 {
+		t.Errorf("pending = %d, want 0", got)
+	}
+}
+
+func TestBroker_Backoff(t *testing.T) {
+	b := newRunningBroker(t, adapter.ConsumerHandler{
+		Topic:       "orders",
+		MaxAttempts: 3,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			return errors.New("failing")
+		},
+	})
+
+	_ = b.Publish(context.Background(), "orders", []byte("1"))
+	b.Flush()
+
+	if got := len(b.Delivered("orders")); got != 1 {
+		t.Fatalf("delivered = %d, want 1", got)
+	}
+
+	// first backoff is 1s, nothing happens before it passed
+	b.Advance(999 * time.Millisecond)
+	b.Flush()
+	if got := len(b.Delivered("orders")); got != 1 {
+		t.Fatalf("delivered before backoff = %d, want 1", got)
+	}
+
+	b.Advance(time.Millisecond)
+	b.Flush()
+	if got := len(b.Delivered("orders")); got != 2 {
+		t.Fatalf("delivered after backoff = %d, want 2", got)
+	}
+
+	// second backoff is 2s
+	b.Advance(2 * time.Second)
+	b.Flush()
+
+	dead := b.DeadLettered("orders")
+	if len(dead) != 1 {
+		t.Fatalf("dead lettered = %d, want 1", len(dead))
+	}
+	if dead[0].Attempts != 3 {
+		t.Errorf("dead letter attempts = %d, want 3", dead[0].Attempts)
+	}
+	if got := len(b.Requeued("orders")); got != 2 {
+		t.Errorf("requeued = %d, want 2", got)
+	}
+}
+
+func TestBroker_RetryPolicy(t *testing.T) {
+	errInvalid := errors.New("invalid")
+
+	b := runBroker(t, NewBroker(
+		WithRetryPolicy(adapter.FixedBackoff{Delay: 5 * time.Second}),
+		WithErrorClassifier(func(err error) bool { return errors.Is(err, errInvalid) }),
+	), adapter.ConsumerHandler{
+		Topic:       "orders",
+		MaxAttempts: 5,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			if string(message.GetBody()) == "invalid" {
+				return fmt.Errorf("decode: %w", errInvalid)
+			}
+			return errors.New("failing")
+		},
+	})
+
+	_ = b.Publish(context.Background(), "orders", []byte("invalid"))
+	_ = b.Publish(context.Background(), "orders", []byte("1"))
+	b.Flush()
+
+	if got := len(b.DeadLettered("orders")); got != 1 {
+		t.Errorf("dead lettered = %d, want 1", got)
+	}
+
+	b.Advance(4 * time.Second)
+	b.Flush()
+	if got := len(b.Delivered("orders")); got != 2 {
+		t.Fatalf("delivered before the retry delay = %d, want 2", got)
+	}
+
+	b.Advance(time.Second)
+	b.Flush()
+	if got := len(b.Delivered("orders")); got != 3 {
+		t.Errorf("delivered after the retry delay = %d, want 3", got)
+	}
+}
+
+func TestBroker_RequeueDelay(t *testing.T) {
+	b := newRunningBroker(t, adapter.ConsumerHandler{
+		Topic:       "orders",
+		MaxAttempts: 5,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			if message.GetAttempts() < 3 {
+				message.RequeueWithoutBackoff(time.Minute)
+			}
+			return nil
+		},
+	})
+
+	_ = b.PublishWithDelay(context.Background(), "orders", []byte("1"), time.Minute)
+	b.AdvanceAndFlush(3*time.Minute, time.Minute)
+
+	acked := b.Acked("orders")
+	if len(acked) != 1 {
+		t.Fatalf("acked = %d, want 1", len(acked))
+	}
+	if want := NewBroker().Now().Add(3 * time.Minute); !acked[0].Time.Equal(want) {
+		t.Errorf("acked at %v, want %v", acked[0].Time, want)
+	}
+}
+
+func TestBroker_Concurrent(t *testing.T) {
+	var (
+		running int32
+		peak    int32
+		release = make(chan struct{})
+		once    sync.Once
+	)
+
+	b := newRunningBroker(t, adapter.ConsumerHandler{
+		Topic:      "orders",
+		Concurrent: 3,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+
+			if n == 3 {
+				once.Do(func() { close(release) })
+			}
+			<-release
+			return nil
+		},
+	})
+
+	for i := 0; i < 6; i++ {
+		_ = b.Publish(context.Background(), "orders", []byte("1"))
+	}
+	b.Flush()
+
+	if peak := atomic.LoadInt32(&peak); peak != 3 {
+		t.Errorf("peak concurrency = %d, want 3", peak)
+	}
+}
+
+func TestBroker_SkipDisabled(t *testing.T) {
+	b := NewBroker()
+	_ = b.RegisterConsumerHandler(adapter.ConsumerHandler{
+		Topic: "orders",
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			return nil
+		},
+	})
+
+	_ = b.Publish(context.Background(), "orders", []byte("1"))
+	if got := b.Pending("orders"); got != 0 {
+		t.Errorf("pending = %d, want 0", got)
+	}
+}
+
+func TestBroker_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	b := NewBroker()
+	_ = b.RegisterConsumerHandler(adapter.ConsumerHandler{
+		Topic:  "orders",
+		Enable: true,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			close(started)
+			<-release
+			return nil
+		},
+	})
+	_ = b.Run()
+
+	_ = b.Publish(context.Background(), "orders", []byte("1"))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := b.Shutdown(ctx)
+
+	var shutdownErr *adapter.ShutdownError
+	if !errors.As(err, &shutdownErr) {
+		t.Fatalf("Shutdown() error = %v, want *adapter.ShutdownError", err)
+	}
+	if len(shutdownErr.Abandoned) != 1 || shutdownErr.Abandoned[0].Topic != "orders" {
+		t.Errorf("abandoned = %+v, want one orders message", shutdownErr.Abandoned)
+	}
+	if got := b.Pending("orders"); got != 1 {
+		t.Errorf("pending = %d, want 1", got)
+	}
+}
+
+func TestBroker_HandlerTimeout(t *testing.T) {
+	b := newRunningBroker(t, adapter.ConsumerHandler{
+		Topic:       "orders",
+		MaxAttempts: 2,
+		Timeout:     10 * time.Millisecond,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}, adapter.ConsumerHandler{
+		Topic:       "orders",
+		Channel:     "observer",
+		MaxAttempts: 2,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			return nil
+		},
+	})
+
+	_ = b.Publish(context.Background(), "orders", []byte("1"))
+	b.Flush()
+
+	requeued := b.Requeued("orders")
+	if len(requeued) != 1 || requeued[0].Channel != "" {
+		t.Errorf("requeued = %+v, want the timed out message", requeued)
+	}
+}
+
+func TestBroker_HandlerTimeoutWaitsForHandler(t *testing.T) {
+	var running, overlapped int32
+	b := newRunningBroker(t, adapter.ConsumerHandler{
+		Topic:       "orders",
+		MaxAttempts: 2,
+		Concurrent:  2,
+		Timeout:     5 * time.Millisecond,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.StoreInt32(&overlapped, 1)
+			}
+			defer atomic.AddInt32(&running, -1)
+
+			// ignore the context on purpose, the worker must wait for the handler
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		},
+	})
+
+	_ = b.Publish(context.Background(), "orders", []byte("1"))
+	b.Flush()
+
+	if got := len(b.Acked("orders")); got != 1 {
+		t.Errorf("acked = %d, want 1", got)
+	}
+	if got := len(b.Requeued("orders")); got != 0 {
+		t.Errorf("requeued = %d, want 0", got)
+	}
+	if atomic.LoadInt32(&overlapped) != 0 {
+		t.Error("the message was handled twice at once")
+	}
+}
+
+func TestBroker_Metadata(t *testing.T) {
+	var (
+		got       adapter.Metadata
+		timestamp time.Time
+	)
+	b := newRunningBroker(t, adapter.ConsumerHandler{
+		Topic:   "orders",
+		Channel: "billing",
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			got, _ = adapter.MetadataFromContext(ctx)
+			timestamp = message.GetTimestamp()
+			return nil
+		},
+	})
+
+	_ = b.Publish(context.Background(), "orders", []byte("1"))
+	b.Flush()
+
+	want := adapter.Metadata{Topic: "orders", Channel: "billing", MessageID: b.Acked("orders")[0].ID, Attempts: 1}
+	if got != want {
+		t.Errorf("metadata = %+v, want %+v", got, want)
+	}
+	if !timestamp.Equal(b.Now()) {
+		t.Errorf("timestamp = %v, want %v", timestamp, b.Now())
+	}
+}
+
+func TestBroker_FirstSeenAndLastError(t *testing.T) {
+	var (
+		firstSeen  []time.Time
+		lastErrors []string
+	)
+	b := newRunningBroker(t, adapter.ConsumerHandler{
+		Topic:       "orders",
+		MaxAttempts: 3,
+		Handler: func(ctx context.Context, message adapter.IMessage) error {
+			firstSeen = append(firstSeen, message.GetFirstSeen())
+			lastErrors = append(lastErrors, message.GetLastError())
+			return fmt.Errorf("attempt %d failed", message.GetAttempts())
+		},
+	})
+
+	start := b.Now()
+	_ = b.Publish(context.Background(), "orders", []byte("1"))
+	b.AdvanceAndFlush(time.Minute, time.Second)
+
+	wantErrors := []string{"", "attempt 1 failed", "attempt 2 failed"}
+	if len(lastErrors) != len(wantErrors) {
+		t.Fatalf("deliveries = %d, want %d", len(lastErrors), len(wantErrors))
+	}
+	for i := range wantErrors {
+		if lastErrors[i] != wantErrors[i] {
+			t.Errorf("attempt %d last error = %q, want %q", i+1, lastErrors[i], wantErrors[i])
+		}
+		if !firstSeen[i].Equal(start) {
+			t.Errorf("attempt %d first seen = %v, want %v", i+1, firstSeen[i], start)
+		}
+	}
+}
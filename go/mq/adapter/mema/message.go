@@ -0,0 +1,100 @@
+package mema
+
+import (
+	"time"
+)
+
+// Message is a delivery of an in-memory message to a consumer
+type Message struct {
+	entry    *entry
+	consumer *consumer
+	broker   *Broker
+	attempts int32
+
+	// firstSeen and lastError are copied from the entry at delivery, the entry is only read under the broker lock
+	firstSeen time.Time
+	lastError string
+
+	responded bool
+}
+
+// Finish mark the message as acknowledged
+func (m *Message) Finish() {
+	m.broker.respond(m, func() {
+		m.broker.record(&m.broker.acked, m)
+	})
+}
+
+// RequeueWithoutBackoff put the message back, it is delivered again once the virtual time passed the delay
+func (m *Message) RequeueWithoutBackoff(delay time.Duration) {
+	m.Requeue(delay)
+}
+
+// Requeue put the message back or dead-letter it when the max attempts is reached
+func (m *Message) Requeue(delay time.Duration) {
+	m.broker.respond(m, func() {
+		if m.attempts >= m.consumer.handler.MaxAttempts {
+			m.broker.record(&m.broker.deadLettered, m)
+			return
+		}
+
+		m.broker.record(&m.broker.requeued, m)
+		m.entry.readyAt = m.broker.now.Add(delay)
+		m.consumer.pending = append(m.consumer.pending, m.entry)
+	})
+}
+
+// deadLetter record the message as dead-lettered regardless of the attempts
+func (m *Message) deadLetter() {
+	m.broker.respond(m, func() {
+		m.broker.record(&m.broker.deadLettered, m)
+	})
+}
+
+// GetAttempts return number of how many this message enter the consumer
+func (m *Message) GetAttempts() int32 {
+	return m.attempts
+}
+
+// GetBody return body of message
+func (m *Message) GetBody() []byte {
+	return m.entry.body
+}
+
+// GetID return the broker sequence id of the message
+func (m *Message) GetID() string {
+	return m.entry.id
+}
+
+// GetHeaders return nil, in-memory messages have no headers
+func (m *Message) GetHeaders() map[string]interface{} {
+	return nil
+}
+
+// GetCorrelationID return empty string, in-memory messages have no correlation id
+func (m *Message) GetCorrelationID() string {
+	return ""
+}
+
+// GetTimestamp return the virtual time the message was published
+func (m *Message) GetTimestamp() time.Time {
+	return m.entry.publishedAt
+}
+
+// GetContentType return the content type set by adapter.WithContentType when publishing
+func (m *Message) GetContentType() string {
+	return m.entry.contentType
+}
+
+// Touch does nothing, in-memory messages have no lease
+func (m *Message) Touch() {}
+
+// GetFirstSeen return the virtual time the message was delivered for the first time
+func (m *Message) GetFirstSeen() time.Time {
+	return m.firstSeen
+}
+
+// GetLastError return the error of the previous attempt
+func (m *Message) GetLastError() string {
+	return m.lastError
+}
@@ -0,0 +1,27 @@
+package adapter
+
+import (
+	"fmt"
+)
+
+// Middleware wrap a Handler to run code around every message
+type Middleware func(Handler) Handler
+
+// Chain wrap the handler with the middlewares, the first middleware is the outermost
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// PanicError is the error of a recovered handler panic
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("mq: handler panic: %v", e.Value)
+}
@@ -0,0 +1,329 @@
+package nsqa
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/reyhanfahlevi/pkg/go/log"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	pkgnsq "github.com/reyhanfahlevi/pkg/go/nsq"
+)
+
+// Consumer run a single adapter.ConsumerHandler on top of go-nsq consumer
+type Consumer struct {
+	consumer *nsq.Consumer
+	mu       sync.Mutex
+	inFlight map[*nsq.Message]struct{}
+
+	// ctx is the root of the handler contexts, cancelled once the shutdown gave up waiting
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	handler       adapter.ConsumerHandler
+	handlerConfig HandlerConfig
+
+	// batches carry the messages from the go-nsq handlers to the batch worker
+	batches chan *Message
+}
+
+// HandlerConfig is the nsq specific config parsed from adapter.ConsumerHandler ExtraConfig.
+// When both addresses are empty the comma separated URL is used,
+// connecting to nsqlookupd first and falling back to nsqd
+type HandlerConfig struct {
+	LookupdAddresses []string `json:"lookupd_addresses,omitempty"`
+	NSQDAddresses    []string `json:"nsqd_addresses,omitempty"`
+
+	// FailFast raise the handler panic again after logging it, crashing the process instead of requeueing
+	FailFast bool `json:"fail_fast,omitempty"`
+}
+
+// NewConsumer will instantiate the nsq consumer for the handler
+func NewConsumer(handler adapter.ConsumerHandler) *Consumer {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Consumer{
+		handler:  handler,
+		inFlight: make(map[*nsq.Message]struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Run will create the go-nsq consumer and connect it to nsqlookupd or nsqd
+func (c *Consumer) Run() error {
+	if c.handler.Handler == nil && c.handler.BatchHandler == nil {
+		return fmt.Errorf("no consumer handler specified")
+	}
+
+	handlerConfig := HandlerConfig{}
+	if err := c.handler.ParseExtraConfig(&handlerConfig); err != nil {
+		return fmt.Errorf("failed to parse extra config: %w", err)
+	}
+	c.handlerConfig = handlerConfig
+
+	cfg := nsq.NewConfig()
+	if c.handler.MaxAttempts > 0 {
+		cfg.MaxAttempts = math.MaxUint16
+		if c.handler.MaxAttempts < math.MaxUint16 {
+			cfg.MaxAttempts = uint16(c.handler.MaxAttempts)
+		}
+	}
+	if c.handler.MaxInFlight > 0 {
+		cfg.MaxInFlight = c.handler.MaxInFlight
+	}
+
+	if c.handler.BatchHandler != nil {
+		if c.handler.BatchSize < 1 {
+			c.handler.BatchSize = adapter.DefaultBatchSize
+		}
+
+		// nsqd must deliver a full batch before any of it is finished
+		if cfg.MaxInFlight < c.handler.BatchSize {
+			cfg.MaxInFlight = c.handler.BatchSize
+		}
+	}
+
+	q, err := nsq.NewConsumer(c.handler.Topic, c.handler.Channel, cfg)
+	if err != nil {
+		return err
+	}
+
+	handler := c.handle()
+	if c.handler.BatchHandler != nil {
+		handler = c.collect()
+		c.batches = make(chan *Message, c.handler.BatchSize)
+		go c.workBatch(q.StopChan)
+	}
+
+	if c.handler.Concurrent > 1 {
+		q.AddConcurrentHandlers(handler, c.handler.Concurrent)
+	} else {
+		q.AddHandler(handler)
+	}
+
+	if err := c.connect(q); err != nil {
+		q.Stop()
+		return err
+	}
+
+	c.consumer = q
+	return nil
+}
+
+// connector is the part of *nsq.Consumer connecting it to nsqlookupd or nsqd
+type connector interface {
+	ConnectToNSQLookupds(addresses []string) error
+	ConnectToNSQDs(addresses []string) error
+}
+
+func (c *Consumer) connect(q connector) error {
+	switch {
+	case len(c.handlerConfig.LookupdAddresses) > 0:
+		return q.ConnectToNSQLookupds(c.handlerConfig.LookupdAddresses)
+	case len(c.handlerConfig.NSQDAddresses) > 0:
+		return q.ConnectToNSQDs(c.handlerConfig.NSQDAddresses)
+	}
+
+	addresses := splitAddresses(c.handler.URL)
+	if len(addresses) == 0 {
+		return fmt.Errorf("no nsqlookupd or nsqd address specified")
+	}
+
+	err := q.ConnectToNSQLookupds(addresses)
+	if err != nil {
+		err = q.ConnectToNSQDs(addresses)
+	}
+
+	return err
+}
+
+func splitAddresses(url string) []string {
+	var addresses []string
+	for _, addr := range strings.Split(url, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addresses = append(addresses, addr)
+		}
+	}
+
+	return addresses
+}
+
+// handle will convert the adapter.Handler into nsq.HandlerFunc
+func (c *Consumer) handle() nsq.HandlerFunc {
+	return func(message *nsq.Message) error {
+		c.mu.Lock()
+		c.inFlight[message] = struct{}{}
+		c.mu.Unlock()
+
+		defer func() {
+			c.mu.Lock()
+			delete(c.inFlight, message)
+			c.mu.Unlock()
+		}()
+
+		md := adapter.Metadata{
+			Topic:     c.handler.Topic,
+			Channel:   c.handler.Channel,
+			MessageID: string(message.ID[:]),
+			Attempts:  int32(message.Attempts),
+		}
+
+		trace, body := pkgnsq.UnwrapTrace(message.Body)
+		message.Body = body
+
+		handler := c.handler
+		handler.Handler = adapter.RecoverHandler(handler.Handler, c.handlerConfig.FailFast, map[string]interface{}{"topic": c.handler.Topic})
+
+		err := handler.Invoke(c.ctx, md, &Message{Message: message, trace: trace})
+		if adapter.IsPermanent(err) {
+			finishPermanent(message, md, err)
+			return nil
+		}
+
+		return err
+	}
+}
+
+// finishPermanent log the message failed with a permanent error and finish it,
+// nsq has no dead-letter queue, the message is logged and finished like nsq does on max attempts
+func finishPermanent(message *nsq.Message, md adapter.Metadata, err error) {
+	fields := md.Fields()
+	fields["message_id"] = string(message.ID[:])
+	fields["attempts"] = int32(message.Attempts)
+	fields["body"] = string(message.Body)
+	log.ErrorWithFields(err.Error(), fields)
+
+	message.Finish()
+}
+
+// collect will hand the messages to the batch worker, which responds to them once their batch is handled
+func (c *Consumer) collect() nsq.HandlerFunc {
+	return func(message *nsq.Message) error {
+		message.DisableAutoResponse()
+
+		c.mu.Lock()
+		c.inFlight[message] = struct{}{}
+		c.mu.Unlock()
+
+		trace, body := pkgnsq.UnwrapTrace(message.Body)
+		message.Body = body
+
+		select {
+		case c.batches <- &Message{Message: message, trace: trace}:
+		case <-c.ctx.Done():
+			// the shutdown gave up on the batch worker, nsqd redeliver the message after its timeout
+		}
+
+		return nil
+	}
+}
+
+// workBatch hand the collected messages to the batch handler until the consumer stopped,
+// every message is finished or requeued with its own result
+func (c *Consumer) workBatch(stop <-chan int) {
+	done := make(chan struct{})
+	go func() {
+		<-stop
+		close(done)
+	}()
+
+	for {
+		batch, ok := adapter.NextBatch(done, c.batches, c.handler.BatchSize, c.handler.BatchWait)
+		if !ok {
+			return
+		}
+
+		c.handleBatch(batch)
+	}
+}
+
+func (c *Consumer) handleBatch(batch []*Message) {
+	md := adapter.Metadata{
+		Topic:   c.handler.Topic,
+		Channel: c.handler.Channel,
+	}
+
+	messages := make([]adapter.IMessage, len(batch))
+	for i, message := range batch {
+		messages[i] = message
+	}
+
+	handler := c.handler
+	handler.BatchHandler = adapter.RecoverBatchHandler(handler.BatchHandler, c.handlerConfig.FailFast, map[string]interface{}{"topic": c.handler.Topic})
+
+	err := handler.InvokeBatch(c.ctx, md, messages)
+	if err != nil {
+		fields := md.Fields()
+		fields["batch_size"] = len(batch)
+		log.ErrorWithFields(err.Error(), fields)
+	}
+
+	for i, result := range adapter.BatchResults(err, len(batch)) {
+		message := batch[i].Message
+
+		switch {
+		case message.HasResponded():
+		case result == nil:
+			message.Finish()
+		case adapter.IsPermanent(result):
+			finishPermanent(message, md, result)
+		default:
+			message.Requeue(-1)
+		}
+
+		c.mu.Lock()
+		delete(c.inFlight, message)
+		c.mu.Unlock()
+	}
+}
+
+// Shutdown stop the consumer and wait for the in-flight handlers until the context is done.
+// Messages still in-flight after that are requeued immediately and reported in *adapter.ShutdownError
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	if c.consumer == nil {
+		return nil
+	}
+
+	c.consumer.Stop()
+	defer c.cancel()
+
+	select {
+	case <-c.consumer.StopChan:
+		return nil
+	case <-ctx.Done():
+		c.cancel()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var abandoned []adapter.AbandonedMessage
+	for message := range c.inFlight {
+		if message.HasResponded() {
+			continue
+		}
+
+		message.RequeueWithoutBackoff(0)
+		abandoned = append(abandoned, adapter.AbandonedMessage{
+			Topic:     c.handler.Topic,
+			MessageID: string(message.ID[:]),
+			Attempts:  int32(message.Attempts),
+		})
+	}
+
+	if len(abandoned) > 0 {
+		return &adapter.ShutdownError{Abandoned: abandoned}
+	}
+
+	return nil
+}
+
+// Close stop the consumer and wait until all the handlers returned
+func (c *Consumer) Close() error {
+	return c.Shutdown(context.Background())
+}
@@ -0,0 +1,337 @@
+package nsqa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+// responseRecorder record how the messages were responded to nsqd
+type responseRecorder struct {
+	mu       sync.Mutex
+	finished []string
+	requeued []string
+}
+
+func (r *responseRecorder) OnFinish(m *nsq.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finished = append(r.finished, string(m.Body))
+}
+
+func (r *responseRecorder) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requeued = append(r.requeued, string(m.Body))
+}
+
+func (r *responseRecorder) OnTouch(m *nsq.Message) {}
+
+func newTestMessage(recorder *responseRecorder, id byte, body string) *nsq.Message {
+	message := nsq.NewMessage(nsq.MessageID{id}, []byte(body))
+	message.Delegate = recorder
+	message.Attempts = 1
+	message.DisableAutoResponse()
+
+	return message
+}
+
+func TestConsumer_handleBatch(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name         string
+		handler      adapter.BatchHandler
+		wantFinished []string
+		wantRequeued []string
+	}{
+		{
+			name: "Test batch succeeded",
+			handler: func(ctx context.Context, messages []adapter.IMessage) error {
+				return nil
+			},
+			wantFinished: []string{"a", "b", "c"},
+		}, {
+			name: "Test batch partially failed",
+			handler: func(ctx context.Context, messages []adapter.IMessage) error {
+				result := adapter.NewBatchError(len(messages))
+				result.Fail(1, errFailed)
+				result.Fail(2, adapter.Permanent(errFailed))
+				return result.Err()
+			},
+			wantFinished: []string{"a", "c"},
+			wantRequeued: []string{"b"},
+		}, {
+			name: "Test whole batch failed",
+			handler: func(ctx context.Context, messages []adapter.IMessage) error {
+				return errFailed
+			},
+			wantRequeued: []string{"a", "b", "c"},
+		}, {
+			name: "Test batch handler panicked",
+			handler: func(ctx context.Context, messages []adapter.IMessage) error {
+				panic("boom")
+			},
+			wantRequeued: []string{"a", "b", "c"},
+		}, {
+			name: "Test message responded by the handler",
+			handler: func(ctx context.Context, messages []adapter.IMessage) error {
+				messages[0].Finish()
+				return errFailed
+			},
+			wantFinished: []string{"a"},
+			wantRequeued: []string{"b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &responseRecorder{}
+			c := NewConsumer(adapter.ConsumerHandler{Topic: "orders", Channel: "billing", BatchHandler: tt.handler})
+
+			var batch []*Message
+			for i, body := range []string{"a", "b", "c"} {
+				message := newTestMessage(recorder, byte(i), body)
+				c.inFlight[message] = struct{}{}
+				batch = append(batch, &Message{Message: message})
+			}
+
+			c.handleBatch(batch)
+
+			if fmt.Sprint(recorder.finished) != fmt.Sprint(tt.wantFinished) {
+				t.Errorf("finished = %v, want %v", recorder.finished, tt.wantFinished)
+			}
+			if fmt.Sprint(recorder.requeued) != fmt.Sprint(tt.wantRequeued) {
+				t.Errorf("requeued = %v, want %v", recorder.requeued, tt.wantRequeued)
+			}
+			if len(c.inFlight) != 0 {
+				t.Errorf("inFlight = %d, want 0", len(c.inFlight))
+			}
+		})
+	}
+}
+
+func TestConsumer_handleBatchFailFast(t *testing.T) {
+	c := NewConsumer(adapter.ConsumerHandler{
+		Topic: "orders",
+		BatchHandler: func(ctx context.Context, messages []adapter.IMessage) error {
+			panic("boom")
+		},
+	})
+	c.handlerConfig.FailFast = true
+
+	defer func() {
+		if rec := recover(); rec != "boom" {
+			t.Errorf("recover() = %v, want boom", rec)
+		}
+	}()
+
+	c.handleBatch([]*Message{{Message: newTestMessage(&responseRecorder{}, 0, "a")}})
+	t.Error("handleBatch() didn't panic with fail_fast")
+}
+
+// connectRecorder record the connections of the consumer, the lookupd connection fails when lookupdErr is set
+type connectRecorder struct {
+	lookupdErr error
+	calls      []string
+}
+
+func (c *connectRecorder) ConnectToNSQLookupds(addresses []string) error {
+	c.calls = append(c.calls, fmt.Sprintf("lookupd %v", addresses))
+	return c.lookupdErr
+}
+
+func (c *connectRecorder) ConnectToNSQDs(addresses []string) error {
+	c.calls = append(c.calls, fmt.Sprintf("nsqd %v", addresses))
+	return nil
+}
+
+func TestConsumer_connect(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		extra      map[string]interface{}
+		lookupdErr error
+		wantCalls  []string
+		wantErr    bool
+	}{
+		{
+			name:      "Test lookupd addresses",
+			url:       "localhost:4150",
+			extra:     map[string]interface{}{"lookupd_addresses": []string{"lookupd-1:4161", "lookupd-2:4161"}},
+			wantCalls: []string{"lookupd [lookupd-1:4161 lookupd-2:4161]"},
+		}, {
+			name:      "Test nsqd addresses",
+			extra:     map[string]interface{}{"nsqd_addresses": []string{"nsqd-1:4150"}},
+			wantCalls: []string{"nsqd [nsqd-1:4150]"},
+		}, {
+			name:      "Test lookupd before nsqd addresses",
+			extra:     map[string]interface{}{"lookupd_addresses": []string{"lookupd-1:4161"}, "nsqd_addresses": []string{"nsqd-1:4150"}},
+			wantCalls: []string{"lookupd [lookupd-1:4161]"},
+		}, {
+			name:      "Test comma separated url through lookupd",
+			url:       "lookupd-1:4161, lookupd-2:4161,",
+			wantCalls: []string{"lookupd [lookupd-1:4161 lookupd-2:4161]"},
+		}, {
+			name:       "Test url falling back to nsqd",
+			url:        "nsqd-1:4150",
+			lookupdErr: errors.New("not a lookupd"),
+			wantCalls:  []string{"lookupd [nsqd-1:4150]", "nsqd [nsqd-1:4150]"},
+		}, {
+			name:    "Test no address",
+			url:     " , ",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := adapter.ConsumerHandler{Topic: "orders", Channel: "billing", URL: tt.url}
+			handler.SetExtraConfig(tt.extra)
+
+			c := NewConsumer(handler)
+			if err := c.handler.ParseExtraConfig(&c.handlerConfig); err != nil {
+				t.Fatalf("ParseExtraConfig() error = %v", err)
+			}
+
+			q := &connectRecorder{lookupdErr: tt.lookupdErr}
+			err := c.connect(q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("connect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fmt.Sprint(q.calls) != fmt.Sprint(tt.wantCalls) {
+				t.Errorf("connect() calls = %v, want %v", q.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestConsumer_handle(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name         string
+		handler      adapter.Handler
+		wantErr      bool
+		wantPanic    bool
+		wantFinished bool
+	}{
+		{
+			name: "Test handled",
+			handler: func(ctx context.Context, message adapter.IMessage) error {
+				return nil
+			},
+		}, {
+			name: "Test failure requeued by go-nsq",
+			handler: func(ctx context.Context, message adapter.IMessage) error {
+				return errFailed
+			},
+			wantErr: true,
+		}, {
+			name: "Test permanent failure finished",
+			handler: func(ctx context.Context, message adapter.IMessage) error {
+				return adapter.Permanent(errFailed)
+			},
+			wantFinished: true,
+		}, {
+			name: "Test panic requeued by go-nsq",
+			handler: func(ctx context.Context, message adapter.IMessage) error {
+				panic("boom")
+			},
+			wantErr:   true,
+			wantPanic: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &responseRecorder{}
+			message := nsq.NewMessage(nsq.MessageID{1}, []byte("a"))
+			message.Delegate = recorder
+			message.Attempts = 1
+
+			c := NewConsumer(adapter.ConsumerHandler{Topic: "orders", Channel: "billing", Handler: tt.handler})
+			err := c.handle()(message)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var panicErr *adapter.PanicError
+			if errors.As(err, &panicErr) != tt.wantPanic {
+				t.Errorf("handle() error = %v, want panic error %v", err, tt.wantPanic)
+			}
+			if got := len(recorder.finished) == 1; got != tt.wantFinished {
+				t.Errorf("handle() finished = %v, want %v", got, tt.wantFinished)
+			}
+			if len(c.inFlight) != 0 {
+				t.Errorf("inFlight = %d, want 0", len(c.inFlight))
+			}
+		})
+	}
+}
+
+func TestConsumer_Shutdown(t *testing.T) {
+	tests := []struct {
+		name          string
+		addHandler    bool
+		inFlight      bool
+		wantAbandoned int
+	}{
+		{
+			name:       "Test stopped handlers",
+			addHandler: true,
+		}, {
+			name:          "Test in-flight message requeued after the deadline",
+			inFlight:      true,
+			wantAbandoned: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := nsq.NewConsumer("orders", "billing", nsq.NewConfig())
+			if err != nil {
+				t.Fatalf("NewConsumer() error = %v", err)
+			}
+			q.SetLogger(nil, nsq.LogLevelError)
+
+			// without handler the go-nsq consumer never stops, like one stuck in a handler
+			if tt.addHandler {
+				q.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error { return nil }))
+			}
+
+			c := NewConsumer(adapter.ConsumerHandler{Topic: "orders", Channel: "billing"})
+			c.consumer = q
+
+			recorder := &responseRecorder{}
+			if tt.inFlight {
+				c.inFlight[newTestMessage(recorder, 1, "a")] = struct{}{}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			err = c.Shutdown(ctx)
+
+			var shutdownErr *adapter.ShutdownError
+			if tt.wantAbandoned == 0 {
+				if err != nil {
+					t.Errorf("Shutdown() error = %v", err)
+				}
+				return
+			}
+
+			if !errors.As(err, &shutdownErr) || len(shutdownErr.Abandoned) != tt.wantAbandoned {
+				t.Fatalf("Shutdown() error = %v, want %d abandoned", err, tt.wantAbandoned)
+			}
+			if len(recorder.requeued) != tt.wantAbandoned {
+				t.Errorf("requeued = %v, want the abandoned messages", recorder.requeued)
+			}
+			if c.ctx.Err() == nil {
+				t.Error("handler context not cancelled after the deadline")
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package nsqa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+// ConsumerManager implement adapter.IConsumerAdapter for nsq
+type ConsumerManager struct {
+	consumers []*Consumer
+}
+
+// NewManager will instantiate the nsq consumer manager
+func NewManager() *ConsumerManager {
+	return &ConsumerManager{}
+}
+
+// RegisterConsumerHandler will register the consumer handler, disabled handler is skipped
+func (c *ConsumerManager) RegisterConsumerHandler(consumer adapter.ConsumerHandler) error {
+	if !consumer.Enable {
+		return nil
+	}
+
+	c.consumers = append(c.consumers, NewConsumer(consumer))
+	return nil
+}
+
+// Run will connect all registered consumers. When any of them fails to start
+// the started ones are closed and all the startup errors are returned joined
+func (c *ConsumerManager) Run() error {
+	var errs []error
+	for _, conn := range c.consumers {
+		err := conn.Run()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s failed to start: %w", conn.handler.Topic, err))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	for _, conn := range c.consumers {
+		_ = conn.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// Shutdown stop all consumers concurrently and wait for their in-flight handlers until the context is done
+func (c *ConsumerManager) Shutdown(ctx context.Context) error {
+	targets := make([]adapter.Shutdowner, 0, len(c.consumers))
+	for _, conn := range c.consumers {
+		targets = append(targets, conn)
+	}
+
+	return adapter.ShutdownAll(ctx, targets...)
+}
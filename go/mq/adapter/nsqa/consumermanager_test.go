@@ -0,0 +1,52 @@
+package nsqa
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+func TestConsumerManager_Run(t *testing.T) {
+	handler := func(ctx context.Context, message adapter.IMessage) error { return nil }
+
+	m := NewManager()
+	handlers := []adapter.ConsumerHandler{
+		// nsqlookupd is polled in the background, the consumer starts even when it is unreachable
+		{Topic: "orders", Channel: "billing", Enable: true, Handler: handler, URL: "127.0.0.1:1"},
+		{Topic: "payments", Channel: "billing", Enable: true, Handler: handler},
+		{Topic: "refunds", Channel: "billing", Enable: false, Handler: handler},
+		{Topic: "invoices", Channel: "billing", Enable: true},
+	}
+	for _, h := range handlers {
+		if err := m.RegisterConsumerHandler(h); err != nil {
+			t.Fatalf("RegisterConsumerHandler() error = %v", err)
+		}
+	}
+
+	if len(m.consumers) != 3 {
+		t.Fatalf("registered = %d consumers, want 3", len(m.consumers))
+	}
+
+	err := m.Run()
+	if err == nil {
+		t.Fatal("Run() error = nil, want the startup errors")
+	}
+	for _, want := range []string{"payments failed to start", "invoices failed to start"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Run() error = %v, want containing %q", err, want)
+		}
+	}
+
+	// the started consumer is closed
+	started := m.consumers[0].consumer
+	if started == nil {
+		t.Fatal("orders consumer not started")
+	}
+	select {
+	case <-started.StopChan:
+	default:
+		t.Error("orders consumer still running after Run() failed")
+	}
+}
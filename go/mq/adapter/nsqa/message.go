@@ -0,0 +1,69 @@
+package nsqa
+
+import (
+	"net/http"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// Message wrap the go-nsq message into adapter.IMessage
+type Message struct {
+	*nsq.Message
+
+	trace http.Header
+}
+
+// GetAttempts return number of how many this message enter the consumer
+func (m *Message) GetAttempts() int32 {
+	return int32(m.Attempts)
+}
+
+// GetBody return body of message
+func (m *Message) GetBody() []byte {
+	return m.Body
+}
+
+// GetID return the nsq message id
+func (m *Message) GetID() string {
+	return string(m.ID[:])
+}
+
+// GetHeaders return the distributed trace metadata of the envelope, nsq messages have no other headers
+func (m *Message) GetHeaders() map[string]interface{} {
+	if len(m.trace) == 0 {
+		return nil
+	}
+
+	headers := make(map[string]interface{}, len(m.trace))
+	for k := range m.trace {
+		headers[k] = m.trace.Get(k)
+	}
+
+	return headers
+}
+
+// GetCorrelationID return empty string, nsq messages have no correlation id
+func (m *Message) GetCorrelationID() string {
+	return ""
+}
+
+// GetTimestamp return the time nsqd received the message
+func (m *Message) GetTimestamp() time.Time {
+	return time.Unix(0, m.Timestamp)
+}
+
+// GetContentType return empty string, nsq messages have no content type
+func (m *Message) GetContentType() string {
+	return ""
+}
+
+// GetFirstSeen return the time nsqd received the message, a requeued nsq message keeps it
+func (m *Message) GetFirstSeen() time.Time {
+	return m.GetTimestamp()
+}
+
+// GetLastError return empty string, nsqd keeps no error of the previous attempts
+func (m *Message) GetLastError() string {
+	return ""
+}
@@ -0,0 +1,59 @@
+package nsqa
+
+import (
+	"context"
+	"time"
+
+	pkgnsq "github.com/reyhanfahlevi/pkg/go/nsq"
+)
+
+// Publisher adapt nsq.Publisher into adapter.IPublisherAdapter
+type Publisher struct {
+	publisher *pkgnsq.Publisher
+}
+
+// NewPublisher will wrap the nsq publisher, the topic is published as is without the publisher prefix
+func NewPublisher(publisher *pkgnsq.Publisher) *Publisher {
+	return &Publisher{publisher: publisher}
+}
+
+// Publish will publish the body to the topic, when the nsq publisher has WithTraceEnvelope
+// the distributed trace of the context is sent in an envelope read by the nsq consumers
+func (p *Publisher) Publish(ctx context.Context, topic string, body []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return p.publisher.PublishRaw(topic, p.publisher.Envelope(ctx, body))
+}
+
+// PublishWithDelay will publish the body to the topic using nsq deferred publish
+func (p *Publisher) PublishWithDelay(ctx context.Context, topic string, body []byte, delay time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if delay <= 0 {
+		return p.publisher.PublishRaw(topic, p.publisher.Envelope(ctx, body))
+	}
+
+	return p.publisher.DeferredPublishRaw(topic, delay, p.publisher.Envelope(ctx, body))
+}
+
+// PublishBatch will publish all the bodies to the topic in a single MPUB command
+func (p *Publisher) PublishBatch(ctx context.Context, topic string, bodies [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(bodies) == 0 {
+		return nil
+	}
+
+	wrapped := make([][]byte, 0, len(bodies))
+	for _, body := range bodies {
+		wrapped = append(wrapped, p.publisher.Envelope(ctx, body))
+	}
+
+	return p.publisher.MultiPublishRaw(topic, wrapped)
+}
@@ -0,0 +1,64 @@
+package adapter
+
+import (
+	"context"
+	"runtime/debug"
+
+	"github.com/reyhanfahlevi/pkg/go/log"
+)
+
+// RecoverHandler return the handler panic as *PanicError so the message follows the failure path of the adapter,
+// the panic is logged with the fields and, with failFast, raised again after logging it
+func RecoverHandler(handler Handler, failFast bool, fields map[string]interface{}) Handler {
+	return func(ctx context.Context, message IMessage) (err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				f := copyFields(fields)
+				f["attempts"] = message.GetAttempts()
+				err = Recovered(rec, failFast, f)
+			}
+		}()
+
+		return handler(ctx, message)
+	}
+}
+
+// RecoverBatchHandler return the batch handler panic as *PanicError, failing the whole batch
+func RecoverBatchHandler(handler BatchHandler, failFast bool, fields map[string]interface{}) BatchHandler {
+	return func(ctx context.Context, messages []IMessage) (err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				f := copyFields(fields)
+				f["batch_size"] = len(messages)
+				err = Recovered(rec, failFast, f)
+			}
+		}()
+
+		return handler(ctx, messages)
+	}
+}
+
+// Recovered log the value of recover() with the fields and the stack and return it as *PanicError,
+// with failFast the panic is raised again
+func Recovered(rec interface{}, failFast bool, fields map[string]interface{}) error {
+	panicErr := &PanicError{Value: rec, Stack: debug.Stack()}
+
+	f := copyFields(fields)
+	f["stack"] = string(panicErr.Stack)
+	log.ErrorWithFields(panicErr.Error(), f)
+
+	if failFast {
+		panic(rec)
+	}
+
+	return panicErr
+}
+
+func copyFields(fields map[string]interface{}) map[string]interface{} {
+	f := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		f[k] = v
+	}
+
+	return f
+}
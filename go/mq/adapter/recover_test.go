@@ -0,0 +1,91 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// attemptsMessage is an IMessage answering only GetAttempts
+type attemptsMessage struct {
+	IMessage
+}
+
+func (attemptsMessage) GetAttempts() int32 { return 1 }
+
+func TestRecoverHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		failFast  bool
+		wantPanic bool
+	}{
+		{
+			name:      "Test panic returned as error",
+			failFast:  false,
+			wantPanic: false,
+		}, {
+			name:      "Test panic raised again with fail fast",
+			failFast:  true,
+			wantPanic: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := map[string]interface{}{"topic": "orders"}
+
+			defer func() {
+				if r := recover(); (r != nil) != tt.wantPanic {
+					t.Errorf("RecoverHandler() panic = %v, wantPanic %v", r, tt.wantPanic)
+				}
+				if len(fields) != 1 {
+					t.Errorf("RecoverHandler() modified the fields: %v", fields)
+				}
+			}()
+
+			handler := RecoverHandler(func(ctx context.Context, message IMessage) error {
+				panic("boom")
+			}, tt.failFast, fields)
+			err := handler(context.Background(), attemptsMessage{})
+
+			var panicErr *PanicError
+			if !errors.As(err, &panicErr) || panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+				t.Errorf("RecoverHandler() error = %v, want *PanicError", err)
+			}
+		})
+	}
+}
+
+func TestRecoverBatchHandler(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		handler BatchHandler
+		wantErr func(err error) bool
+	}{
+		{
+			name: "Test batch error returned as is",
+			handler: func(ctx context.Context, messages []IMessage) error {
+				return errFailed
+			},
+			wantErr: func(err error) bool { return err == errFailed },
+		}, {
+			name: "Test panic fails the whole batch",
+			handler: func(ctx context.Context, messages []IMessage) error {
+				panic("boom")
+			},
+			wantErr: func(err error) bool {
+				var panicErr *PanicError
+				return errors.As(err, &panicErr) && panicErr.Value == "boom"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RecoverBatchHandler(tt.handler, false, nil)(context.Background(), make([]IMessage, 2))
+			if !tt.wantErr(err) {
+				t.Errorf("RecoverBatchHandler() error = %v", err)
+			}
+		})
+	}
+}
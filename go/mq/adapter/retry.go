@@ -0,0 +1,181 @@
+package adapter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/rand"
+)
+
+// RetryPolicy decide how long a failed message waits before its next attempt
+type RetryPolicy interface {
+	// Backoff return the delay after the failed attempt, attempts starts at 1
+	Backoff(attempts int32) time.Duration
+}
+
+// RetryPolicyFunc adapt a function into RetryPolicy
+type RetryPolicyFunc func(attempts int32) time.Duration
+
+// Backoff call the function
+func (f RetryPolicyFunc) Backoff(attempts int32) time.Duration {
+	return f(attempts)
+}
+
+// ExponentialBackoff double the delay on every attempt: Base * 2^(attempts-1), capped at Max.
+// With Jitter up to half of the delay is added so consumers don't retry together
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter bool
+}
+
+// Backoff return the exponential delay of the attempt
+func (e ExponentialBackoff) Backoff(attempts int32) time.Duration {
+	delay := capDelay(float64(e.Base)*math.Pow(2, float64(attempts-1)), e.Max)
+
+	if e.Jitter && delay > 1 {
+		return capDelay(float64(delay)+float64(rand.Int63n(int64(delay)/2)), e.Max)
+	}
+
+	return delay
+}
+
+// FixedBackoff wait the same delay on every attempt
+type FixedBackoff struct {
+	Delay time.Duration
+}
+
+// Backoff return the fixed delay
+func (f FixedBackoff) Backoff(int32) time.Duration {
+	return f.Delay
+}
+
+// LinearBackoff add Step on every attempt: Base + Step * (attempts-1), capped at Max
+type LinearBackoff struct {
+	Base time.Duration
+	Step time.Duration
+	Max  time.Duration
+}
+
+// Backoff return the linear delay of the attempt
+func (l LinearBackoff) Backoff(attempts int32) time.Duration {
+	return capDelay(float64(l.Base)+float64(l.Step)*float64(attempts-1), l.Max)
+}
+
+// DecorrelatedJitter pick a random delay between Base and three times the previous delay, capped at Max.
+// The previous delay of a message is not kept across requeues, the upper bound of the previous attempt is used instead
+type DecorrelatedJitter struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Backoff return a random delay of the attempt
+func (d DecorrelatedJitter) Backoff(attempts int32) time.Duration {
+	if attempts <= 1 || d.Base <= 0 {
+		return capDelay(float64(d.Base), d.Max)
+	}
+
+	previous := capDelay(float64(d.Base)*math.Pow(3, float64(attempts-2)), d.Max)
+	upper := capDelay(float64(previous)*3, d.Max)
+	if upper <= d.Base {
+		return upper
+	}
+
+	return d.Base + time.Duration(rand.Int63n(int64(upper-d.Base)))
+}
+
+// ScheduleBackoff use the delay of the attempt from the list, the last delay is repeated once the list is exhausted
+type ScheduleBackoff []time.Duration
+
+// Backoff return the scheduled delay of the attempt
+func (s ScheduleBackoff) Backoff(attempts int32) time.Duration {
+	if len(s) == 0 {
+		return 0
+	}
+
+	i := int(attempts) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(s) {
+		i = len(s) - 1
+	}
+
+	return s[i]
+}
+
+// capDelay convert the delay computed in float64 to avoid overflow, max <= 0 means no cap
+func capDelay(delay float64, max time.Duration) time.Duration {
+	if delay < 0 {
+		delay = 0
+	}
+
+	if max > 0 && delay > float64(max) {
+		return max
+	}
+
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+
+	return time.Duration(delay)
+}
+
+// DelayTiers is the ascending set of delays a broker waits with, e.g. one wait queue or retry topic per tier,
+// so the messages waiting the same tier are released in order
+type DelayTiers []time.Duration
+
+// DefaultDelayTiers cover the default retry policy up to 10 minutes
+var DefaultDelayTiers = DelayTiers{
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+}
+
+// ParseDelayTiers build the tiers from delays in milliseconds, empty means DefaultDelayTiers
+func ParseDelayTiers(ms []int64) (DelayTiers, error) {
+	if len(ms) == 0 {
+		return DefaultDelayTiers, nil
+	}
+
+	tiers := make(DelayTiers, 0, len(ms))
+	for _, v := range ms {
+		if v <= 0 {
+			return nil, fmt.Errorf("delay tier must be positive, got %d", v)
+		}
+		tiers = append(tiers, time.Duration(v)*time.Millisecond)
+	}
+
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i] < tiers[j] })
+
+	// drop the duplicates
+	n := 1
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i] != tiers[n-1] {
+			tiers[n] = tiers[i]
+			n++
+		}
+	}
+
+	return tiers[:n], nil
+}
+
+// Round return the smallest tier not shorter than the delay, the longest tier beyond it and zero for no delay
+func (t DelayTiers) Round(delay time.Duration) time.Duration {
+	if delay <= 0 || len(t) == 0 {
+		return 0
+	}
+
+	for _, tier := range t {
+		if tier >= delay {
+			return tier
+		}
+	}
+
+	return t[len(t)-1]
+}
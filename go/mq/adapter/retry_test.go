@@ -0,0 +1,207 @@
+package adapter
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempts int32
+		want     time.Duration
+	}{
+		{
+			name:     "Test exponential first attempt",
+			policy:   ExponentialBackoff{Base: time.Second, Max: time.Minute},
+			attempts: 1,
+			want:     time.Second,
+		}, {
+			name:     "Test exponential third attempt",
+			policy:   ExponentialBackoff{Base: time.Second, Max: time.Minute},
+			attempts: 3,
+			want:     4 * time.Second,
+		}, {
+			name:     "Test exponential capped",
+			policy:   ExponentialBackoff{Base: time.Second, Max: time.Minute},
+			attempts: 100,
+			want:     time.Minute,
+		}, {
+			name:     "Test exponential without cap doesn't overflow",
+			policy:   ExponentialBackoff{Base: time.Second},
+			attempts: math.MaxInt32,
+			want:     math.MaxInt64,
+		}, {
+			name:     "Test fixed",
+			policy:   FixedBackoff{Delay: 5 * time.Second},
+			attempts: 7,
+			want:     5 * time.Second,
+		}, {
+			name:     "Test linear",
+			policy:   LinearBackoff{Base: time.Second, Step: 2 * time.Second, Max: time.Minute},
+			attempts: 4,
+			want:     7 * time.Second,
+		}, {
+			name:     "Test linear capped",
+			policy:   LinearBackoff{Base: time.Second, Step: time.Minute, Max: time.Minute},
+			attempts: 4,
+			want:     time.Minute,
+		}, {
+			name:     "Test decorrelated jitter first attempt",
+			policy:   DecorrelatedJitter{Base: time.Second, Max: time.Minute},
+			attempts: 1,
+			want:     time.Second,
+		}, {
+			name:     "Test schedule",
+			policy:   ScheduleBackoff{time.Second, 10 * time.Second, time.Minute},
+			attempts: 2,
+			want:     10 * time.Second,
+		}, {
+			name:     "Test schedule repeat the last delay",
+			policy:   ScheduleBackoff{time.Second, 10 * time.Second, time.Minute},
+			attempts: 9,
+			want:     time.Minute,
+		}, {
+			name:     "Test empty schedule",
+			policy:   ScheduleBackoff{},
+			attempts: 1,
+			want:     0,
+		}, {
+			name:     "Test func",
+			policy:   RetryPolicyFunc(func(attempts int32) time.Duration { return time.Duration(attempts) }),
+			attempts: 3,
+			want:     3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Backoff(tt.attempts); got != tt.want {
+				t.Errorf("Backoff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_BackoffJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempts int32
+		min      time.Duration
+		max      time.Duration
+	}{
+		{
+			name:     "Test exponential jitter",
+			policy:   ExponentialBackoff{Base: time.Second, Max: time.Minute, Jitter: true},
+			attempts: 3,
+			min:      4 * time.Second,
+			max:      6 * time.Second,
+		}, {
+			name:     "Test exponential jitter capped",
+			policy:   ExponentialBackoff{Base: time.Second, Max: 5 * time.Second, Jitter: true},
+			attempts: 3,
+			min:      4 * time.Second,
+			max:      5 * time.Second,
+		}, {
+			name:     "Test decorrelated jitter",
+			policy:   DecorrelatedJitter{Base: time.Second, Max: time.Minute},
+			attempts: 3,
+			min:      time.Second,
+			max:      9 * time.Second,
+		}, {
+			name:     "Test decorrelated jitter capped",
+			policy:   DecorrelatedJitter{Base: time.Second, Max: 2 * time.Second},
+			attempts: 10,
+			min:      time.Second,
+			max:      2 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := tt.policy.Backoff(tt.attempts); got < tt.min || got > tt.max {
+					t.Fatalf("Backoff() = %v, want between %v and %v", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestDelayTiers_Round(t *testing.T) {
+	tiers, err := ParseDelayTiers([]int64{5000, 1000, 60000, 1000})
+	if err != nil {
+		t.Fatalf("ParseDelayTiers() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		delay time.Duration
+		want  time.Duration
+	}{
+		{
+			name:  "Test no delay",
+			delay: 0,
+			want:  0,
+		}, {
+			name:  "Test rounded up to the first tier",
+			delay: time.Millisecond,
+			want:  time.Second,
+		}, {
+			name:  "Test exact tier",
+			delay: 5 * time.Second,
+			want:  5 * time.Second,
+		}, {
+			name:  "Test rounded up to the next tier",
+			delay: 5*time.Second + time.Millisecond,
+			want:  time.Minute,
+		}, {
+			name:  "Test beyond the longest tier",
+			delay: time.Hour,
+			want:  time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tiers.Round(tt.delay); got != tt.want {
+				t.Errorf("Round() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDelayTiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		ms      []int64
+		want    DelayTiers
+		wantErr bool
+	}{
+		{
+			name: "Test default tiers",
+			ms:   nil,
+			want: DefaultDelayTiers,
+		}, {
+			name: "Test sorted without duplicates",
+			ms:   []int64{30000, 1000, 30000},
+			want: DelayTiers{time.Second, 30 * time.Second},
+		}, {
+			name:    "Test non positive tier",
+			ms:      []int64{1000, 0},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDelayTiers(tt.ms)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDelayTiers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("ParseDelayTiers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package rmqa
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+// HandlerConfig is the rabbitmq specific config parsed from adapter.ConsumerHandler ExtraConfig
+type HandlerConfig struct {
+	Durable    bool `json:"durable,omitempty"`
+	AutoDelete bool `json:"auto_delete,omitempty"`
+	Exclusive  bool `json:"exclusive,omitempty"`
+	NoWait     bool `json:"no_wait,omitempty"`
+	AutoAck    bool `json:"auto_ack,omitempty"`
+	NoLocal    bool `json:"no_local,omitempty"`
+
+	// DeadLetterQueue receive the messages that reached max attempts, default: <topic>.dlq
+	DeadLetterQueue string `json:"dead_letter_queue,omitempty"`
+
+	// DelayedExchange is the name of the x-delayed-message exchange used to delay requeued messages,
+	// it requires the rabbitmq_delayed_message_exchange plugin. Empty means ttl wait queues are used
+	DelayedExchange string `json:"delayed_exchange,omitempty"`
+
+	// DelayTiers in milliseconds, without delayed exchange a requeue delay is rounded up to the next tier
+	// and waits in the "<topic>.wait.<ms>" queue of the tier, default: 1s, 5s, 30s, 1m, 5m and 10m
+	DelayTiers []int64 `json:"delay_tiers,omitempty"`
+
+	// FailFast raise the handler panic again after logging it, crashing the process instead of requeueing
+	FailFast bool `json:"fail_fast,omitempty"`
+
+	// Exchange the queue is bound to, empty means the queue only receive from the default exchange
+	Exchange string `json:"exchange,omitempty"`
+
+	// ExchangeKind is direct, fanout, topic or headers, default: direct
+	ExchangeKind       string                 `json:"exchange_kind,omitempty"`
+	ExchangeDurable    bool                   `json:"exchange_durable,omitempty"`
+	ExchangeAutoDelete bool                   `json:"exchange_auto_delete,omitempty"`
+	ExchangeArgs       map[string]interface{} `json:"exchange_args,omitempty"`
+
+	// RoutingKeys bind the queue to the exchange once per key,
+	// default: the topic for direct and topic exchanges, an empty key for fanout and headers exchanges
+	RoutingKeys []string `json:"routing_keys,omitempty"`
+
+	// BindingArgs are the arguments of every binding, e.g. x-match for headers exchanges
+	BindingArgs map[string]interface{} `json:"binding_args,omitempty"`
+
+	// Arguments are the x-arguments of the queue declaration
+	Arguments QueueArguments `json:"arguments,omitempty"`
+
+	// ConsumeArgs are the arguments of the consume, e.g. x-priority for consumer priority
+	ConsumeArgs map[string]interface{} `json:"consume_args,omitempty"`
+
+	// Retry select the retry policy of the consumer, it takes precedence over WithRetryPolicy
+	Retry RetryConfig `json:"retry,omitempty"`
+}
+
+// RetryConfig describe the retry policy of a consumer, durations are in milliseconds
+type RetryConfig struct {
+	// Policy is exponential, fixed, linear, decorrelated_jitter or schedule, empty keep the consumer policy
+	Policy string `json:"policy,omitempty"`
+
+	// Base is the first delay, and the delay of every attempt for the fixed policy
+	Base int64 `json:"base,omitempty"`
+	// Max cap the delay, zero means no cap
+	Max int64 `json:"max,omitempty"`
+	// Step is added on every attempt by the linear policy
+	Step int64 `json:"step,omitempty"`
+	// Jitter add up to half of the delay to the exponential policy
+	Jitter bool `json:"jitter,omitempty"`
+	// Schedule is the delay of every attempt for the schedule policy, the last one is repeated
+	Schedule []int64 `json:"schedule,omitempty"`
+}
+
+const (
+	RetryExponential        = "exponential"
+	RetryFixed              = "fixed"
+	RetryLinear             = "linear"
+	RetryDecorrelatedJitter = "decorrelated_jitter"
+	RetrySchedule           = "schedule"
+)
+
+// QueueArguments are the common x-arguments of a queue, durations are in milliseconds
+type QueueArguments struct {
+	// Type is classic, quorum or stream, empty let the broker decide
+	Type string `json:"type,omitempty"`
+
+	MessageTTL     int64  `json:"message_ttl,omitempty"`
+	Expires        int64  `json:"expires,omitempty"`
+	MaxLength      int64  `json:"max_length,omitempty"`
+	MaxLengthBytes int64  `json:"max_length_bytes,omitempty"`
+	Overflow       string `json:"overflow,omitempty"`
+
+	SingleActiveConsumer bool `json:"single_active_consumer,omitempty"`
+
+	// MaxPriority enable priorities on classic queue, from 1 to 255
+	MaxPriority int `json:"max_priority,omitempty"`
+
+	// DeliveryLimit is the poison message handling of quorum queue
+	DeliveryLimit int64 `json:"delivery_limit,omitempty"`
+
+	// Extra is passed as is, it can't override the typed arguments
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
+
+var overflows = map[string]bool{
+	"drop-head":          true,
+	"reject-publish":     true,
+	"reject-publish-dlx": true,
+}
+
+var exchangeKinds = map[string]bool{
+	"direct":  true,
+	"fanout":  true,
+	"topic":   true,
+	"headers": true,
+}
+
+func (c *HandlerConfig) setDefaults(topic string) {
+	if c.DeadLetterQueue == "" {
+		c.DeadLetterQueue = topic + ".dlq"
+	}
+
+	if c.Exchange == "" {
+		return
+	}
+
+	if c.ExchangeKind == "" {
+		c.ExchangeKind = "direct"
+	}
+
+	if len(c.RoutingKeys) == 0 {
+		switch c.ExchangeKind {
+		case "fanout", "headers":
+			c.RoutingKeys = []string{""}
+		default:
+			c.RoutingKeys = []string{topic}
+		}
+	}
+}
+
+// Validate check the config before declaring anything on the broker
+func (c HandlerConfig) Validate() error {
+	if err := c.Arguments.validate(c); err != nil {
+		return err
+	}
+
+	if err := c.Retry.validate(); err != nil {
+		return err
+	}
+
+	if _, err := adapter.ParseDelayTiers(c.DelayTiers); err != nil {
+		return err
+	}
+
+	if c.Exchange == "" {
+		if len(c.RoutingKeys) > 0 || len(c.BindingArgs) > 0 {
+			return fmt.Errorf("routing keys and binding args require an exchange")
+		}
+		return nil
+	}
+
+	if c.Exchange == c.DelayedExchange {
+		return fmt.Errorf("exchange %q is also used as the delayed exchange", c.Exchange)
+	}
+
+	if c.ExchangeKind != "" && !exchangeKinds[c.ExchangeKind] {
+		return fmt.Errorf("unknown exchange kind %q", c.ExchangeKind)
+	}
+
+	return nil
+}
+
+func (r RetryConfig) validate() error {
+	switch r.Policy {
+	case "", RetryExponential, RetryFixed, RetryLinear, RetryDecorrelatedJitter:
+	case RetrySchedule:
+		if len(r.Schedule) == 0 {
+			return fmt.Errorf("schedule retry policy requires at least one delay")
+		}
+	default:
+		return fmt.Errorf("unknown retry policy %q", r.Policy)
+	}
+
+	if r.Base < 0 || r.Max < 0 || r.Step < 0 {
+		return fmt.Errorf("retry delays can't be negative")
+	}
+
+	for _, d := range r.Schedule {
+		if d < 0 {
+			return fmt.Errorf("retry delays can't be negative")
+		}
+	}
+
+	return nil
+}
+
+// policy build the retry policy, nil when no policy is configured
+func (r RetryConfig) policy() adapter.RetryPolicy {
+	base, max := time.Duration(r.Base)*time.Millisecond, time.Duration(r.Max)*time.Millisecond
+
+	switch r.Policy {
+	case RetryExponential:
+		return adapter.ExponentialBackoff{Base: base, Max: max, Jitter: r.Jitter}
+	case RetryFixed:
+		return adapter.FixedBackoff{Delay: base}
+	case RetryLinear:
+		return adapter.LinearBackoff{Base: base, Step: time.Duration(r.Step) * time.Millisecond, Max: max}
+	case RetryDecorrelatedJitter:
+		return adapter.DecorrelatedJitter{Base: base, Max: max}
+	case RetrySchedule:
+		schedule := make(adapter.ScheduleBackoff, 0, len(r.Schedule))
+		for _, d := range r.Schedule {
+			schedule = append(schedule, time.Duration(d)*time.Millisecond)
+		}
+		return schedule
+	default:
+		return nil
+	}
+}
+
+func (a QueueArguments) validate(c HandlerConfig) error {
+	switch a.Type {
+	case "", QueueTypeClassic:
+		if a.DeliveryLimit != 0 {
+			return fmt.Errorf("delivery limit is only supported by quorum queue")
+		}
+	case QueueTypeQuorum, QueueTypeStream:
+		if !c.Durable || c.AutoDelete || c.Exclusive {
+			return fmt.Errorf("%s queue must be durable, not auto-delete and not exclusive", a.Type)
+		}
+		if a.MaxPriority != 0 {
+			return fmt.Errorf("max priority is not supported by %s queue", a.Type)
+		}
+		if a.Overflow == "reject-publish-dlx" {
+			return fmt.Errorf("overflow reject-publish-dlx is not supported by %s queue", a.Type)
+		}
+		if a.Type == QueueTypeStream && a.DeliveryLimit != 0 {
+			return fmt.Errorf("delivery limit is only supported by quorum queue")
+		}
+	default:
+		return fmt.Errorf("unknown queue type %q", a.Type)
+	}
+
+	if a.MessageTTL < 0 || a.Expires < 0 || a.MaxLength < 0 || a.MaxLengthBytes < 0 || a.DeliveryLimit < 0 {
+		return fmt.Errorf("queue arguments can't be negative")
+	}
+
+	if a.MaxPriority < 0 || a.MaxPriority > 255 {
+		return fmt.Errorf("max priority must be between 1 and 255")
+	}
+
+	if a.Overflow != "" && !overflows[a.Overflow] {
+		return fmt.Errorf("unknown overflow %q", a.Overflow)
+	}
+
+	typed := a.typed()
+	for k := range a.Extra {
+		if _, ok := typed[k]; ok {
+			return fmt.Errorf("extra argument %s is already set by a typed argument", k)
+		}
+	}
+
+	return nil
+}
+
+func (a QueueArguments) typed() amqp.Table {
+	args := amqp.Table{}
+
+	if a.Type != "" {
+		args["x-queue-type"] = a.Type
+	}
+	if a.MessageTTL > 0 {
+		args["x-message-ttl"] = a.MessageTTL
+	}
+	if a.Expires > 0 {
+		args["x-expires"] = a.Expires
+	}
+	if a.MaxLength > 0 {
+		args["x-max-length"] = a.MaxLength
+	}
+	if a.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = a.MaxLengthBytes
+	}
+	if a.Overflow != "" {
+		args["x-overflow"] = a.Overflow
+	}
+	if a.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	if a.MaxPriority > 0 {
+		args["x-max-priority"] = int32(a.MaxPriority)
+	}
+	if a.DeliveryLimit > 0 {
+		args["x-delivery-limit"] = a.DeliveryLimit
+	}
+
+	return args
+}
+
+// Table return the queue declaration arguments, nil when there is none
+func (a QueueArguments) Table() amqp.Table {
+	args := a.typed()
+	for k, v := range toTable(a.Extra) {
+		args[k] = v
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	return args
+}
+
+// toTable convert the map parsed from json into amqp.Table,
+// json numbers are float64 and the broker expects integers for most arguments
+func toTable(m map[string]interface{}) amqp.Table {
+	if len(m) == 0 {
+		return nil
+	}
+
+	table := amqp.Table{}
+	for k, v := range m {
+		if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) < math.MaxInt64 {
+			v = int64(f)
+		}
+		table[k] = v
+	}
+
+	return table
+}
@@ -0,0 +1,233 @@
+package rmqa
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+func TestHandlerConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     HandlerConfig
+		wantErr bool
+	}{
+		{
+			name: "Test default exchange",
+			cfg:  HandlerConfig{},
+		}, {
+			name: "Test topic exchange",
+			cfg: HandlerConfig{
+				Exchange:     "events",
+				ExchangeKind: "topic",
+				RoutingKeys:  []string{"order.*"},
+			},
+		}, {
+			name:    "Test unknown exchange kind",
+			cfg:     HandlerConfig{Exchange: "events", ExchangeKind: "broadcast"},
+			wantErr: true,
+		}, {
+			name:    "Test routing keys without exchange",
+			cfg:     HandlerConfig{RoutingKeys: []string{"order.*"}},
+			wantErr: true,
+		}, {
+			name:    "Test exchange used as delayed exchange",
+			cfg:     HandlerConfig{Exchange: "events", DelayedExchange: "events"},
+			wantErr: true,
+		}, {
+			name:    "Test durable quorum queue",
+			cfg:     HandlerConfig{Durable: true, Arguments: QueueArguments{Type: QueueTypeQuorum, DeliveryLimit: 5}},
+			wantErr: false,
+		}, {
+			name:    "Test non durable quorum queue",
+			cfg:     HandlerConfig{Arguments: QueueArguments{Type: QueueTypeQuorum}},
+			wantErr: true,
+		}, {
+			name:    "Test quorum queue with priority",
+			cfg:     HandlerConfig{Durable: true, Arguments: QueueArguments{Type: QueueTypeQuorum, MaxPriority: 10}},
+			wantErr: true,
+		}, {
+			name:    "Test delivery limit on classic queue",
+			cfg:     HandlerConfig{Arguments: QueueArguments{DeliveryLimit: 5}},
+			wantErr: true,
+		}, {
+			name:    "Test unknown queue type",
+			cfg:     HandlerConfig{Arguments: QueueArguments{Type: "lazy"}},
+			wantErr: true,
+		}, {
+			name: "Test exponential retry",
+			cfg:  HandlerConfig{Retry: RetryConfig{Policy: RetryExponential, Base: 1000, Max: 60000}},
+		}, {
+			name:    "Test unknown retry policy",
+			cfg:     HandlerConfig{Retry: RetryConfig{Policy: "random"}},
+			wantErr: true,
+		}, {
+			name:    "Test schedule retry without delay",
+			cfg:     HandlerConfig{Retry: RetryConfig{Policy: RetrySchedule}},
+			wantErr: true,
+		}, {
+			name:    "Test negative retry delay",
+			cfg:     HandlerConfig{Retry: RetryConfig{Policy: RetrySchedule, Schedule: []int64{1000, -1}}},
+			wantErr: true,
+		}, {
+			name:    "Test unknown overflow",
+			cfg:     HandlerConfig{Arguments: QueueArguments{Overflow: "drop-tail"}},
+			wantErr: true,
+		}, {
+			name:    "Test negative ttl",
+			cfg:     HandlerConfig{Arguments: QueueArguments{MessageTTL: -1}},
+			wantErr: true,
+		}, {
+			name:    "Test priority out of range",
+			cfg:     HandlerConfig{Arguments: QueueArguments{MaxPriority: 256}},
+			wantErr: true,
+		}, {
+			name:    "Test extra overriding typed argument",
+			cfg:     HandlerConfig{Arguments: QueueArguments{MessageTTL: 1000, Extra: map[string]interface{}{"x-message-ttl": 10}}},
+			wantErr: true,
+		}, {
+			name:    "Test extra argument",
+			cfg:     HandlerConfig{Arguments: QueueArguments{Extra: map[string]interface{}{"x-queue-mode": "lazy"}}},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandlerConfig_setDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  HandlerConfig
+		want HandlerConfig
+	}{
+		{
+			name: "Test default exchange",
+			cfg:  HandlerConfig{},
+			want: HandlerConfig{DeadLetterQueue: "orders.dlq"},
+		}, {
+			name: "Test direct exchange bind with topic",
+			cfg:  HandlerConfig{Exchange: "events"},
+			want: HandlerConfig{
+				DeadLetterQueue: "orders.dlq",
+				Exchange:        "events",
+				ExchangeKind:    "direct",
+				RoutingKeys:     []string{"orders"},
+			},
+		}, {
+			name: "Test fanout exchange bind with empty key",
+			cfg:  HandlerConfig{Exchange: "events", ExchangeKind: "fanout", DeadLetterQueue: "parked"},
+			want: HandlerConfig{
+				DeadLetterQueue: "parked",
+				Exchange:        "events",
+				ExchangeKind:    "fanout",
+				RoutingKeys:     []string{""},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.setDefaults("orders")
+			if !reflect.DeepEqual(tt.cfg, tt.want) {
+				t.Errorf("setDefaults() = %+v, want %+v", tt.cfg, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueArguments_Table(t *testing.T) {
+	tests := []struct {
+		name string
+		args QueueArguments
+		want amqp.Table
+	}{
+		{
+			name: "Test empty arguments",
+			args: QueueArguments{},
+			want: nil,
+		}, {
+			name: "Test typed arguments",
+			args: QueueArguments{
+				MessageTTL:           60000,
+				MaxLength:            100,
+				Overflow:             "reject-publish",
+				SingleActiveConsumer: true,
+				MaxPriority:          10,
+			},
+			want: amqp.Table{
+				"x-message-ttl":            int64(60000),
+				"x-max-length":             int64(100),
+				"x-overflow":               "reject-publish",
+				"x-single-active-consumer": true,
+				"x-max-priority":           int32(10),
+			},
+		}, {
+			name: "Test json number in extra",
+			args: QueueArguments{
+				Type:  QueueTypeQuorum,
+				Extra: map[string]interface{}{"x-quorum-initial-group-size": float64(3)},
+			},
+			want: amqp.Table{
+				"x-queue-type":                "quorum",
+				"x-quorum-initial-group-size": int64(3),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.args.Table(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Table() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryConfig_policy(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  RetryConfig
+		want adapter.RetryPolicy
+	}{
+		{
+			name: "Test no policy",
+			cfg:  RetryConfig{Base: 1000},
+			want: nil,
+		}, {
+			name: "Test exponential",
+			cfg:  RetryConfig{Policy: RetryExponential, Base: 1000, Max: 60000, Jitter: true},
+			want: adapter.ExponentialBackoff{Base: time.Second, Max: time.Minute, Jitter: true},
+		}, {
+			name: "Test fixed",
+			cfg:  RetryConfig{Policy: RetryFixed, Base: 5000},
+			want: adapter.FixedBackoff{Delay: 5 * time.Second},
+		}, {
+			name: "Test linear",
+			cfg:  RetryConfig{Policy: RetryLinear, Base: 1000, Step: 2000, Max: 60000},
+			want: adapter.LinearBackoff{Base: time.Second, Step: 2 * time.Second, Max: time.Minute},
+		}, {
+			name: "Test decorrelated jitter",
+			cfg:  RetryConfig{Policy: RetryDecorrelatedJitter, Base: 1000, Max: 60000},
+			want: adapter.DecorrelatedJitter{Base: time.Second, Max: time.Minute},
+		}, {
+			name: "Test schedule",
+			cfg:  RetryConfig{Policy: RetrySchedule, Schedule: []int64{1000, 10000}},
+			want: adapter.ScheduleBackoff{time.Second, 10 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.policy(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("policy() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package rmqa
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// confirmation is the broker confirmation of a publish, *amqp.DeferredConfirmation
+type confirmation interface {
+	WaitContext(ctx context.Context) (bool, error)
+}
+
+// publishChannel is the part of a channel in confirm mode used to publish
+type publishChannel interface {
+	publishWithConfirm(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) (confirmation, error)
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	IsClosed() bool
+	Close() error
+}
+
+// amqpChannel is a publishChannel of an *amqp.Channel in confirm mode
+type amqpChannel struct {
+	*amqp.Channel
+}
+
+func (c amqpChannel) publishWithConfirm(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) (confirmation, error) {
+	confirm, err := c.PublishWithDeferredConfirmWithContext(ctx, exchange, key, mandatory, false, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return confirm, nil
+}
+
+// confirmChannel publish on a channel in confirm mode. A single goroutine reads the returns for the whole life
+// of the channel and hands each one to the publish waiting for its message id, the returns of a publish
+// that gave up waiting are dropped, so amqp091 never blocks delivering them
+type confirmChannel struct {
+	ch publishChannel
+
+	mu      sync.Mutex
+	waiting map[*returned]struct{}
+
+	// synced receives once the drainer handled every return read before, drained is closed when it exits
+	synced  chan struct{}
+	drained chan struct{}
+}
+
+// returned collect the returns of the message ids of one publish
+type returned struct {
+	ids     map[string]bool
+	returns []amqp.Return
+}
+
+func newConfirmChannel(ch publishChannel) *confirmChannel {
+	cc := &confirmChannel{
+		ch:      ch,
+		waiting: map[*returned]struct{}{},
+		synced:  make(chan struct{}),
+		drained: make(chan struct{}),
+	}
+
+	// unbuffered, the broker sends basic.return before the basic.ack of the same message
+	// so a return is always read before its publish sees the confirmation
+	go cc.drain(ch.NotifyReturn(make(chan amqp.Return)))
+
+	return cc
+}
+
+// drain read the returns until amqp091 closes the channel on shutdown
+func (cc *confirmChannel) drain(returns <-chan amqp.Return) {
+	defer close(cc.drained)
+
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				return
+			}
+			cc.route(ret)
+		case cc.synced <- struct{}{}:
+		}
+	}
+}
+
+func (cc *confirmChannel) route(ret amqp.Return) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for r := range cc.waiting {
+		if r.ids[ret.MessageId] {
+			r.returns = append(r.returns, ret)
+			return
+		}
+	}
+}
+
+// sync wait until the drainer handled the returns read so far
+func (cc *confirmChannel) sync() {
+	select {
+	case <-cc.synced:
+	case <-cc.drained:
+	}
+}
+
+// publish the messages and wait for all the broker confirmations. A mandatory message that can't be routed
+// fails with ReturnError, a message refused by the broker with ErrPublishNacked
+func (cc *confirmChannel) publish(ctx context.Context, exchange, key string, mandatory bool, msgs ...amqp.Publishing) error {
+	r := &returned{ids: make(map[string]bool, len(msgs))}
+	for _, msg := range msgs {
+		r.ids[msg.MessageId] = true
+	}
+
+	cc.mu.Lock()
+	cc.waiting[r] = struct{}{}
+	cc.mu.Unlock()
+
+	defer func() {
+		cc.mu.Lock()
+		delete(cc.waiting, r)
+		cc.mu.Unlock()
+	}()
+
+	confirms := make([]confirmation, 0, len(msgs))
+	for _, msg := range msgs {
+		confirm, err := cc.ch.publishWithConfirm(ctx, exchange, key, mandatory, msg)
+		if err != nil {
+			return fmt.Errorf("failed to publish message: %w", err)
+		}
+		confirms = append(confirms, confirm)
+	}
+
+	nacked := 0
+	for _, confirm := range confirms {
+		acked, err := confirm.WaitContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait publish confirmation: %w", err)
+		}
+		if !acked {
+			nacked++
+		}
+	}
+
+	cc.sync()
+
+	cc.mu.Lock()
+	returns := r.returns
+	cc.mu.Unlock()
+
+	switch {
+	case len(returns) > 0:
+		return &ReturnError{Return: returns[0]}
+	case nacked > 0 && len(msgs) == 1:
+		return ErrPublishNacked
+	case nacked > 0:
+		return fmt.Errorf("%d of %d messages: %w", nacked, len(msgs), ErrPublishNacked)
+	}
+
+	return nil
+}
+
+// openConfirmChannel open a channel of the connection in confirm mode
+func openConfirmChannel(conn *amqp.Connection) (*confirmChannel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, fmt.Errorf("failed to put channel into confirm mode: %w", err)
+	}
+
+	return newConfirmChannel(amqpChannel{ch}), nil
+}
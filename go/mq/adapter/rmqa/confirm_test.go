@@ -0,0 +1,158 @@
+package rmqa
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeConfirmation is confirmed right away unless pending, a pending one is never confirmed
+type fakeConfirmation struct {
+	acked   bool
+	pending bool
+}
+
+func (c fakeConfirmation) WaitContext(ctx context.Context) (bool, error) {
+	if c.pending {
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+
+	return c.acked, nil
+}
+
+// fakePublishChannel confirm every publish, the messages of the returned ids are returned first like the broker does
+type fakePublishChannel struct {
+	mu       sync.Mutex
+	returns  chan amqp.Return
+	closed   bool
+	nacked   bool
+	pending  bool
+	returned map[string]bool
+}
+
+func (c *fakePublishChannel) publishWithConfirm(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) (confirmation, error) {
+	if c.IsClosed() {
+		return nil, amqp.ErrClosed
+	}
+
+	if mandatory && c.returned[msg.MessageId] {
+		c.returns <- amqp.Return{MessageId: msg.MessageId, ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE", RoutingKey: key}
+	}
+
+	return fakeConfirmation{acked: !c.nacked, pending: c.pending}, nil
+}
+
+func (c *fakePublishChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	c.returns = returns
+	return returns
+}
+
+func (c *fakePublishChannel) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+func (c *fakePublishChannel) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.returns)
+	}
+
+	return nil
+}
+
+func TestConfirmChannel_publish(t *testing.T) {
+	tests := []struct {
+		name      string
+		ch        *fakePublishChannel
+		mandatory bool
+		ids       []string
+		wantErr   error
+		wantMsg   string
+	}{
+		{
+			name: "Test confirmed",
+			ch:   &fakePublishChannel{},
+			ids:  []string{"1", "2"},
+		}, {
+			name:    "Test nacked",
+			ch:      &fakePublishChannel{nacked: true},
+			ids:     []string{"1"},
+			wantErr: ErrPublishNacked,
+		}, {
+			name:    "Test batch nacked",
+			ch:      &fakePublishChannel{nacked: true},
+			ids:     []string{"1", "2"},
+			wantErr: ErrPublishNacked,
+			wantMsg: "2 of 2 messages: message was nacked by the broker",
+		}, {
+			name:      "Test mandatory message returned",
+			ch:        &fakePublishChannel{returned: map[string]bool{"2": true}},
+			mandatory: true,
+			ids:       []string{"1", "2"},
+			wantMsg:   `message returned by the broker: 312 NO_ROUTE (exchange: "", routing key: "orders")`,
+		}, {
+			name:    "Test confirmation timeout",
+			ch:      &fakePublishChannel{pending: true},
+			ids:     []string{"1"},
+			wantErr: context.DeadlineExceeded,
+		}, {
+			name:    "Test closed channel",
+			ch:      &fakePublishChannel{closed: true},
+			ids:     []string{"1"},
+			wantErr: amqp.ErrClosed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := newConfirmChannel(tt.ch)
+
+			msgs := make([]amqp.Publishing, len(tt.ids))
+			for i, id := range tt.ids {
+				msgs[i] = amqp.Publishing{MessageId: id}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			err := cc.publish(ctx, "", "orders", tt.mandatory, msgs...)
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("publish() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantMsg != "" && (err == nil || err.Error() != tt.wantMsg) {
+				t.Errorf("publish() error = %v, want %s", err, tt.wantMsg)
+			}
+			if tt.wantErr == nil && tt.wantMsg == "" && err != nil {
+				t.Errorf("publish() error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestConfirmChannel_staleReturn(t *testing.T) {
+	ch := &fakePublishChannel{}
+	cc := newConfirmChannel(ch)
+
+	// returns of a publish that gave up waiting are read and dropped, they never block the next publishes
+	for i := 0; i < 3; i++ {
+		select {
+		case ch.returns <- amqp.Return{MessageId: "stale"}:
+		case <-time.After(time.Second):
+			t.Fatal("stale return blocked the channel")
+		}
+	}
+
+	if err := cc.publish(context.Background(), "", "orders", true, amqp.Publishing{MessageId: "1"}); err != nil {
+		t.Errorf("publish() error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,121 @@
+package rmqa
+
+import (
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ConnectionPool share a few AMQP connections between consumers, every consumer opens its own channel.
+// A connection is dialed while the pool of the URL is not full, otherwise the least used one is shared
+type ConnectionPool struct {
+	mu    sync.Mutex
+	size  int
+	conns map[string][]*pooledConn
+	dial  func(url string) (*amqp.Connection, error)
+}
+
+type pooledConn struct {
+	conn *amqp.Connection
+	refs int
+}
+
+// NewConnectionPool will create a pool of at most size connections per URL, default: 2
+func NewConnectionPool(size int) *ConnectionPool {
+	if size < 1 {
+		size = 2
+	}
+
+	return &ConnectionPool{
+		size:  size,
+		conns: map[string][]*pooledConn{},
+		dial:  amqp.Dial,
+	}
+}
+
+// acquire return a live connection of the URL, it must be given back with release
+func (p *ConnectionPool) acquire(url string) (*amqp.Connection, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// forget the connections closed by the broker, their consumers release them on reconnect
+	live := p.conns[url][:0]
+	for _, pc := range p.conns[url] {
+		if !pc.conn.IsClosed() {
+			live = append(live, pc)
+		}
+	}
+	p.conns[url] = live
+
+	var least *pooledConn
+	for _, pc := range live {
+		if least == nil || pc.refs < least.refs {
+			least = pc
+		}
+	}
+
+	if least == nil || (least.refs > 0 && len(live) < p.size) {
+		conn, err := p.dial(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+		}
+
+		least = &pooledConn{conn: conn}
+		p.conns[url] = append(p.conns[url], least)
+	}
+
+	least.refs++
+	return least.conn, nil
+}
+
+// release give the connection back, it is closed once no consumer uses it
+func (p *ConnectionPool) release(conn *amqp.Connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for url, conns := range p.conns {
+		for i, pc := range conns {
+			if pc.conn != conn {
+				continue
+			}
+
+			pc.refs--
+			if pc.refs > 0 {
+				return
+			}
+
+			p.conns[url] = append(conns[:i], conns[i+1:]...)
+			if !conn.IsClosed() {
+				_ = conn.Close()
+			}
+			return
+		}
+	}
+
+	// the connection was already forgotten after the broker closed it
+	if !conn.IsClosed() {
+		_ = conn.Close()
+	}
+}
+
+// Close close every connection of the pool
+func (p *ConnectionPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for url, conns := range p.conns {
+		for _, pc := range conns {
+			if pc.conn.IsClosed() {
+				continue
+			}
+			if cerr := pc.conn.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		delete(p.conns, url)
+	}
+
+	return err
+}
@@ -0,0 +1,78 @@
+package rmqa
+
+import (
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestConnectionPool_acquire(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		acquire  int
+		wantDial int
+	}{
+		{
+			name:     "Test dial until the pool is full",
+			size:     2,
+			acquire:  2,
+			wantDial: 2,
+		}, {
+			name:     "Test share the connections once full",
+			size:     2,
+			acquire:  5,
+			wantDial: 2,
+		}, {
+			name:     "Test default size",
+			size:     0,
+			acquire:  3,
+			wantDial: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewConnectionPool(tt.size)
+
+			dialed := 0
+			p.dial = func(url string) (*amqp.Connection, error) {
+				dialed++
+				// a zero connection is not closed, it is enough to exercise the bookkeeping
+				return &amqp.Connection{}, nil
+			}
+
+			for i := 0; i < tt.acquire; i++ {
+				if _, err := p.acquire(unreachableURL); err != nil {
+					t.Fatalf("acquire() error = %v", err)
+				}
+			}
+
+			if dialed != tt.wantDial {
+				t.Errorf("dialed = %d, want %d", dialed, tt.wantDial)
+			}
+
+			refs := 0
+			for _, pc := range p.conns[unreachableURL] {
+				refs += pc.refs
+			}
+			if refs != tt.acquire {
+				t.Errorf("refs = %d, want %d", refs, tt.acquire)
+			}
+		})
+	}
+}
+
+func TestConnectionPool_acquireError(t *testing.T) {
+	p := NewConnectionPool(1)
+	p.dial = func(url string) (*amqp.Connection, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	if _, err := p.acquire(unreachableURL); err == nil {
+		t.Fatal("acquire() error = nil, want error")
+	}
+	if len(p.conns[unreachableURL]) != 0 {
+		t.Errorf("pool kept %d connections after a failed dial", len(p.conns[unreachableURL]))
+	}
+}
@@ -6,72 +6,158 @@ import (
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/reyhanfahlevi/pkg/go/log"
 	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
-	"golang.org/x/exp/rand"
+	"github.com/reyhanfahlevi/pkg/go/mq/metrics"
+	"github.com/reyhanfahlevi/pkg/go/token"
 )
 
+// ErrConsumerClosed returned when pausing or resuming a consumer after its shutdown
+var ErrConsumerClosed = errors.New("consumer is closed")
+
 type Consumer struct {
 	conn         *amqp.Connection
 	channel      *amqp.Channel
+	confirms     *confirmChannel
+	pool         *ConnectionPool
 	mu           sync.Mutex
 	connected    bool
 	notifyClose  chan *amqp.Error
+	notifyChan   chan *amqp.Error
 	shutdown     chan struct{}
+	closed       bool
 	reconnecting bool
+	paused       bool
+
+	// consumerTag is used to cancel the consume on shutdown
+	consumerTag string
+	workers     sync.WaitGroup
+	inFlight    map[*Message]struct{}
+
+	// batching is held by the batch worker while it runs, a multiple ack is only safe
+	// when no other worker has unsettled deliveries on the channel, e.g. the worker of a previous consume draining
+	batching sync.Mutex
+
+	sink     metrics.Sink
+	counters *metrics.Counters
+
+	// ctx is the root of the handler contexts, cancelled on Close or once the shutdown gave up waiting
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	// Single handler configuration
 	handler       adapter.ConsumerHandler
 	handlerConfig HandlerConfig
 	isConfigured  bool
-	baseDelay     time.Duration
-	maxDelay      time.Duration
-}
+	retryPolicy   adapter.RetryPolicy
+	classify      func(err error) bool
+	delayTiers    adapter.DelayTiers
 
-type HandlerConfig struct {
-	Durable    bool `json:"durable,omitempty"`
-	AutoDelete bool `json:"auto_delete,omitempty"`
-	Exclusive  bool `json:"exclusive,omitempty"`
-	NoWait     bool `json:"no_wait,omitempty"`
-	AutoAck    bool `json:"auto_ack,omitempty"`
-	NoLocal    bool `json:"no_local,omitempty"`
+	// deadLetterChannel replace the channel of the dead-letter operations, nil means a channel of the connection
+	deadLetterChannel func() (deadLetterChannel, error)
 }
 
 type ConsumerOptions func(*Consumer)
 
+// WithConnectionPool share the pool connections instead of dialing a connection for the consumer
+func WithConnectionPool(pool *ConnectionPool) ConsumerOptions {
+	return func(c *Consumer) {
+		c.pool = pool
+	}
+}
+
+// WithConsumerTag set the consumer tag, default: the handler channel or "<topic>-<random>"
+func WithConsumerTag(tag string) ConsumerOptions {
+	return func(c *Consumer) {
+		c.consumerTag = tag
+	}
+}
+
+// WithRetryPolicy set the delay before the next attempt of a failed message,
+// default: exponential from 1 second up to 10 minutes with jitter
+func WithRetryPolicy(policy adapter.RetryPolicy) ConsumerOptions {
+	return func(c *Consumer) {
+		c.retryPolicy = policy
+	}
+}
+
+// WithErrorClassifier report the handler errors that are permanent besides adapter.Permanent ones,
+// e.g. validation errors of a library, so they are dead-lettered without retrying
+func WithErrorClassifier(classify func(err error) bool) ConsumerOptions {
+	return func(c *Consumer) {
+		c.classify = classify
+	}
+}
+
+// WithMetrics report the consumer metrics to the sink
+func WithMetrics(sink metrics.Sink) ConsumerOptions {
+	return func(c *Consumer) {
+		c.sink = sink
+	}
+}
+
 func NewConsumer(handler adapter.ConsumerHandler, opt ...ConsumerOptions) *Consumer {
 	c := &Consumer{
-		shutdown:  make(chan struct{}),
-		handler:   handler,
-		baseDelay: time.Second,      // Base delay of 1 second
-		maxDelay:  time.Minute * 10, // Maximum delay of 10 minutes
+		shutdown: make(chan struct{}),
+		inFlight: make(map[*Message]struct{}),
+		handler:  handler,
+		retryPolicy: adapter.ExponentialBackoff{
+			Base:   time.Second,
+			Max:    10 * time.Minute,
+			Jitter: true,
+		},
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 
 	for _, opt := range opt {
 		opt(c)
 	}
+	c.counters = metrics.NewCounters(handler.Topic, c.sink)
 
 	return c
 }
 
+// connect dial the broker without holding the lock, so Stats and ConsumerTag don't wait for the dial
 func (r *Consumer) connect() error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	connected := r.connected
+	r.mu.Unlock()
 
-	if r.connected {
+	if connected {
 		return nil
 	}
 
-	conn, err := amqp.Dial(r.handler.URL)
+	var (
+		conn *amqp.Connection
+		err  error
+	)
+	if r.pool != nil {
+		conn, err = r.pool.acquire(r.handler.URL)
+	} else {
+		conn, err = amqp.Dial(r.handler.URL)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
 	}
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// shut down while dialing
+	if r.closed {
+		r.conn = conn
+		r.disconnect()
+		return ErrConsumerClosed
+	}
+
 	r.conn = conn
 	r.connected = true
-	r.notifyClose = make(chan *amqp.Error)
+	// buffered so amqp091 never blocks notifying a consumer busy reconnecting
+	r.notifyClose = make(chan *amqp.Error, 1)
 	r.conn.NotifyClose(r.notifyClose)
+	r.counters.SetConnected(true)
 
 	return nil
 }
@@ -79,28 +165,12 @@ func (r *Consumer) connect() error {
 func (r *Consumer) setupConsumer() error {
 	r.mu.Lock()
 
-	// Configure the consumer handler here instead of during initialization
+	// Guard against setting up the consumer twice on the same connection
 	if r.isConfigured {
 		r.mu.Unlock()
 		return fmt.Errorf("consumer handler already configured")
 	}
 
-	if r.handler.Concurrent < 1 {
-		r.handler.Concurrent = 1
-	}
-
-	if r.handler.MaxAttempts < 1 {
-		r.handler.MaxAttempts = 1
-	}
-
-	if r.handler.MaxInFlight < 1 {
-		r.handler.MaxInFlight = 1
-	}
-
-	handlerConfig := HandlerConfig{}
-	_ = r.handler.ParseExtraConfig(&handlerConfig)
-
-	r.handlerConfig = handlerConfig
 	r.isConfigured = true
 	r.mu.Unlock()
 
@@ -108,19 +178,25 @@ func (r *Consumer) setupConsumer() error {
 	if err != nil {
 		return fmt.Errorf("failed to open channel: %w", err)
 	}
+
+	r.mu.Lock()
 	r.channel = ch
+	r.notifyChan = make(chan *amqp.Error, 1)
+	ch.NotifyClose(r.notifyChan)
+	r.mu.Unlock()
 
-	// Declare queue
-	_, err = ch.QueueDeclare(
-		r.handler.Topic,
-		r.handlerConfig.Durable,    // durable
-		r.handlerConfig.AutoDelete, // auto-delete
-		r.handlerConfig.Exclusive,  // exclusive
-		r.handlerConfig.NoWait,     // no-wait
-		nil,                        // arguments
-	)
-	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+	// the messages are requeued and dead-lettered on the consumer channel, acknowledged once the broker confirmed the copy
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("failed to put channel into confirm mode: %w", err)
+	}
+	cc := newConfirmChannel(amqpChannel{ch})
+
+	r.mu.Lock()
+	r.confirms = cc
+	r.mu.Unlock()
+
+	if err := r.declareTopology(ch); err != nil {
+		return err
 	}
 
 	// Set QoS
@@ -133,77 +209,428 @@ func (r *Consumer) setupConsumer() error {
 		return fmt.Errorf("failed to set QoS: %w", err)
 	}
 
-	// Start consuming
+	r.mu.Lock()
+	paused := r.paused
+	r.mu.Unlock()
+
+	// a paused consumer keeps its channel and topology but doesn't consume until resumed
+	if paused {
+		return nil
+	}
+
+	return r.consume(ch, cc)
+}
+
+// consume start the deliveries and the workers handling them
+func (r *Consumer) consume(ch *amqp.Channel, cc *confirmChannel) error {
 	deliveries, err := ch.Consume(
 		r.handler.Topic,
-		r.handler.Channel,
+		r.consumerTag,
 		r.handlerConfig.AutoAck,   // auto-ack
 		r.handlerConfig.Exclusive, // exclusive
 		r.handlerConfig.NoLocal,   // no-local
 		r.handlerConfig.NoWait,    // no-wait
-		nil,                       // arguments
+		toTable(r.handlerConfig.ConsumeArgs),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to start consuming: %w", err)
 	}
 
+	if err := r.startWorkers(cc, deliveries); err != nil {
+		// the shutdown already waits for the workers, the deliveries are redelivered once the channel is closed
+		_ = ch.Cancel(r.consumerTag, false)
+		return err
+	}
+
+	return nil
+}
+
+// startWorkers start the workers of the deliveries. The workers are added under the lock Shutdown set closed with,
+// so none is added once Shutdown may be waiting for them
+func (r *Consumer) startWorkers(cc *confirmChannel, deliveries <-chan amqp.Delivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrConsumerClosed
+	}
+
+	if r.handler.BatchHandler != nil {
+		r.workers.Add(1)
+		go r.workBatch(cc, deliveries)
+		return nil
+	}
+
 	for i := 0; i < r.handler.Concurrent; i++ {
-		go func(workerID int) {
-			for delivery := range deliveries {
-				ctx := context.Background()
-
-				msg := &Message{
-					Delivery:    delivery,
-					maxAttempts: r.handler.MaxAttempts,
-					topic:       r.handler.Topic,
-					ch:          r.channel,
-				}
+		r.workers.Add(1)
+		go r.work(cc, deliveries)
+	}
 
-				msg.increaseAttempts()
-				err := r.handler.Handler(ctx, msg)
-				if err != nil {
-					log.Error(err)
+	return nil
+}
 
-					if msg.requeued {
-						continue
-					}
+// declareTopology declare the queue, the dead-letter queue and the exchanges the queue is bound to,
+// it runs on every connect so the topology is recreated after the broker lost it
+func (r *Consumer) declareTopology(ch *amqp.Channel) error {
+	// Declare queue
+	_, err := ch.QueueDeclare(
+		r.handler.Topic,
+		r.handlerConfig.Durable,    // durable
+		r.handlerConfig.AutoDelete, // auto-delete
+		r.handlerConfig.Exclusive,  // exclusive
+		r.handlerConfig.NoWait,     // no-wait
+		r.handlerConfig.Arguments.Table(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue: %w", err)
+	}
 
-					// Calculate exponential backoff delay
-					attempts := msg.GetAttempts()
-					delay := r.calculateBackoff(attempts)
-					msg.Requeue(delay)
-					continue
-				}
-				msg.Ack(false)
+	// Declare dead-letter queue
+	_, err = ch.QueueDeclare(
+		r.handlerConfig.DeadLetterQueue,
+		true,  // durable
+		false, // auto-delete
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead-letter queue: %w", err)
+	}
+
+	// Declare exchange and bind the queue with every routing key
+	if r.handlerConfig.Exchange != "" {
+		err = ch.ExchangeDeclare(
+			r.handlerConfig.Exchange,
+			r.handlerConfig.ExchangeKind,
+			r.handlerConfig.ExchangeDurable,    // durable
+			r.handlerConfig.ExchangeAutoDelete, // auto-delete
+			false,                              // internal
+			r.handlerConfig.NoWait,             // no-wait
+			toTable(r.handlerConfig.ExchangeArgs),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare exchange %s: %w", r.handlerConfig.Exchange, err)
+		}
+
+		for _, key := range r.handlerConfig.RoutingKeys {
+			err = ch.QueueBind(
+				r.handler.Topic,
+				key,
+				r.handlerConfig.Exchange,
+				r.handlerConfig.NoWait,
+				toTable(r.handlerConfig.BindingArgs),
+			)
+			if err != nil {
+				return fmt.Errorf("failed to bind queue to %s with key %q: %w", r.handlerConfig.Exchange, key, err)
 			}
-		}(i)
+		}
+	}
+
+	// Declare delayed-message exchange routing back to the queue
+	if r.handlerConfig.DelayedExchange != "" {
+		err = ch.ExchangeDeclare(
+			r.handlerConfig.DelayedExchange,
+			"x-delayed-message",
+			true,  // durable
+			false, // auto-delete
+			false, // internal
+			false, // no-wait
+			amqp.Table{"x-delayed-type": "direct"},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare delayed exchange: %w", err)
+		}
+
+		err = ch.QueueBind(r.handler.Topic, r.handler.Topic, r.handlerConfig.DelayedExchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("failed to bind queue to delayed exchange: %w", err)
+		}
+
+		return nil
+	}
+
+	// Declare the wait queues of the delay tiers once, requeueing only publishes into them
+	for _, tier := range r.delayTiers {
+		if _, err := declareWaitQueue(ch, "", r.handler.Topic, tier); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// Add this new method for calculating backoff
-func (r *Consumer) calculateBackoff(attempts int32) time.Duration {
-	// Calculate exponential delay: baseDelay * 2^(attempts-1)
-	delay := r.baseDelay * time.Duration(1<<uint(attempts-1))
+// work handle the deliveries until the consume is cancelled or the channel is closed
+func (r *Consumer) work(cc *confirmChannel, deliveries <-chan amqp.Delivery) {
+	defer r.workers.Done()
+
+	for delivery := range deliveries {
+		msg := r.newMessage(cc, delivery)
+
+		r.track(msg)
+		r.handle(msg)
+		r.untrack(msg)
+	}
+}
+
+// workBatch hand the deliveries to the batch handler, the batches are handled one after the other
+// so the multiple ack of a batch never covers a delivery of another one
+func (r *Consumer) workBatch(cc *confirmChannel, deliveries <-chan amqp.Delivery) {
+	defer r.workers.Done()
+
+	r.batching.Lock()
+	defer r.batching.Unlock()
+
+	for {
+		batch, ok := adapter.NextBatch(nil, deliveries, r.handler.BatchSize, r.handler.BatchWait)
+		if !ok {
+			return
+		}
+
+		msgs := make([]*Message, len(batch))
+		for i, delivery := range batch {
+			msgs[i] = r.newMessage(cc, delivery)
+		}
+
+		r.track(msgs...)
+		r.handleBatch(msgs)
+		r.untrack(msgs...)
+	}
+}
+
+func (r *Consumer) newMessage(cc *confirmChannel, delivery amqp.Delivery) *Message {
+	msg := newMessage(delivery)
+	msg.maxAttempts = r.handler.MaxAttempts
+	msg.topic = r.handler.Topic
+	msg.deadLetterQueue = r.handlerConfig.DeadLetterQueue
+	msg.delayedExchange = r.handlerConfig.DelayedExchange
+	msg.delayTiers = r.delayTiers
+	if cc != nil {
+		msg.confirms = cc
+	}
+	msg.counters = r.counters
+
+	return msg
+}
+
+func (r *Consumer) track(msgs ...*Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, msg := range msgs {
+		r.inFlight[msg] = struct{}{}
+	}
+	r.counters.SetInFlight(len(r.inFlight))
+}
+
+func (r *Consumer) untrack(msgs ...*Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, msg := range msgs {
+		delete(r.inFlight, msg)
+	}
+	r.counters.SetInFlight(len(r.inFlight))
+}
+
+func (r *Consumer) handle(msg *Message) {
+	md := adapter.Metadata{
+		Topic:       r.handler.Topic,
+		Channel:     r.handler.Channel,
+		MessageID:   msg.MessageId,
+		DeliveryTag: msg.DeliveryTag,
+		Attempts:    msg.GetAttempts(),
+	}
+
+	handler := r.handler
+	handler.Handler = adapter.RecoverHandler(handler.Handler, r.handlerConfig.FailFast, map[string]interface{}{"topic": r.handler.Topic})
+
+	start := time.Now()
+	err := handler.Invoke(r.ctx, md, msg)
+	r.counters.Handled(time.Since(start), err)
+	if err != nil {
+		log.ErrorWithFields(err.Error(), md.Fields())
+		r.fail(msg, err)
+		return
+	}
+
+	msg.Finish()
+}
+
+// handleBatch call the batch handler and settle every message with its own result.
+// When the whole batch succeeded and the handler settled none of the messages,
+// they are acknowledged at once with a multiple ack of the last delivery
+func (r *Consumer) handleBatch(msgs []*Message) {
+	md := adapter.Metadata{
+		Topic:   r.handler.Topic,
+		Channel: r.handler.Channel,
+	}
+
+	messages := make([]adapter.IMessage, len(msgs))
+	for i, msg := range msgs {
+		messages[i] = msg
+	}
+
+	handler := r.handler
+	handler.BatchHandler = adapter.RecoverBatchHandler(handler.BatchHandler, r.handlerConfig.FailFast, map[string]interface{}{"topic": r.handler.Topic})
+
+	start := time.Now()
+	err := handler.InvokeBatch(r.ctx, md, messages)
+	latency := time.Since(start)
+
+	results := adapter.BatchResults(err, len(msgs))
+	for _, result := range results {
+		r.counters.Handled(latency, result)
+	}
+
+	if err != nil {
+		fields := md.Fields()
+		fields["batch_size"] = len(msgs)
+		log.ErrorWithFields(err.Error(), fields)
+	}
+
+	if err == nil && r.ackBatch(msgs) {
+		return
+	}
+
+	for i, msg := range msgs {
+		if results[i] != nil {
+			r.fail(msg, results[i])
+			continue
+		}
+
+		msg.Finish()
+	}
+}
+
+// ackBatch acknowledge all the messages with a multiple ack, it report false without settling any of them
+// when the handler settled some already since acknowledging a delivery twice closes the channel
+func (r *Consumer) ackBatch(msgs []*Message) bool {
+	for _, msg := range msgs {
+		msg.mu.Lock()
+	}
+	defer func() {
+		for _, msg := range msgs {
+			msg.mu.Unlock()
+		}
+	}()
+
+	for _, msg := range msgs {
+		if msg.settled {
+			return false
+		}
+	}
+
+	for _, msg := range msgs {
+		msg.settled = true
+	}
+
+	last := msgs[len(msgs)-1]
+	if err := last.Ack(true); err != nil {
+		log.Error(errors.Wrapf(err, "%s failed to acknowledge batch up to delivery %d", r.handler.Topic, last.DeliveryTag))
+	}
+
+	return true
+}
+
+// fail requeue the message following the retry policy, or dead-letter it right away when the error is permanent.
+// A message the handler settled itself is left as is
+func (r *Consumer) fail(msg *Message, err error) {
+	if msg.isSettled() {
+		return
+	}
+
+	msg.handleErr = err
+
+	if r.isPermanent(err) {
+		msg.settle(func() {
+			msg.deadLetter(reasonPermanent)
+		})
+		return
+	}
+
+	msg.Requeue(r.retryPolicy.Backoff(msg.GetAttempts()))
+}
+
+// isPermanent report whether the error skip the retries
+func (r *Consumer) isPermanent(err error) bool {
+	return adapter.IsPermanent(err) || (r.classify != nil && r.classify(err))
+}
+
+// configure parse and validate the handler config once, so misconfiguration fails Run
+// instead of failing on the broker later
+func (r *Consumer) configure() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.handler.Concurrent < 1 {
+		r.handler.Concurrent = 1
+	}
+
+	if r.handler.MaxAttempts < 1 {
+		r.handler.MaxAttempts = 1
+	}
+
+	if r.handler.MaxInFlight < 1 {
+		r.handler.MaxInFlight = 1
+	}
+
+	if r.handler.BatchHandler != nil {
+		if r.handler.BatchSize < 1 {
+			r.handler.BatchSize = adapter.DefaultBatchSize
+		}
+
+		// the broker must deliver a full batch before any of it is acknowledged
+		if r.handler.MaxInFlight < r.handler.BatchSize {
+			r.handler.MaxInFlight = r.handler.BatchSize
+		}
+	}
+
+	handlerConfig := HandlerConfig{}
+	if err := r.handler.ParseExtraConfig(&handlerConfig); err != nil {
+		return fmt.Errorf("failed to parse extra config: %w", err)
+	}
+
+	if err := handlerConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid %s config: %w", r.handler.Topic, err)
+	}
+	handlerConfig.setDefaults(r.handler.Topic)
+	r.handlerConfig = handlerConfig
+
+	if policy := handlerConfig.Retry.policy(); policy != nil {
+		r.retryPolicy = policy
+	}
+
+	delayTiers, err := adapter.ParseDelayTiers(handlerConfig.DelayTiers)
+	if err != nil {
+		return fmt.Errorf("invalid %s config: %w", r.handler.Topic, err)
+	}
+	r.delayTiers = delayTiers
 
-	// Add some jitter to prevent thundering herd
-	jitter := time.Duration(rand.Int63n(int64(delay) / 2))
-	delay = delay + jitter
+	if r.consumerTag == "" {
+		r.consumerTag = r.handler.Channel
+	}
 
-	// Ensure we don't exceed maximum delay
-	if delay > r.maxDelay {
-		delay = r.maxDelay
+	if r.consumerTag == "" {
+		id, err := token.GenerateString(16)
+		if err != nil {
+			return err
+		}
+		r.consumerTag = r.handler.Topic + "-" + id
 	}
 
-	return delay
+	return nil
 }
 
 func (r *Consumer) Run() error {
-	if r.handler.Handler == nil {
+	if r.handler.Handler == nil && r.handler.BatchHandler == nil {
 		return fmt.Errorf("no consumer handler specified")
 	}
 
+	if err := r.configure(); err != nil {
+		return err
+	}
+
 	if err := r.connect(); err != nil {
 		return err
 	}
@@ -213,12 +640,22 @@ func (r *Consumer) Run() error {
 	return r.setupConsumer()
 }
 
+// reconnectLoop recover the consumer when its connection or its channel is closed by the broker,
+// the notifications are read again after every reconnect since they belong to the previous connection
 func (r *Consumer) reconnectLoop() {
 	for {
+		r.mu.Lock()
+		notifyClose, notifyChan := r.notifyClose, r.notifyChan
+		r.mu.Unlock()
+
 		select {
 		case <-r.shutdown:
 			return
-		case err := <-r.notifyClose:
+		case err := <-notifyClose:
+			if err != nil {
+				r.reconnect()
+			}
+		case err := <-notifyChan:
 			if err != nil {
 				r.reconnect()
 			}
@@ -226,6 +663,22 @@ func (r *Consumer) reconnectLoop() {
 	}
 }
 
+// disconnect give the connection back to the pool or close it, the lock must be held
+func (r *Consumer) disconnect() {
+	if r.conn == nil {
+		return
+	}
+
+	if r.pool != nil {
+		r.pool.release(r.conn)
+	} else if !r.conn.IsClosed() {
+		_ = r.conn.Close()
+	}
+
+	r.conn = nil
+	r.connected = false
+}
+
 func (r *Consumer) reconnect() {
 	r.mu.Lock()
 	if r.reconnecting {
@@ -233,9 +686,13 @@ func (r *Consumer) reconnect() {
 		return
 	}
 	r.reconnecting = true
-	r.connected = false
 	r.isConfigured = false // Reset the configuration flag
+	if r.channel != nil && !r.channel.IsClosed() {
+		_ = r.channel.Close()
+	}
+	r.disconnect()
 	r.mu.Unlock()
+	r.counters.SetConnected(false)
 
 	backoff := time.Second
 	maxBackoff := 30 * time.Second
@@ -257,7 +714,8 @@ func (r *Consumer) reconnect() {
 
 			if err := r.setupConsumer(); err != nil {
 				r.mu.Lock()
-				r.connected = false
+				r.isConfigured = false
+				r.disconnect()
 				r.mu.Unlock()
 				continue
 			}
@@ -265,25 +723,187 @@ func (r *Consumer) reconnect() {
 			r.mu.Lock()
 			r.reconnecting = false
 			r.mu.Unlock()
+			r.counters.Reconnected()
 			return
 		}
 	}
 }
 
-// Close gracefully shuts down the consumer
-func (r *Consumer) Close() error {
+// Shutdown cancel the consume and wait for the in-flight handlers until the context is done.
+// Messages still in-flight after that are nacked for redelivery and reported in *adapter.ShutdownError
+func (r *Consumer) Shutdown(ctx context.Context) error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
-
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
 	close(r.shutdown)
+	ch, tag, paused := r.channel, r.consumerTag, r.paused
+	r.mu.Unlock()
+
+	// stop receiving new deliveries, the workers exit once the delivery channel is drained
+	if ch != nil && !ch.IsClosed() && !paused {
+		if err := ch.Cancel(tag, false); err != nil {
+			log.Error(errors.Wrapf(err, "%s failed to cancel consume", r.handler.Topic))
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.workers.Wait()
+		close(done)
+	}()
+
+	var abandoned []adapter.AbandonedMessage
+	select {
+	case <-done:
+	case <-ctx.Done():
+		r.cancel()
+		abandoned = r.abandonInFlight()
+	}
+	r.cancel()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
 	if r.channel != nil {
-		r.channel.Close()
+		_ = r.channel.Close()
+	}
+
+	var err error
+	if r.pool != nil {
+		r.disconnect()
+	} else if r.conn != nil && !r.conn.IsClosed() {
+		err = r.conn.Close()
+	}
+	r.counters.SetConnected(false)
+
+	if len(abandoned) > 0 {
+		return &adapter.ShutdownError{Abandoned: abandoned}
 	}
 
-	if r.conn != nil {
-		return r.conn.Close()
+	return err
+}
+
+// Pause stop receiving new deliveries, the in-flight handlers finish normally.
+// The connection and the channel stay open and a reconnect doesn't consume until Resume
+func (r *Consumer) Pause() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrConsumerClosed
+	}
+	if r.paused {
+		r.mu.Unlock()
+		return nil
+	}
+	r.paused = true
+	ch, tag := r.channel, r.consumerTag
+	r.mu.Unlock()
+
+	if ch == nil || ch.IsClosed() {
+		return nil
+	}
+
+	if err := ch.Cancel(tag, false); err != nil {
+		return fmt.Errorf("failed to cancel consume: %w", err)
 	}
 
 	return nil
 }
+
+// Resume start receiving deliveries again after Pause
+func (r *Consumer) Resume() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrConsumerClosed
+	}
+	if !r.paused {
+		r.mu.Unlock()
+		return nil
+	}
+	r.paused = false
+	ch, cc := r.channel, r.confirms
+	r.mu.Unlock()
+
+	// the reconnect will consume once the channel is back
+	if ch == nil || ch.IsClosed() {
+		return nil
+	}
+
+	return r.consume(ch, cc)
+}
+
+func (r *Consumer) abandonInFlight() []adapter.AbandonedMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var abandoned []adapter.AbandonedMessage
+	for msg := range r.inFlight {
+		if !msg.abandon() {
+			continue
+		}
+
+		id := msg.MessageId
+		if id == "" {
+			id = fmt.Sprintf("delivery-%d", msg.DeliveryTag)
+		}
+
+		abandoned = append(abandoned, adapter.AbandonedMessage{
+			Topic:     r.handler.Topic,
+			MessageID: id,
+			Attempts:  msg.GetAttempts(),
+		})
+	}
+
+	return abandoned
+}
+
+// Close shuts down the consumer without waiting for the in-flight handlers,
+// their messages are nacked for redelivery
+func (r *Consumer) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	return r.Shutdown(ctx)
+}
+
+// ConsumerTag return the tag identifying the consume on the channel, it is set once the consumer runs
+func (r *Consumer) ConsumerTag() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.consumerTag
+}
+
+// Stats return a snapshot of the consumer connection state and counters
+func (r *Consumer) Stats() metrics.ConsumerStats {
+	stats := r.counters.Snapshot()
+	stats.Channel = r.handler.Channel
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats.Connected = r.connected && !r.closed && r.conn != nil && !r.conn.IsClosed()
+	stats.InFlight = len(r.inFlight)
+
+	return stats
+}
+
+// Backlog return the number of messages ready in the queue, it asks the broker on a short-lived channel
+func (r *Consumer) Backlog() (int, error) {
+	ch, err := r.openChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(r.handler.Topic, false, false, false, false, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect queue %s: %w", r.handler.Topic, err)
+	}
+
+	return q.Messages, nil
+}
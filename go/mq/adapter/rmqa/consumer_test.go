@@ -0,0 +1,234 @@
+package rmqa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+type stubMessage struct{}
+
+func (stubMessage) Finish()                                   {}
+func (stubMessage) RequeueWithoutBackoff(delay time.Duration) {}
+func (stubMessage) Requeue(delay time.Duration)               {}
+func (stubMessage) GetAttempts() int32                        { return 1 }
+func (stubMessage) GetBody() []byte                           { return nil }
+func (stubMessage) GetID() string                             { return "" }
+func (stubMessage) GetHeaders() map[string]interface{}        { return nil }
+func (stubMessage) GetCorrelationID() string                  { return "" }
+func (stubMessage) GetFirstSeen() time.Time                   { return time.Time{} }
+func (stubMessage) GetLastError() string                      { return "" }
+func (stubMessage) GetTimestamp() time.Time                   { return time.Time{} }
+func (stubMessage) GetContentType() string                    { return "" }
+func (stubMessage) Touch()                                    {}
+
+func TestConsumer_isPermanent(t *testing.T) {
+	errInvalid := errors.New("invalid payload")
+	classify := func(err error) bool { return errors.Is(err, errInvalid) }
+
+	tests := []struct {
+		name     string
+		opt      []ConsumerOptions
+		err      error
+		wantPerm bool
+	}{
+		{
+			name:     "Test transient error",
+			err:      errors.New("timeout"),
+			wantPerm: false,
+		}, {
+			name:     "Test permanent error",
+			err:      adapter.Permanent(errors.New("bad")),
+			wantPerm: true,
+		}, {
+			name:     "Test classified error",
+			opt:      []ConsumerOptions{WithErrorClassifier(classify)},
+			err:      fmt.Errorf("decode: %w", errInvalid),
+			wantPerm: true,
+		}, {
+			name:     "Test unclassified error",
+			opt:      []ConsumerOptions{WithErrorClassifier(classify)},
+			err:      errors.New("timeout"),
+			wantPerm: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConsumer(adapter.ConsumerHandler{Topic: "orders"}, tt.opt...)
+			if got := c.isPermanent(tt.err); got != tt.wantPerm {
+				t.Errorf("isPermanent() = %v, want %v", got, tt.wantPerm)
+			}
+		})
+	}
+}
+
+type ackRecorder struct {
+	acks    []string
+	rejects []uint64
+	nacked  bool
+}
+
+func (a *ackRecorder) Ack(tag uint64, multiple bool) error {
+	a.acks = append(a.acks, fmt.Sprintf("%d/%t", tag, multiple))
+	return nil
+}
+
+func (a *ackRecorder) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked = true
+	return nil
+}
+
+func (a *ackRecorder) Reject(tag uint64, requeue bool) error {
+	a.rejects = append(a.rejects, tag)
+	return nil
+}
+
+func TestConsumer_handleBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     adapter.BatchHandler
+		wantAcks    []string
+		wantRejects []uint64
+	}{
+		{
+			name: "Test batch acknowledged with multiple ack",
+			handler: func(ctx context.Context, messages []adapter.IMessage) error {
+				return nil
+			},
+			wantAcks: []string{"3/true"},
+		}, {
+			name: "Test failed messages settled one by one",
+			handler: func(ctx context.Context, messages []adapter.IMessage) error {
+				batchErr := adapter.NewBatchError(len(messages))
+				batchErr.Fail(1, adapter.Permanent(errors.New("bad")))
+				return batchErr
+			},
+			wantAcks:    []string{"1/false", "3/false"},
+			wantRejects: []uint64{2},
+		}, {
+			name: "Test messages settled by the handler",
+			handler: func(ctx context.Context, messages []adapter.IMessage) error {
+				messages[0].Finish()
+				return nil
+			},
+			wantAcks: []string{"1/false", "2/false", "3/false"},
+		}, {
+			name: "Test whole batch failed",
+			handler: func(ctx context.Context, messages []adapter.IMessage) error {
+				return errors.New("db down")
+			},
+			wantRejects: []uint64{1, 2, 3},
+		}, {
+			name: "Test batch handler panic",
+			handler: func(ctx context.Context, messages []adapter.IMessage) error {
+				panic("boom")
+			},
+			wantRejects: []uint64{1, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConsumer(adapter.ConsumerHandler{Topic: "orders", MaxAttempts: 1, BatchHandler: tt.handler})
+			ack := &ackRecorder{}
+
+			var msgs []*Message
+			for tag := uint64(1); tag <= 3; tag++ {
+				msgs = append(msgs, c.newMessage(nil, amqp.Delivery{Acknowledger: ack, DeliveryTag: tag}))
+			}
+
+			c.handleBatch(msgs)
+
+			if fmt.Sprint(ack.acks) != fmt.Sprint(tt.wantAcks) {
+				t.Errorf("handleBatch() acks = %v, want %v", ack.acks, tt.wantAcks)
+			}
+			if fmt.Sprint(ack.rejects) != fmt.Sprint(tt.wantRejects) {
+				t.Errorf("handleBatch() rejects = %v, want %v", ack.rejects, tt.wantRejects)
+			}
+		})
+	}
+}
+
+func TestConsumer_Shutdown(t *testing.T) {
+	tests := []struct {
+		name          string
+		timeout       time.Duration
+		wantAck       bool
+		wantAbandoned int
+	}{
+		{
+			name:    "Test in-flight message drained",
+			timeout: time.Second,
+			wantAck: true,
+		}, {
+			name:          "Test in-flight message abandoned on timeout",
+			timeout:       20 * time.Millisecond,
+			wantAbandoned: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			c := NewConsumer(adapter.ConsumerHandler{
+				Topic:      "orders",
+				Concurrent: 1,
+				Handler: func(ctx context.Context, message adapter.IMessage) error {
+					close(started)
+					select {
+					case <-time.After(100 * time.Millisecond):
+					case <-ctx.Done():
+					}
+					return ctx.Err()
+				},
+			})
+			ack := &ackRecorder{}
+
+			deliveries := make(chan amqp.Delivery, 1)
+			deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, MessageId: "1"}
+			if err := c.startWorkers(nil, deliveries); err != nil {
+				t.Fatalf("startWorkers() error = %v", err)
+			}
+			<-started
+			// the cancelled consume closes the deliveries
+			close(deliveries)
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			err := c.Shutdown(ctx)
+
+			var shutdownErr *adapter.ShutdownError
+			switch {
+			case tt.wantAbandoned == 0 && err != nil:
+				t.Fatalf("Shutdown() error = %v, want nil", err)
+			case tt.wantAbandoned > 0 && !errors.As(err, &shutdownErr):
+				t.Fatalf("Shutdown() error = %v, want *adapter.ShutdownError", err)
+			case tt.wantAbandoned > 0 && len(shutdownErr.Abandoned) != tt.wantAbandoned:
+				t.Errorf("Shutdown() abandoned = %d, want %d", len(shutdownErr.Abandoned), tt.wantAbandoned)
+			}
+
+			if got := len(ack.acks) > 0; got != tt.wantAck {
+				t.Errorf("Shutdown() acked = %v, want %v", got, tt.wantAck)
+			}
+			if ack.nacked != (tt.wantAbandoned > 0) {
+				t.Errorf("Shutdown() nacked = %v, want %v", ack.nacked, tt.wantAbandoned > 0)
+			}
+		})
+	}
+}
+
+func TestConsumer_startWorkersAfterShutdown(t *testing.T) {
+	c := NewConsumer(adapter.ConsumerHandler{Topic: "orders", Concurrent: 1})
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// a reconnect or a resume racing the shutdown must not add workers it may be waiting for
+	if err := c.startWorkers(nil, make(chan amqp.Delivery)); !errors.Is(err, ErrConsumerClosed) {
+		t.Errorf("startWorkers() error = %v, want %v", err, ErrConsumerClosed)
+	}
+}
@@ -1,33 +1,546 @@
 package rmqa
 
 import (
-	"github.com/pkg/errors"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/reyhanfahlevi/pkg/go/log"
 	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/reyhanfahlevi/pkg/go/mq/metrics"
+)
+
+var (
+	// ErrConsumerNotFound returned when no consumer is registered for the topic
+	ErrConsumerNotFound = errors.New("consumer not found")
+
+	// ErrManagerClosed returned when starting consumers after the manager shutdown
+	ErrManagerClosed = errors.New("consumer manager is closed")
 )
 
+// FailurePolicy decide what Run does when a consumer fails to start
+type FailurePolicy int
+
+const (
+	// FailAll start every consumer and return all the startup errors joined, it is the default
+	FailAll FailurePolicy = iota
+
+	// FailFast stop at the first startup error and close the consumers already started
+	FailFast
+
+	// RetryInBackground log the startup error and keep starting the consumer with backoff, Run returns nil
+	RetryInBackground
+)
+
+// ConsumerState is the lifecycle state of a managed consumer
+type ConsumerState string
+
+const (
+	StateIdle     ConsumerState = "idle"
+	StateRunning  ConsumerState = "running"
+	StatePaused   ConsumerState = "paused"
+	StateStopped  ConsumerState = "stopped"
+	StateFailed   ConsumerState = "failed"
+	StateRetrying ConsumerState = "retrying"
+
+	// StateStarting is the state of a consumer while Run starts it
+	StateStarting ConsumerState = "starting"
+
+	// StateRestarting is the state of a consumer between the shutdown and the start of Restart
+	StateRestarting ConsumerState = "restarting"
+)
+
+// ConsumerStatus is the state of a managed consumer
+type ConsumerStatus struct {
+	Topic       string        `json:"topic"`
+	ConsumerTag string        `json:"consumer_tag,omitempty"`
+	State       ConsumerState `json:"state"`
+	Error       string        `json:"error,omitempty"`
+}
+
+type managedConsumer struct {
+	handler  adapter.ConsumerHandler
+	opt      []ConsumerOptions
+	consumer *Consumer
+	state    ConsumerState
+	err      error
+}
+
 type ConsumerManager struct {
-	consumers []*Consumer
+	mu        sync.Mutex
+	consumers []*managedConsumer
+	opt       []ConsumerOptions
+	policy    FailurePolicy
+	pool      *ConnectionPool
+	poolSize  int
+	shutdown  chan struct{}
+	closed    bool
+
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+}
+
+// ManagerOptions option to modify the consumer manager
+type ManagerOptions func(*ConsumerManager)
+
+// WithConsumerOptions apply the options to every consumer of the manager
+func WithConsumerOptions(opt ...ConsumerOptions) ManagerOptions {
+	return func(c *ConsumerManager) {
+		c.opt = append(c.opt, opt...)
+	}
+}
+
+// WithFailurePolicy set what Run does when a consumer fails to start, default: FailAll
+func WithFailurePolicy(policy FailurePolicy) ManagerOptions {
+	return func(c *ConsumerManager) {
+		c.policy = policy
+	}
 }
 
-func NewManager() *ConsumerManager {
-	return &ConsumerManager{}
+// WithPoolSize set the number of AMQP connections shared by the consumers of a URL, default: 2
+func WithPoolSize(size int) ManagerOptions {
+	return func(c *ConsumerManager) {
+		c.poolSize = size
+	}
 }
 
+// NewManager will create the consumer manager
+func NewManager(opt ...ManagerOptions) *ConsumerManager {
+	c := &ConsumerManager{
+		shutdown:      make(chan struct{}),
+		retryDelay:    time.Second,
+		maxRetryDelay: 30 * time.Second,
+	}
+
+	for _, opt := range opt {
+		opt(c)
+	}
+	c.pool = NewConnectionPool(c.poolSize)
+
+	return c
+}
+
+// RegisterConsumerHandler will register the consumer handler, disabled handler is skipped.
+// A queue can have several handlers, each one is a consumer with its own channel and consumer tag
 func (c *ConsumerManager) RegisterConsumerHandler(consumer adapter.ConsumerHandler) error {
-	conn := NewConsumer(consumer)
-	c.consumers = append(c.consumers, conn)
+	if !consumer.Enable {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	opt := append([]ConsumerOptions{WithConnectionPool(c.pool)}, c.opt...)
+	// the channel is the consumer tag, without it the tags are random and distinct already
+	if n := c.count(consumer.Topic, consumer.Channel); consumer.Channel != "" && n > 0 {
+		opt = append(opt, WithConsumerTag(fmt.Sprintf("%s-%d", consumer.Channel, n+1)))
+	}
+
+	c.consumers = append(c.consumers, &managedConsumer{
+		handler:  consumer,
+		opt:      opt,
+		consumer: NewConsumer(consumer, opt...),
+		state:    StateIdle,
+	})
 	return nil
 }
 
+// count return the number of consumers bound to the same queue, the lock must be held
+func (c *ConsumerManager) count(topic, channel string) int {
+	n := 0
+	for _, mc := range c.consumers {
+		if mc.handler.Topic == topic && mc.handler.Channel == channel {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Run start every registered consumer following the failure policy.
+// The dial and the declarations can take a while, the lock is not held meanwhile
 func (c *ConsumerManager) Run() error {
-	for _, conn := range c.consumers {
-		err := conn.Run()
-		if err != nil {
-			log.Error(errors.Wrapf(err, "%s failed to start", conn.handler.Topic))
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrManagerClosed
+	}
+
+	var (
+		starting  []*managedConsumer
+		consumers []*Consumer
+	)
+	for _, mc := range c.consumers {
+		if mc.state != StateIdle {
 			continue
 		}
+		mc.state = StateStarting
+		starting = append(starting, mc)
+		consumers = append(consumers, mc.consumer)
 	}
+	c.mu.Unlock()
 
-	return nil
+	var errs []error
+	for i, mc := range starting {
+		consumer := consumers[i]
+		err := consumer.Run()
+
+		c.mu.Lock()
+		if mc.state != StateStarting {
+			// stopped, restarted or shut down while starting
+			c.mu.Unlock()
+			_ = consumer.Close()
+			continue
+		}
+
+		if err == nil {
+			mc.state, mc.err = StateRunning, nil
+			c.mu.Unlock()
+			continue
+		}
+
+		err = fmt.Errorf("%s failed to start: %w", mc.handler.Topic, err)
+		mc.err = err
+
+		switch c.policy {
+		case FailFast:
+			mc.state = StateFailed
+			for _, rest := range starting[i+1:] {
+				if rest.state == StateStarting {
+					rest.state = StateIdle
+				}
+			}
+			running := c.stopRunning()
+			c.mu.Unlock()
+
+			// a consumer can't run twice, the failed one is closed and replaced on restart
+			_ = consumer.Close()
+			for _, r := range running {
+				_ = r.Close()
+			}
+			return err
+		case RetryInBackground:
+			log.Error(err)
+			mc.state = StateRetrying
+			go c.retry(mc)
+		default:
+			mc.state = StateFailed
+			errs = append(errs, err)
+		}
+		c.mu.Unlock()
+
+		_ = consumer.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// stopRunning mark the consumers started so far stopped and return them to be closed, the lock must be held
+func (c *ConsumerManager) stopRunning() []*Consumer {
+	var running []*Consumer
+	for _, mc := range c.consumers {
+		if mc.state == StateRunning || mc.state == StatePaused {
+			mc.state = StateStopped
+			running = append(running, mc.consumer)
+		}
+	}
+
+	return running
+}
+
+// retry start a new consumer with backoff until it runs, the consumer is stopped or the manager shuts down
+func (c *ConsumerManager) retry(mc *managedConsumer) {
+	delay := c.retryDelay
+
+	for {
+		select {
+		case <-c.shutdown:
+			return
+		case <-time.After(delay):
+		}
+
+		c.mu.Lock()
+		if mc.state != StateRetrying {
+			c.mu.Unlock()
+			return
+		}
+		next := c.newConsumer(mc)
+		c.mu.Unlock()
+
+		// the dial can take a while, the lock is not held meanwhile
+		err := next.Run()
+
+		c.mu.Lock()
+		switch {
+		case mc.state != StateRetrying:
+			// stopped or shut down while starting
+			c.mu.Unlock()
+			_ = next.Close()
+			return
+		case err == nil:
+			mc.consumer, mc.state, mc.err = next, StateRunning, nil
+			c.mu.Unlock()
+			return
+		}
+
+		err = fmt.Errorf("%s failed to start: %w", mc.handler.Topic, err)
+		mc.err = err
+		c.mu.Unlock()
+
+		_ = next.Close()
+		log.Error(err)
+
+		delay *= 2
+		if delay > c.maxRetryDelay {
+			delay = c.maxRetryDelay
+		}
+	}
+}
+
+// newConsumer create a fresh consumer for the handler keeping the counters of the previous one
+func (c *ConsumerManager) newConsumer(mc *managedConsumer) *Consumer {
+	next := NewConsumer(mc.handler, mc.opt...)
+	next.counters = mc.consumer.counters
+
+	return next
+}
+
+// Consumers return every consumer of the topic in registration order, they can be used to inspect or replay
+// the dead letters. A topic without consumers return nil
+func (c *ConsumerManager) Consumers(topic string) []*Consumer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var consumers []*Consumer
+	for _, mc := range c.consumers {
+		if mc.handler.Topic == topic {
+			consumers = append(consumers, mc.consumer)
+		}
+	}
+
+	return consumers
+}
+
+// Status return the state of every consumer
+func (c *ConsumerManager) Status() []ConsumerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := make([]ConsumerStatus, 0, len(c.consumers))
+	for _, mc := range c.consumers {
+		s := ConsumerStatus{
+			Topic:       mc.handler.Topic,
+			ConsumerTag: mc.consumer.ConsumerTag(),
+			State:       mc.state,
+		}
+		if mc.err != nil {
+			s.Error = mc.err.Error()
+		}
+		status = append(status, s)
+	}
+
+	return status
+}
+
+// find return the consumers of the topic, the lock must be held
+func (c *ConsumerManager) find(topic string) ([]*managedConsumer, error) {
+	var found []*managedConsumer
+	for _, mc := range c.consumers {
+		if mc.handler.Topic == topic {
+			found = append(found, mc)
+		}
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrConsumerNotFound, topic)
+	}
+
+	return found, nil
+}
+
+// each run fn on every consumer of the topic under the manager lock, fn must not block
+func (c *ConsumerManager) each(topic string, fn func(mc *managedConsumer) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	found, err := c.find(topic)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, mc := range found {
+		if err := fn(mc); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Stop shut down the consumers of the topic, waiting for their in-flight handlers until the context is done
+func (c *ConsumerManager) Stop(ctx context.Context, topic string) error {
+	c.mu.Lock()
+	found, err := c.find(topic)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	targets := make([]adapter.Shutdowner, 0, len(found))
+	for _, mc := range found {
+		mc.state = StateStopped
+		targets = append(targets, mc.consumer)
+	}
+	c.mu.Unlock()
+
+	// the shutdown waits for the handlers, the lock is not held meanwhile
+	return adapter.ShutdownAll(ctx, targets...)
+}
+
+// Restart shut down the consumers of the topic and start new ones, it fails with ErrManagerClosed after Shutdown
+func (c *ConsumerManager) Restart(ctx context.Context, topic string) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrManagerClosed
+	}
+
+	found, err := c.find(topic)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	prev := make([]*Consumer, len(found))
+	next := make([]*Consumer, len(found))
+	for i, mc := range found {
+		// a retrying consumer gives up once the state changed
+		mc.state = StateRestarting
+		prev[i], next[i] = mc.consumer, c.newConsumer(mc)
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	for i, mc := range found {
+		// the shutdown and the dial can take a while, the lock is not held meanwhile
+		if err := prev[i].Shutdown(ctx); err != nil {
+			log.Error(fmt.Errorf("%s failed to stop before restart: %w", topic, err))
+		}
+
+		// the manager shut down meanwhile, its connection pool is closed
+		if c.isClosed() {
+			for _, n := range next[i:] {
+				_ = n.Close()
+			}
+			return errors.Join(append(errs, ErrManagerClosed)...)
+		}
+		err := next[i].Run()
+
+		c.mu.Lock()
+		if c.closed || mc.state != StateRestarting {
+			// stopped or shut down while restarting
+			c.mu.Unlock()
+			_ = next[i].Close()
+			continue
+		}
+
+		mc.consumer = next[i]
+		if err != nil {
+			_ = next[i].Close()
+			mc.state, mc.err = StateFailed, fmt.Errorf("%s failed to start: %w", topic, err)
+			errs = append(errs, mc.err)
+		} else {
+			mc.state, mc.err = StateRunning, nil
+		}
+		c.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *ConsumerManager) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+// Pause stop the deliveries of the topic consumers without closing them
+func (c *ConsumerManager) Pause(topic string) error {
+	return c.each(topic, func(mc *managedConsumer) error {
+		if mc.state != StateRunning {
+			return fmt.Errorf("%s can't be paused while %s", topic, mc.state)
+		}
+
+		if err := mc.consumer.Pause(); err != nil {
+			return err
+		}
+
+		mc.state = StatePaused
+		return nil
+	})
+}
+
+// Resume start the deliveries of the paused topic consumers again
+func (c *ConsumerManager) Resume(topic string) error {
+	return c.each(topic, func(mc *managedConsumer) error {
+		if mc.state != StatePaused {
+			return fmt.Errorf("%s can't be resumed while %s", topic, mc.state)
+		}
+
+		if err := mc.consumer.Resume(); err != nil {
+			return err
+		}
+
+		mc.state = StateRunning
+		return nil
+	})
+}
+
+// Stats return a snapshot of every consumer
+func (c *ConsumerManager) Stats() []metrics.ConsumerStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := make([]metrics.ConsumerStats, 0, len(c.consumers))
+	for _, mc := range c.consumers {
+		stats = append(stats, mc.consumer.Stats())
+	}
+
+	return stats
+}
+
+// Shutdown shuts down all consumers concurrently and wait for their in-flight handlers until the context is done,
+// the messages abandoned by every consumer are reported together in *adapter.ShutdownError
+func (c *ConsumerManager) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.shutdown)
+	}
+
+	targets := make([]adapter.Shutdowner, 0, len(c.consumers))
+	for _, mc := range c.consumers {
+		targets = append(targets, mc.consumer)
+		mc.state = StateStopped
+	}
+	c.mu.Unlock()
+
+	err := adapter.ShutdownAll(ctx, targets...)
+
+	// the consumers gave their connections back already, this closes the ones kept by an abandoned shutdown
+	_ = c.pool.Close()
+
+	return err
+}
+
+// Close shuts down all consumers without waiting for the in-flight handlers
+func (c *ConsumerManager) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	return c.Shutdown(ctx)
 }
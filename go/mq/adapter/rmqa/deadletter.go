@@ -0,0 +1,279 @@
+package rmqa
+
+import (
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	reasonMaxAttempts = "max attempts reached"
+	reasonPermanent   = "permanent error"
+
+	headerDeadLetterReason   = "x-dlq-reason"
+	headerDeadLetterAttempts = "x-dlq-attempts"
+	headerDeadLetterError    = "x-dlq-last-error"
+	headerDeadLetterQueue    = "x-dlq-original-queue"
+	headerDeadLetterTime     = "x-dlq-timestamp"
+)
+
+// replayConfirmTimeout is the maximum time to wait for the broker confirmation of a replayed dead letter
+const replayConfirmTimeout = 5 * time.Second
+
+// deadLetterChannel is the part of *amqp.Channel used to inspect and replay the dead letters
+type deadLetterChannel interface {
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueuePurge(name string, noWait bool) (int, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Ack(tag uint64, multiple bool) error
+	Nack(tag uint64, multiple bool, requeue bool) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// DeadLetter is a message parked in the dead-letter queue
+type DeadLetter struct {
+	MessageID      string
+	Body           []byte
+	Headers        amqp.Table
+	Reason         string
+	Attempts       int32
+	LastError      string
+	OriginalQueue  string
+	DeadLetteredAt time.Time
+}
+
+func newDeadLetter(d amqp.Delivery) DeadLetter {
+	dl := DeadLetter{
+		MessageID: d.MessageId,
+		Body:      d.Body,
+		Headers:   d.Headers,
+	}
+
+	dl.Reason, _ = d.Headers[headerDeadLetterReason].(string)
+	dl.LastError, _ = d.Headers[headerDeadLetterError].(string)
+	dl.OriginalQueue, _ = d.Headers[headerDeadLetterQueue].(string)
+	dl.DeadLetteredAt, _ = d.Headers[headerDeadLetterTime].(time.Time)
+
+	switch v := d.Headers[headerDeadLetterAttempts].(type) {
+	case int32:
+		dl.Attempts = v
+	case int64:
+		dl.Attempts = int32(v)
+	case int:
+		dl.Attempts = int32(v)
+	}
+
+	return dl
+}
+
+// DeadLetterQueue return the name of the consumer dead-letter queue
+func (r *Consumer) DeadLetterQueue() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.handlerConfig.DeadLetterQueue != "" {
+		return r.handlerConfig.DeadLetterQueue
+	}
+
+	return r.handler.Topic + ".dlq"
+}
+
+// ListDeadLetters return up to limit dead letters without removing them from the queue,
+// limit <= 0 return all of them
+func (r *Consumer) ListDeadLetters(limit int) ([]DeadLetter, error) {
+	var result []DeadLetter
+
+	err := r.withDeadLetters(limit, func(ch deadLetterChannel, deliveries []amqp.Delivery) error {
+		for _, d := range deliveries {
+			result = append(result, newDeadLetter(d))
+		}
+
+		// put everything back in the original order
+		return ch.Nack(deliveries[len(deliveries)-1].DeliveryTag, true, true)
+	})
+
+	return result, err
+}
+
+// ReplayDeadLetters move up to limit dead letters back to the consumer queue with fresh attempts,
+// limit <= 0 replay all of them. Each dead letter is acknowledged only once the broker confirmed
+// its copy was routed to the queue, it is returned to the dead-letter queue otherwise.
+// It return the number of replayed messages
+func (r *Consumer) ReplayDeadLetters(limit int) (int, error) {
+	replayed := 0
+
+	err := r.withDeadLetters(limit, func(ch deadLetterChannel, deliveries []amqp.Delivery) error {
+		if err := ch.Confirm(false); err != nil {
+			_ = ch.Nack(deliveries[len(deliveries)-1].DeliveryTag, true, true)
+			return fmt.Errorf("failed to put channel into confirm mode: %w", err)
+		}
+
+		// the broker always sends basic.return before the basic.ack of the same message
+		confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+		for _, d := range deliveries {
+			if err := r.replay(ch, d, confirms, returns); err != nil {
+				// requeue this dead letter and the ones not replayed yet
+				_ = ch.Nack(deliveries[len(deliveries)-1].DeliveryTag, true, true)
+				return fmt.Errorf("failed to replay dead letter %s: %w", d.MessageId, err)
+			}
+
+			if err := ch.Ack(d.DeliveryTag, false); err != nil {
+				return fmt.Errorf("failed to ack dead letter: %w", err)
+			}
+			replayed++
+		}
+
+		return nil
+	})
+
+	return replayed, err
+}
+
+// replay publish the dead letter to the consumer queue as mandatory and wait for the broker confirmation
+func (r *Consumer) replay(ch deadLetterChannel, d amqp.Delivery, confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		switch k {
+		case headerDeadLetterReason, headerDeadLetterAttempts, headerDeadLetterError,
+			headerDeadLetterQueue, headerDeadLetterTime,
+			headerAttempts, headerFirstSeen, headerLastError, headerDeliveryCount, headerLegacyAttempts:
+			continue
+		}
+		headers[k] = v
+	}
+
+	err := ch.Publish("", r.handler.Topic, true, false, amqp.Publishing{
+		Headers:       headers,
+		ContentType:   d.ContentType,
+		Body:          d.Body,
+		DeliveryMode:  d.DeliveryMode,
+		CorrelationId: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		MessageId:     d.MessageId,
+		Timestamp:     d.Timestamp,
+		Type:          d.Type,
+		AppId:         d.AppId,
+	})
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(replayConfirmTimeout)
+	defer timer.Stop()
+
+	select {
+	case confirm, ok := <-confirms:
+		if !ok {
+			return fmt.Errorf("channel closed before the publish confirmation")
+		}
+
+		select {
+		case ret := <-returns:
+			return &ReturnError{Return: ret}
+		default:
+		}
+
+		if !confirm.Ack {
+			return ErrPublishNacked
+		}
+
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("publish confirmation not received after %s", replayConfirmTimeout)
+	}
+}
+
+// PurgeDeadLetters remove every message in the dead-letter queue and return how many were removed
+func (r *Consumer) PurgeDeadLetters() (int, error) {
+	ch, err := r.openDeadLetterChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	n, err := ch.QueuePurge(r.DeadLetterQueue(), false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge dead-letter queue: %w", err)
+	}
+
+	return n, nil
+}
+
+// withDeadLetters get up to limit dead letters on a dedicated channel without acknowledging them,
+// anything not acknowledged by fn is returned to the queue when the channel is closed
+func (r *Consumer) withDeadLetters(limit int, fn func(ch deadLetterChannel, deliveries []amqp.Delivery) error) error {
+	ch, err := r.openDeadLetterChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	queue := r.DeadLetterQueue()
+
+	// only look at the messages present now, replayed messages can come back while iterating
+	q, err := ch.QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to inspect dead-letter queue: %w", err)
+	}
+
+	count := q.Messages
+	if limit > 0 && limit < count {
+		count = limit
+	}
+
+	deliveries := make([]amqp.Delivery, 0, count)
+	for i := 0; i < count; i++ {
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return fmt.Errorf("failed to get dead letter: %w", err)
+		}
+		if !ok {
+			break
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	return fn(ch, deliveries)
+}
+
+// openDeadLetterChannel open a channel of the connection for the dead-letter operations unless deadLetterChannel is set
+func (r *Consumer) openDeadLetterChannel() (deadLetterChannel, error) {
+	if r.deadLetterChannel != nil {
+		return r.deadLetterChannel()
+	}
+
+	ch, err := r.openChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+func (r *Consumer) openChannel() (*amqp.Channel, error) {
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, fmt.Errorf("consumer is not connected")
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	return ch, nil
+}
@@ -0,0 +1,286 @@
+package rmqa
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+// fakeDeadLetterChannel keep a dead-letter queue in memory, unacknowledged messages return to it on Nack and Close
+type fakeDeadLetterChannel struct {
+	queue     []amqp.Delivery
+	unacked   map[uint64]amqp.Delivery
+	tag       uint64
+	published []publishRecord
+	mandatory []bool
+
+	// nack and unroutable make the broker refuse the published messages
+	nack       bool
+	unroutable bool
+
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+func newFakeDeadLetterChannel(bodies ...string) *fakeDeadLetterChannel {
+	ch := &fakeDeadLetterChannel{unacked: map[uint64]amqp.Delivery{}}
+	for _, body := range bodies {
+		ch.queue = append(ch.queue, amqp.Delivery{
+			MessageId: body,
+			Body:      []byte(body),
+			Headers: amqp.Table{
+				headerDeadLetterReason:   reasonMaxAttempts,
+				headerDeadLetterAttempts: int32(3),
+				headerAttempts:           int32(3),
+				"x-trace":                "t-" + body,
+			},
+		})
+	}
+
+	return ch
+}
+
+func (c *fakeDeadLetterChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name, Messages: len(c.queue)}, nil
+}
+
+func (c *fakeDeadLetterChannel) QueuePurge(name string, noWait bool) (int, error) {
+	n := len(c.queue)
+	c.queue = nil
+	return n, nil
+}
+
+func (c *fakeDeadLetterChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	if len(c.queue) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	c.tag++
+	d := c.queue[0]
+	d.DeliveryTag = c.tag
+	c.queue = c.queue[1:]
+	c.unacked[d.DeliveryTag] = d
+
+	return d, true, nil
+}
+
+func (c *fakeDeadLetterChannel) Ack(tag uint64, multiple bool) error {
+	delete(c.unacked, tag)
+	return nil
+}
+
+func (c *fakeDeadLetterChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	var tags []uint64
+	for t := range c.unacked {
+		if t == tag || (multiple && t < tag) {
+			tags = append(tags, t)
+		}
+	}
+	c.requeue(tags)
+	return nil
+}
+
+func (c *fakeDeadLetterChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+func (c *fakeDeadLetterChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	c.confirms = confirm
+	return confirm
+}
+
+func (c *fakeDeadLetterChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	c.returns = returns
+	return returns
+}
+
+func (c *fakeDeadLetterChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.published = append(c.published, publishRecord{exchange: exchange, key: key, msg: msg})
+	c.mandatory = append(c.mandatory, mandatory)
+
+	if c.unroutable && mandatory {
+		c.returns <- amqp.Return{RoutingKey: key, MessageId: msg.MessageId}
+	}
+	if c.confirms != nil {
+		c.confirms <- amqp.Confirmation{DeliveryTag: uint64(len(c.published)), Ack: !c.nack}
+	}
+
+	return nil
+}
+
+func (c *fakeDeadLetterChannel) Close() error {
+	var tags []uint64
+	for t := range c.unacked {
+		tags = append(tags, t)
+	}
+	c.requeue(tags)
+	return nil
+}
+
+// requeue put the messages back in front of the queue in their original order
+func (c *fakeDeadLetterChannel) requeue(tags []uint64) {
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	var requeued []amqp.Delivery
+	for _, t := range tags {
+		requeued = append(requeued, c.unacked[t])
+		delete(c.unacked, t)
+	}
+	c.queue = append(requeued, c.queue...)
+}
+
+func (c *fakeDeadLetterChannel) queued() []string {
+	var bodies []string
+	for _, d := range c.queue {
+		bodies = append(bodies, string(d.Body))
+	}
+	return bodies
+}
+
+func newDeadLetterConsumer(ch *fakeDeadLetterChannel) *Consumer {
+	c := NewConsumer(adapter.ConsumerHandler{Topic: "orders"})
+	c.deadLetterChannel = func() (deadLetterChannel, error) {
+		return ch, nil
+	}
+
+	return c
+}
+
+func TestConsumer_ListDeadLetters(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		want  []string
+	}{
+		{name: "Test list all dead letters", limit: 0, want: []string{"a", "b", "c"}},
+		{name: "Test list up to the limit", limit: 2, want: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := newFakeDeadLetterChannel("a", "b", "c")
+
+			got, err := newDeadLetterConsumer(ch).ListDeadLetters(tt.limit)
+			if err != nil {
+				t.Fatalf("ListDeadLetters() error = %v", err)
+			}
+
+			var bodies []string
+			for _, dl := range got {
+				bodies = append(bodies, string(dl.Body))
+				if dl.Reason != reasonMaxAttempts || dl.Attempts != 3 {
+					t.Errorf("ListDeadLetters() reason, attempts = %s, %d, want %s, 3", dl.Reason, dl.Attempts, reasonMaxAttempts)
+				}
+			}
+			if fmt.Sprint(bodies) != fmt.Sprint(tt.want) {
+				t.Errorf("ListDeadLetters() = %v, want %v", bodies, tt.want)
+			}
+			if fmt.Sprint(ch.queued()) != "[a b c]" {
+				t.Errorf("queue after ListDeadLetters() = %v, want [a b c]", ch.queued())
+			}
+		})
+	}
+}
+
+func TestConsumer_ReplayDeadLetters(t *testing.T) {
+	tests := []struct {
+		name         string
+		limit        int
+		nack         bool
+		unroutable   bool
+		want         int
+		wantErr      error
+		wantQueued   []string
+		wantReplayed []string
+	}{
+		{
+			name:         "Test replay all dead letters",
+			want:         3,
+			wantReplayed: []string{"a", "b", "c"},
+		}, {
+			name:         "Test replay up to the limit",
+			limit:        1,
+			want:         1,
+			wantQueued:   []string{"b", "c"},
+			wantReplayed: []string{"a"},
+		}, {
+			name:         "Test dead letter kept when the broker nacked its copy",
+			nack:         true,
+			wantErr:      ErrPublishNacked,
+			wantQueued:   []string{"a", "b", "c"},
+			wantReplayed: []string{"a"},
+		}, {
+			name:         "Test dead letter kept when its copy can't be routed",
+			unroutable:   true,
+			wantErr:      &ReturnError{},
+			wantQueued:   []string{"a", "b", "c"},
+			wantReplayed: []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := newFakeDeadLetterChannel("a", "b", "c")
+			ch.nack = tt.nack
+			ch.unroutable = tt.unroutable
+
+			got, err := newDeadLetterConsumer(ch).ReplayDeadLetters(tt.limit)
+
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("ReplayDeadLetters() error = %v", err)
+				}
+			case *ReturnError:
+				if !errors.As(err, &want) {
+					t.Errorf("ReplayDeadLetters() error = %v, want *ReturnError", err)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Errorf("ReplayDeadLetters() error = %v, want %v", err, want)
+				}
+			}
+
+			if got != tt.want {
+				t.Errorf("ReplayDeadLetters() = %d, want %d", got, tt.want)
+			}
+			if fmt.Sprint(ch.queued()) != fmt.Sprint(tt.wantQueued) {
+				t.Errorf("queue after ReplayDeadLetters() = %v, want %v", ch.queued(), tt.wantQueued)
+			}
+
+			var replayed []string
+			for i, p := range ch.published {
+				replayed = append(replayed, string(p.msg.Body))
+				if p.key != "orders" || !ch.mandatory[i] {
+					t.Errorf("ReplayDeadLetters() published to %q mandatory %v, want orders mandatory", p.key, ch.mandatory[i])
+				}
+				if _, ok := p.msg.Headers[headerAttempts]; ok {
+					t.Error("ReplayDeadLetters() kept the attempts header")
+				}
+				if _, ok := p.msg.Headers[headerDeadLetterReason]; ok {
+					t.Error("ReplayDeadLetters() kept the dead letter reason header")
+				}
+				if p.msg.Headers["x-trace"] == nil {
+					t.Error("ReplayDeadLetters() dropped the message headers")
+				}
+			}
+			if fmt.Sprint(replayed) != fmt.Sprint(tt.wantReplayed) {
+				t.Errorf("ReplayDeadLetters() published %v, want %v", replayed, tt.wantReplayed)
+			}
+		})
+	}
+}
+
+func TestConsumer_PurgeDeadLetters(t *testing.T) {
+	ch := newFakeDeadLetterChannel("a", "b")
+
+	got, err := newDeadLetterConsumer(ch).PurgeDeadLetters()
+	if err != nil || got != 2 {
+		t.Errorf("PurgeDeadLetters() = %d, %v, want 2, nil", got, err)
+	}
+	if len(ch.queue) != 0 {
+		t.Errorf("queue after PurgeDeadLetters() = %v, want empty", ch.queued())
+	}
+}
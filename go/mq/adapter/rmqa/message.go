@@ -1,78 +1,234 @@
 package rmqa
 
 import (
+	"context"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/reyhanfahlevi/pkg/go/log"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/reyhanfahlevi/pkg/go/mq/metrics"
 )
 
+const (
+	// headerAttempts carry the attempts made before the message was republished
+	headerAttempts  = "x-mq-attempts"
+	headerFirstSeen = "x-mq-first-seen"
+	headerLastError = "x-mq-last-error"
+
+	// headerDeliveryCount is set by quorum queues on every redelivery of the same message
+	headerDeliveryCount = "x-delivery-count"
+	// headerLegacyAttempts is the attempts header of the messages republished by older consumers
+	headerLegacyAttempts = "attempts"
+
+	// maxLastErrorLength keep the error header small, it is copied on every republish
+	maxLastErrorLength = 512
+
+	// republishConfirmTimeout is the maximum time to wait for the broker confirmation of a copy of the message
+	republishConfirmTimeout = 5 * time.Second
+)
+
+// confirmPublisher publish on the consumer channel in confirm mode and wait for the broker confirmation, *confirmChannel
+type confirmPublisher interface {
+	publish(ctx context.Context, exchange, key string, mandatory bool, msgs ...amqp.Publishing) error
+}
+
 type Message struct {
 	amqp.Delivery
-	ch          *amqp.Channel
-	topic       string
-	attempts    int32
-	maxAttempts int32
-	requeued    bool
+	confirms        confirmPublisher
+	topic           string
+	deadLetterQueue string
+	delayedExchange string
+	delayTiers      adapter.DelayTiers
+	maxAttempts     int32
+	counters        *metrics.Counters
+
+	attempts  int32
+	firstSeen time.Time
+	lastError string
+
+	// handleErr is the error of the current attempt, it becomes the last error of the next one
+	handleErr error
+
+	mu      sync.Mutex
+	settled bool
 }
 
+// Finish acknowledge the message
 func (m *Message) Finish() {
-	m.Ack(false)
+	m.settle(func() {
+		m.Ack(false)
+	})
 }
 
+// RequeueWithoutBackoff republish the message to be delivered again after the delay
 func (m *Message) RequeueWithoutBackoff(delay time.Duration) {
-	_ = m.republish(m.topic)
-	m.Nack(false, false)
-	m.requeued = true
+	m.settle(func() {
+		m.requeue(delay)
+	})
 }
 
+// newMessage read the attempt accounting of the delivery once, the delivery headers are never modified
+func newMessage(delivery amqp.Delivery) *Message {
+	m := &Message{
+		Delivery: delivery,
+		attempts: attemptsOf(delivery),
+	}
+
+	m.firstSeen, _ = delivery.Headers[headerFirstSeen].(time.Time)
+	if m.firstSeen.IsZero() {
+		m.firstSeen = time.Now()
+	}
+	m.lastError, _ = delivery.Headers[headerLastError].(string)
+
+	return m
+}
+
+// attemptsOf return the attempts of the delivery including this one: the attempts made before the message was
+// republished, plus the redeliveries of the same message counted by quorum queues in x-delivery-count.
+// Classic queues only flag a redelivery, it is counted once
+func attemptsOf(delivery amqp.Delivery) int32 {
+	previous, ok := toInt32(delivery.Headers[headerAttempts])
+	if !ok {
+		previous, _ = toInt32(delivery.Headers[headerLegacyAttempts])
+	}
+
+	redeliveries, ok := toInt32(delivery.Headers[headerDeliveryCount])
+	if !ok && delivery.Redelivered {
+		redeliveries = 1
+	}
+
+	return previous + redeliveries + 1
+}
+
+func toInt32(v interface{}) (int32, bool) {
+	switch v := v.(type) {
+	case int8:
+		return int32(v), true
+	case uint8:
+		return int32(v), true
+	case int16:
+		return int32(v), true
+	case uint16:
+		return int32(v), true
+	case int32:
+		return v, true
+	case uint32:
+		return int32(v), true
+	case int64:
+		return int32(v), true
+	case int:
+		return int32(v), true
+	default:
+		return 0, false
+	}
+}
+
+// GetAttempts return number of how many this message enter the consumer, including this delivery
 func (m *Message) GetAttempts() int32 {
-	if m.Headers == nil {
-		m.Headers = make(amqp.Table)
-		m.Headers["attempts"] = int32(0)
-		return 0
-	}
-
-	if attempts, ok := m.Headers["attempts"]; ok {
-		switch v := attempts.(type) {
-		case int32:
-			return v
-		case int64:
-			return int32(v)
-		case int:
-			return int32(v)
-		default:
-			return 0
+	return m.attempts
+}
+
+// GetFirstSeen return when a consumer received the message for the first time
+func (m *Message) GetFirstSeen() time.Time {
+	return m.firstSeen
+}
+
+// GetLastError return the error of the previous attempt
+func (m *Message) GetLastError() string {
+	return m.lastError
+}
+
+// Requeue republish the message to be delivered again after the delay,
+// or move it to the dead-letter queue when the max attempts is reached
+func (m *Message) Requeue(delay time.Duration) {
+	m.settle(func() {
+		if m.attempts >= m.maxAttempts {
+			m.deadLetter(reasonMaxAttempts)
+			return
 		}
+
+		m.requeue(delay)
+	})
+}
+
+// abandon nack the message for immediate redelivery when it is not settled yet,
+// later responses of the handler are ignored
+func (m *Message) abandon() bool {
+	return m.settle(func() {
+		m.Nack(false, true)
+	})
+}
+
+// settle run fn only for the first response to the delivery,
+// a delivery can't be acknowledged twice without closing the channel
+func (m *Message) settle(fn func()) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.settled {
+		return false
 	}
+	m.settled = true
 
-	return 0
+	fn()
+	return true
 }
 
-func (m *Message) Requeue(delay time.Duration) {
-	attempts := m.GetAttempts()
-	if attempts >= m.maxAttempts {
-		m.Reject(false)
+func (m *Message) isSettled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.settled
+}
+
+// requeue acknowledge the delivery only once the broker confirmed the delayed copy,
+// when publishing fails, is nacked or can't be routed the broker redeliver the original immediately instead of losing it
+func (m *Message) requeue(delay time.Duration) {
+	m.counters.Requeued()
+
+	if err := m.republishWithDelay(delay); err != nil {
+		log.Error(errors.Wrapf(err, "failed to requeue message %s of %s", m.MessageId, m.topic))
+		m.Nack(false, true)
 		return
 	}
 
-	_ = m.republish(m.topic)
-	m.Nack(false, false)
-	m.requeued = true
+	m.Ack(false)
 }
 
-func (m *Message) republish(queueName string) error {
+// republishWithDelay publish the message through the delayed-message exchange when configured,
+// otherwise through the ttl wait queue of the delay tier, declared by the consumer setup, dead-lettering back to the topic queue.
+// The delayed-message exchange routes the message only once the delay expired, so it can't be mandatory
+func (m *Message) republishWithDelay(delay time.Duration) error {
+	switch {
+	case delay <= 0:
+		return m.republish("", m.topic, true, nil)
+	case m.delayedExchange != "":
+		return m.republish(m.delayedExchange, m.topic, false, amqp.Table{"x-delay": delay.Milliseconds()})
+	}
 
-	// Modify headers
-	newHeaders := m.Headers
-	newHeaders["attempts"] = m.GetAttempts()
+	tier := m.delayTiers.Round(delay)
+	if tier <= 0 {
+		return m.republish("", m.topic, true, nil)
+	}
 
-	return m.ch.Publish(
-		"",
-		queueName,
-		false,
-		false,
+	return m.republish("", waitQueueName("", m.topic, tier), true, nil)
+}
+
+// republish publish a copy of the message and wait for the broker confirmation
+func (m *Message) republish(exchange, key string, mandatory bool, extraHeaders amqp.Table) error {
+	ctx, cancel := context.WithTimeout(context.Background(), republishConfirmTimeout)
+	defer cancel()
+
+	return m.confirms.publish(
+		ctx,
+		exchange,
+		key,
+		mandatory,
 		amqp.Publishing{
-			Headers:       newHeaders,
+			Headers:       m.republishHeaders(extraHeaders),
 			ContentType:   m.ContentType,
 			Body:          m.Body,
 			DeliveryMode:  m.DeliveryMode,
@@ -86,12 +242,130 @@ func (m *Message) republish(queueName string) error {
 	)
 }
 
-func (m *Message) increaseAttempts() {
-	attempts := m.GetAttempts()
-	m.attempts = attempts + 1
-	m.Headers["attempts"] = m.attempts
+// republishHeaders copy the delivery headers with the attempt accounting of this attempt,
+// x-delivery-count is dropped since the broker counts the redeliveries of the new message from zero
+func (m *Message) republishHeaders(extraHeaders amqp.Table) amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range m.Headers {
+		switch k {
+		case headerDeliveryCount, headerLegacyAttempts:
+			continue
+		}
+		headers[k] = v
+	}
+
+	headers[headerAttempts] = m.attempts
+	headers[headerFirstSeen] = m.firstSeen
+	if m.handleErr != nil {
+		lastError := m.handleErr.Error()
+		if len(lastError) > maxLastErrorLength {
+			lastError = lastError[:maxLastErrorLength]
+		}
+		headers[headerLastError] = lastError
+	}
+
+	for k, v := range extraHeaders {
+		headers[k] = v
+	}
+
+	return headers
+}
+
+// deadLetter move the message into the dead-letter queue with the failure information in the headers,
+// the message is rejected when no dead-letter queue is configured. The delivery is acknowledged only once
+// the broker confirmed the copy was routed to the dead-letter queue, it is redelivered otherwise
+func (m *Message) deadLetter(reason string) {
+	m.counters.DeadLettered()
+
+	if m.deadLetterQueue == "" {
+		m.Reject(false)
+		return
+	}
+
+	headers := amqp.Table{}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers[headerDeadLetterReason] = reason
+	headers[headerDeadLetterAttempts] = m.attempts
+	headers[headerDeadLetterQueue] = m.topic
+	headers[headerDeadLetterTime] = time.Now()
+	if m.handleErr != nil {
+		headers[headerDeadLetterError] = m.handleErr.Error()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), republishConfirmTimeout)
+	defer cancel()
+
+	err := m.confirms.publish(
+		ctx,
+		"",
+		m.deadLetterQueue,
+		true,
+		amqp.Publishing{
+			Headers:       headers,
+			ContentType:   m.ContentType,
+			Body:          m.Body,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: m.CorrelationId,
+			ReplyTo:       m.ReplyTo,
+			MessageId:     m.MessageId,
+			Timestamp:     m.Timestamp,
+			Type:          m.Type,
+			AppId:         m.AppId,
+		},
+	)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "failed to dead-letter message %s of %s", m.MessageId, m.topic))
+		m.Nack(false, true)
+		return
+	}
+
+	m.Ack(false)
 }
 
 func (m *Message) GetBody() []byte {
 	return m.Body
 }
+
+// GetID return the AMQP message id
+func (m *Message) GetID() string {
+	return m.MessageId
+}
+
+// GetHeaders return a copy of the AMQP headers
+func (m *Message) GetHeaders() map[string]interface{} {
+	if m.Headers == nil {
+		return nil
+	}
+
+	headers := make(map[string]interface{}, len(m.Headers))
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+
+	return headers
+}
+
+// GetCorrelationID return the AMQP correlation id
+func (m *Message) GetCorrelationID() string {
+	return m.CorrelationId
+}
+
+// GetReplyTo return the queue the rpc reply is published to
+func (m *Message) GetReplyTo() string {
+	return m.ReplyTo
+}
+
+// GetTimestamp return the AMQP timestamp
+func (m *Message) GetTimestamp() time.Time {
+	return m.Timestamp
+}
+
+// GetContentType return the AMQP content type
+func (m *Message) GetContentType() string {
+	return m.ContentType
+}
+
+// Touch does nothing, an unacknowledged AMQP delivery has no lease
+func (m *Message) Touch() {}
@@ -0,0 +1,331 @@
+package rmqa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+func TestAttemptsOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery amqp.Delivery
+		want     int32
+	}{
+		{
+			name:     "Test first delivery without headers",
+			delivery: amqp.Delivery{},
+			want:     1,
+		}, {
+			name:     "Test redelivery of a classic queue",
+			delivery: amqp.Delivery{Redelivered: true},
+			want:     2,
+		}, {
+			name:     "Test redelivery count of a quorum queue",
+			delivery: amqp.Delivery{Redelivered: true, Headers: amqp.Table{headerDeliveryCount: int64(2)}},
+			want:     3,
+		}, {
+			name:     "Test republished message",
+			delivery: amqp.Delivery{Headers: amqp.Table{headerAttempts: int32(2)}},
+			want:     3,
+		}, {
+			name:     "Test redelivery of a republished message",
+			delivery: amqp.Delivery{Redelivered: true, Headers: amqp.Table{headerAttempts: int32(2), headerDeliveryCount: int64(1)}},
+			want:     4,
+		}, {
+			name:     "Test message republished by an older consumer",
+			delivery: amqp.Delivery{Headers: amqp.Table{headerLegacyAttempts: int64(4)}},
+			want:     5,
+		}, {
+			name:     "Test invalid header",
+			delivery: amqp.Delivery{Headers: amqp.Table{headerAttempts: "2"}},
+			want:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := attemptsOf(tt.delivery); got != tt.want {
+				t.Errorf("attemptsOf() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessage_republishHeaders(t *testing.T) {
+	// a quorum queue delivered the message twice, then the handler failed and the message is republished
+	delivery := amqp.Delivery{
+		Redelivered: true,
+		Headers: amqp.Table{
+			"trace":              "abc",
+			headerDeliveryCount:  int64(1),
+			headerLegacyAttempts: int32(1),
+		},
+	}
+
+	msg := newMessage(delivery)
+	msg.handleErr = errors.New("boom")
+
+	if msg.GetAttempts() != 3 {
+		t.Fatalf("GetAttempts() = %d, want 3", msg.GetAttempts())
+	}
+	if msg.GetLastError() != "" {
+		t.Errorf("GetLastError() = %q, want empty", msg.GetLastError())
+	}
+
+	headers := msg.republishHeaders(amqp.Table{"x-delay": int64(1000)})
+	if len(delivery.Headers) != 3 {
+		t.Errorf("delivery headers modified: %v", delivery.Headers)
+	}
+
+	// the broker deliver the republished message as a new one
+	next := newMessage(amqp.Delivery{Headers: headers})
+	if next.GetAttempts() != 4 {
+		t.Errorf("next GetAttempts() = %d, want 4", next.GetAttempts())
+	}
+	if next.GetLastError() != "boom" {
+		t.Errorf("next GetLastError() = %q, want boom", next.GetLastError())
+	}
+	if !next.GetFirstSeen().Equal(msg.GetFirstSeen()) {
+		t.Errorf("next GetFirstSeen() = %v, want %v", next.GetFirstSeen(), msg.GetFirstSeen())
+	}
+	if headers["trace"] != "abc" || headers["x-delay"] != int64(1000) {
+		t.Errorf("republish headers = %v, want trace and x-delay kept", headers)
+	}
+	if _, ok := headers[headerDeliveryCount]; ok {
+		t.Errorf("republish headers kept %s", headerDeliveryCount)
+	}
+}
+
+func TestMessage_republishHeadersLastError(t *testing.T) {
+	msg := newMessage(amqp.Delivery{Headers: amqp.Table{
+		headerLastError: "previous",
+		headerFirstSeen: time.Unix(100, 0),
+	}})
+
+	if !msg.GetFirstSeen().Equal(time.Unix(100, 0)) {
+		t.Errorf("GetFirstSeen() = %v, want %v", msg.GetFirstSeen(), time.Unix(100, 0))
+	}
+
+	// requeued by the handler without an error, the last error is kept
+	if got := msg.republishHeaders(nil)[headerLastError]; got != "previous" {
+		t.Errorf("last error = %v, want previous", got)
+	}
+
+	msg.handleErr = errors.New(strings.Repeat("x", maxLastErrorLength+10))
+	if got := msg.republishHeaders(nil)[headerLastError].(string); len(got) != maxLastErrorLength {
+		t.Errorf("last error length = %d, want %d", len(got), maxLastErrorLength)
+	}
+}
+
+type publishRecord struct {
+	exchange  string
+	key       string
+	mandatory bool
+	msg       amqp.Publishing
+}
+
+type channelRecorder struct {
+	err       error
+	published []publishRecord
+}
+
+func (c *channelRecorder) publish(ctx context.Context, exchange, key string, mandatory bool, msgs ...amqp.Publishing) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	for _, msg := range msgs {
+		c.published = append(c.published, publishRecord{exchange: exchange, key: key, mandatory: mandatory, msg: msg})
+	}
+	return nil
+}
+
+func TestMessage_Requeue(t *testing.T) {
+	tests := []struct {
+		name            string
+		delay           time.Duration
+		delayedExchange string
+		publishErr      error
+		wantExchange    string
+		wantKey         string
+		wantMandatory   bool
+		wantDelay       interface{}
+		wantAcks        []string
+		wantNack        bool
+	}{
+		{
+			name:          "Test requeue without delay",
+			delay:         0,
+			wantKey:       "orders",
+			wantMandatory: true,
+			wantAcks:      []string{"7/false"},
+		}, {
+			name:          "Test delay rounded up to the wait queue of the tier",
+			delay:         1200 * time.Millisecond,
+			wantKey:       "orders.wait.5000",
+			wantMandatory: true,
+			wantAcks:      []string{"7/false"},
+		}, {
+			name:          "Test delay beyond the longest tier",
+			delay:         time.Hour,
+			wantKey:       "orders.wait.600000",
+			wantMandatory: true,
+			wantAcks:      []string{"7/false"},
+		}, {
+			name:            "Test exact delay through the delayed exchange",
+			delay:           1200 * time.Millisecond,
+			delayedExchange: "orders.delayed",
+			wantExchange:    "orders.delayed",
+			wantKey:         "orders",
+			wantDelay:       int64(1200),
+			wantAcks:        []string{"7/false"},
+		}, {
+			name:       "Test nacked for redelivery when the republish failed",
+			delay:      time.Second,
+			publishErr: errors.New("channel closed"),
+			wantNack:   true,
+		}, {
+			name:       "Test nacked for redelivery when the broker nacked the copy",
+			delay:      time.Second,
+			publishErr: ErrPublishNacked,
+			wantNack:   true,
+		}, {
+			name:       "Test nacked for redelivery when the wait queue is missing",
+			delay:      time.Second,
+			publishErr: &ReturnError{Return: amqp.Return{ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE"}},
+			wantNack:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := &ackRecorder{}
+			ch := &channelRecorder{err: tt.publishErr}
+
+			m := newMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 7, Body: []byte("1")})
+			m.confirms = ch
+			m.topic = "orders"
+			m.maxAttempts = 3
+			m.delayedExchange = tt.delayedExchange
+			m.delayTiers = adapter.DefaultDelayTiers
+
+			m.Requeue(tt.delay)
+
+			if ack.nacked != tt.wantNack {
+				t.Errorf("Requeue() nacked = %v, want %v", ack.nacked, tt.wantNack)
+			}
+			if fmt.Sprint(ack.acks) != fmt.Sprint(tt.wantAcks) {
+				t.Errorf("Requeue() acks = %v, want %v", ack.acks, tt.wantAcks)
+			}
+			if tt.publishErr != nil {
+				return
+			}
+
+			if len(ch.published) != 1 {
+				t.Fatalf("Requeue() published = %d, want 1", len(ch.published))
+			}
+
+			got := ch.published[0]
+			if got.exchange != tt.wantExchange || got.key != tt.wantKey {
+				t.Errorf("Requeue() published to %q %q, want %q %q", got.exchange, got.key, tt.wantExchange, tt.wantKey)
+			}
+			if got.mandatory != tt.wantMandatory {
+				t.Errorf("Requeue() mandatory = %v, want %v", got.mandatory, tt.wantMandatory)
+			}
+			if got.msg.Headers["x-delay"] != tt.wantDelay {
+				t.Errorf("Requeue() x-delay = %v, want %v", got.msg.Headers["x-delay"], tt.wantDelay)
+			}
+			if got.msg.Headers[headerAttempts] != int32(1) {
+				t.Errorf("Requeue() attempts header = %v, want 1", got.msg.Headers[headerAttempts])
+			}
+		})
+	}
+}
+
+func TestMessage_RequeueMaxAttempts(t *testing.T) {
+	ack := &ackRecorder{}
+	ch := &channelRecorder{}
+
+	m := newMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 7, Headers: amqp.Table{headerAttempts: int32(2)}})
+	m.confirms = ch
+	m.topic = "orders"
+	m.deadLetterQueue = "orders.dlq"
+	m.maxAttempts = 3
+
+	m.Requeue(time.Second)
+
+	if len(ch.published) != 1 || ch.published[0].key != "orders.dlq" {
+		t.Fatalf("Requeue() published = %v, want the dead-letter queue", ch.published)
+	}
+	if ch.published[0].msg.Headers[headerDeadLetterReason] != reasonMaxAttempts {
+		t.Errorf("Requeue() dead letter reason = %v, want %s", ch.published[0].msg.Headers[headerDeadLetterReason], reasonMaxAttempts)
+	}
+}
+
+func TestWaitQueueName(t *testing.T) {
+	if got := waitQueueName("", "orders", 5*time.Second); got != "orders.wait.5000" {
+		t.Errorf("waitQueueName() = %q, want orders.wait.5000", got)
+	}
+	if got := waitQueueName("events", "orders", time.Second); got != "events.orders.wait.1000" {
+		t.Errorf("waitQueueName() = %q, want events.orders.wait.1000", got)
+	}
+}
+
+func TestMessage_deadLetter(t *testing.T) {
+	tests := []struct {
+		name       string
+		publishErr error
+		wantAcks   []string
+		wantNack   bool
+	}{
+		{
+			name:     "Test acknowledged once the dead letter is confirmed",
+			wantAcks: []string{"7/false"},
+		}, {
+			name:       "Test redelivered when publishing failed",
+			publishErr: errors.New("channel closed"),
+			wantNack:   true,
+		}, {
+			name:       "Test redelivered when the broker nacked the dead letter",
+			publishErr: ErrPublishNacked,
+			wantNack:   true,
+		}, {
+			name:       "Test redelivered when the dead-letter queue is missing",
+			publishErr: &ReturnError{Return: amqp.Return{ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE"}},
+			wantNack:   true,
+		}, {
+			name:       "Test redelivered when the confirmation timed out",
+			publishErr: context.DeadlineExceeded,
+			wantNack:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := &ackRecorder{}
+			ch := &channelRecorder{err: tt.publishErr}
+
+			m := newMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 7})
+			m.confirms = ch
+			m.topic = "orders"
+			m.deadLetterQueue = "orders.dlq"
+
+			m.deadLetter(reasonPermanent)
+
+			if ack.nacked != tt.wantNack || len(ack.rejects) != 0 || fmt.Sprint(ack.acks) != fmt.Sprint(tt.wantAcks) {
+				t.Errorf("deadLetter() nacked, rejects, acks = %v, %v, %v, want %v, [], %v", ack.nacked, ack.rejects, ack.acks, tt.wantNack, tt.wantAcks)
+			}
+			if tt.publishErr != nil {
+				return
+			}
+
+			if len(ch.published) != 1 || ch.published[0].key != "orders.dlq" || !ch.published[0].mandatory {
+				t.Errorf("deadLetter() published = %v, want a mandatory publish to orders.dlq", ch.published)
+			}
+		})
+	}
+}
@@ -1 +1,538 @@
 package rmqa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/reyhanfahlevi/pkg/go/log"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/reyhanfahlevi/pkg/go/token"
+	"github.com/reyhanfahlevi/pkg/go/tracer/nr"
+)
+
+var (
+	// ErrPublisherClosed returned when publishing through a closed publisher
+	ErrPublisherClosed = errors.New("publisher is closed")
+
+	// ErrPublishNacked returned when the broker refuse to take responsibility of the message
+	ErrPublishNacked = errors.New("message was nacked by the broker")
+)
+
+// ReturnError returned when a mandatory message can't be routed to any queue
+type ReturnError struct {
+	Return amqp.Return
+}
+
+func (e *ReturnError) Error() string {
+	return fmt.Sprintf("message returned by the broker: %d %s (exchange: %q, routing key: %q)",
+		e.Return.ReplyCode, e.Return.ReplyText, e.Return.Exchange, e.Return.RoutingKey)
+}
+
+// Publisher publish message to RabbitMQ using a pool of channels in confirm mode
+type Publisher struct {
+	conn         *amqp.Connection
+	mu           sync.Mutex
+	connected    bool
+	notifyClose  chan *amqp.Error
+	shutdown     chan struct{}
+	closed       bool
+	reconnecting bool
+
+	// pool is replaced on every reconnect, ready is closed once the pool is usable
+	pool  chan *confirmChannel
+	ready chan struct{}
+
+	// newChannel replace the channel opened for a closed pooled channel, nil means a channel of the connection
+	newChannel func() (*confirmChannel, error)
+
+	// waitQueues are the wait queues declared on the current connection
+	waitQueues map[string]bool
+	delayTiers adapter.DelayTiers
+
+	config         PublisherConfig
+	confirmTimeout time.Duration
+
+	// reconnectDelay is doubled after every failed reconnect up to maxReconnectDelay
+	reconnectDelay    time.Duration
+	maxReconnectDelay time.Duration
+}
+
+// PublisherConfig config for the publisher instance
+type PublisherConfig struct {
+	URL string `json:"url"`
+
+	// Exchange used by Publish and PublishJSON, empty means the default exchange
+	Exchange string `json:"exchange,omitempty"`
+
+	// PoolSize is the number of channels that can publish concurrently, default: 4
+	PoolSize int `json:"pool_size,omitempty"`
+
+	// ConfirmTimeout is the maximum milliseconds to wait for the broker confirmation, default: 5000
+	ConfirmTimeout int64 `json:"confirm_timeout,omitempty"`
+
+	// Mandatory will make the publish fail with ReturnError when the message can't be routed
+	Mandatory bool `json:"mandatory,omitempty"`
+
+	// Transient will publish the message without persisting it on the broker
+	Transient bool `json:"transient,omitempty"`
+
+	// DelayTiers in milliseconds, PublishWithDelay round the delay up to the next tier, capped at the longest one.
+	// default: 1s, 5s, 30s, 1m, 5m and 10m
+	DelayTiers []int64 `json:"delay_tiers,omitempty"`
+}
+
+// PublisherOptions option to modify the publisher
+type PublisherOptions func(*Publisher)
+
+// NewPublisher will instantiate the rabbitmq publisher,
+// call Connect before publishing any message
+func NewPublisher(cfg PublisherConfig, opt ...PublisherOptions) *Publisher {
+	if cfg.PoolSize < 1 {
+		cfg.PoolSize = 4
+	}
+
+	if cfg.ConfirmTimeout <= 0 {
+		cfg.ConfirmTimeout = 5000
+	}
+
+	p := &Publisher{
+		shutdown:          make(chan struct{}),
+		ready:             make(chan struct{}),
+		config:            cfg,
+		confirmTimeout:    time.Duration(cfg.ConfirmTimeout) * time.Millisecond,
+		reconnectDelay:    time.Second,
+		maxReconnectDelay: 30 * time.Second,
+	}
+
+	for _, opt := range opt {
+		opt(p)
+	}
+
+	return p
+}
+
+// Connect will dial the broker, prepare the channel pool and keep reconnecting when the connection lost
+func (p *Publisher) Connect() error {
+	delayTiers, err := adapter.ParseDelayTiers(p.config.DelayTiers)
+	if err != nil {
+		return fmt.Errorf("invalid publisher config: %w", err)
+	}
+
+	p.mu.Lock()
+	p.delayTiers = delayTiers
+	p.mu.Unlock()
+
+	if err := p.connect(); err != nil {
+		return err
+	}
+
+	go p.reconnectLoop()
+
+	return nil
+}
+
+func (p *Publisher) connect() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrPublisherClosed
+	}
+
+	if p.connected {
+		return nil
+	}
+
+	conn, err := amqp.Dial(p.config.URL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+
+	pool := make(chan *confirmChannel, p.config.PoolSize)
+	for i := 0; i < p.config.PoolSize; i++ {
+		pc, err := openConfirmChannel(conn)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		pool <- pc
+	}
+
+	p.conn = conn
+	p.pool = pool
+	p.waitQueues = map[string]bool{}
+	p.connected = true
+	p.notifyClose = make(chan *amqp.Error, 1)
+	p.conn.NotifyClose(p.notifyClose)
+	close(p.ready)
+
+	return nil
+}
+
+func (p *Publisher) reconnectLoop() {
+	for {
+		p.mu.Lock()
+		notifyClose := p.notifyClose
+		p.mu.Unlock()
+
+		select {
+		case <-p.shutdown:
+			return
+		case err := <-notifyClose:
+			if err == nil {
+				// closed gracefully via Close
+				return
+			}
+			log.Error(fmt.Errorf("publisher connection closed: %w", err))
+			p.reconnect()
+		}
+	}
+}
+
+func (p *Publisher) reconnect() {
+	p.mu.Lock()
+	if p.reconnecting {
+		p.mu.Unlock()
+		return
+	}
+	p.reconnecting = true
+	p.connected = false
+	p.pool = nil
+	p.ready = make(chan struct{})
+	p.mu.Unlock()
+
+	backoff := p.reconnectDelay
+	maxBackoff := p.maxReconnectDelay
+
+	for {
+		select {
+		case <-p.shutdown:
+			return
+		default:
+			time.Sleep(backoff)
+
+			if err := p.connect(); err != nil {
+				backoff *= 2
+				if backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+
+			p.mu.Lock()
+			p.reconnecting = false
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// acquire borrow a channel from the pool, waiting for reconnection when needed
+func (p *Publisher) acquire(ctx context.Context) (*confirmChannel, chan *confirmChannel, error) {
+	for {
+		p.mu.Lock()
+		pool, ready, closed := p.pool, p.ready, p.closed
+		p.mu.Unlock()
+
+		if closed {
+			return nil, nil, ErrPublisherClosed
+		}
+
+		if pool == nil {
+			select {
+			case <-ready:
+				continue
+			case <-p.shutdown:
+				return nil, nil, ErrPublisherClosed
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+
+		select {
+		case pc := <-pool:
+			if pc.ch.IsClosed() {
+				// the channel was closed by a channel exception, replace it
+				fresh, err := p.reopen()
+				if err != nil {
+					pool <- pc
+					return nil, nil, err
+				}
+				pc = fresh
+			}
+			return pc, pool, nil
+		case <-p.shutdown:
+			return nil, nil, ErrPublisherClosed
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func (p *Publisher) reopen() (*confirmChannel, error) {
+	if p.newChannel != nil {
+		return p.newChannel()
+	}
+
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, fmt.Errorf("publisher is not connected")
+	}
+
+	return openConfirmChannel(conn)
+}
+
+// Publish will publish the body to the topic through the configured exchange,
+// on the default exchange the topic is the queue name
+func (p *Publisher) Publish(ctx context.Context, topic string, body []byte) error {
+	return p.PublishRaw(ctx, p.config.Exchange, topic, amqp.Publishing{
+		ContentType: contentType(ctx),
+		Body:        body,
+	})
+}
+
+// contentType return the content type set by adapter.WithContentType, default: application/octet-stream
+func contentType(ctx context.Context) string {
+	if contentType := adapter.ContentTypeFromContext(ctx); contentType != "" {
+		return contentType
+	}
+
+	return "application/octet-stream"
+}
+
+// PublishJSON will publish the data using json format
+func (p *Publisher) PublishJSON(ctx context.Context, topic string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return p.PublishRaw(ctx, p.config.Exchange, topic, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        payload,
+	})
+}
+
+// PublishRaw will publish the message to the exchange with the routing key and wait for the broker confirmation.
+// Message id, timestamp and delivery mode are filled when empty
+func (p *Publisher) PublishRaw(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	if err := p.prepare(ctx, &msg); err != nil {
+		return err
+	}
+
+	return p.withChannel(ctx, func(ctx context.Context, pc *confirmChannel) error {
+		return pc.publish(ctx, exchange, key, p.config.Mandatory, msg)
+	})
+}
+
+// PublishWithDelay will publish the body to the topic after the delay rounded up to the next delay tier.
+// The message waits in the "<topic>.wait.<ms>" queue of the tier until its ttl expired
+// and then dead-lettered back to the configured exchange with the topic as routing key
+func (p *Publisher) PublishWithDelay(ctx context.Context, topic string, body []byte, delay time.Duration) error {
+	if delay <= 0 {
+		return p.Publish(ctx, topic, body)
+	}
+
+	msg := amqp.Publishing{
+		ContentType: contentType(ctx),
+		Body:        body,
+	}
+	if err := p.prepare(ctx, &msg); err != nil {
+		return err
+	}
+
+	return p.withChannel(ctx, func(ctx context.Context, pc *confirmChannel) error {
+		queue, err := p.waitQueue(topic, p.delayTiers.Round(delay))
+		if err != nil {
+			return err
+		}
+
+		return pc.publish(ctx, "", queue, p.config.Mandatory, msg)
+	})
+}
+
+// waitQueue declare the wait queue of the tier once per connection, on its own channel
+// so a failed declaration doesn't close a pooled channel
+func (p *Publisher) waitQueue(topic string, tier time.Duration) (string, error) {
+	name := waitQueueName(p.config.Exchange, topic, tier)
+
+	p.mu.Lock()
+	conn, declared := p.conn, p.waitQueues[name]
+	p.mu.Unlock()
+
+	if declared {
+		return name, nil
+	}
+
+	if conn == nil || conn.IsClosed() {
+		return "", fmt.Errorf("publisher is not connected")
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return "", fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+
+	if _, err := declareWaitQueue(ch, p.config.Exchange, topic, tier); err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	if p.conn == conn {
+		p.waitQueues[name] = true
+	}
+	p.mu.Unlock()
+
+	return name, nil
+}
+
+// PublishBatch will publish every body to the topic and wait for all the broker confirmations at once
+func (p *Publisher) PublishBatch(ctx context.Context, topic string, bodies [][]byte) error {
+	msgs := make([]amqp.Publishing, 0, len(bodies))
+	for _, body := range bodies {
+		msg := amqp.Publishing{
+			ContentType: contentType(ctx),
+			Body:        body,
+		}
+		if err := p.prepare(ctx, &msg); err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return p.withChannel(ctx, func(ctx context.Context, pc *confirmChannel) error {
+		return pc.publish(ctx, p.config.Exchange, topic, p.config.Mandatory, msgs...)
+	})
+}
+
+// prepare fill message id, timestamp and delivery mode when empty,
+// and add the distributed trace of the context to the headers
+func (p *Publisher) prepare(ctx context.Context, msg *amqp.Publishing) error {
+	injectTrace(ctx, msg)
+
+	if msg.MessageId == "" {
+		id, err := token.GenerateString(32)
+		if err != nil {
+			return err
+		}
+		msg.MessageId = id
+	}
+
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	if msg.DeliveryMode == 0 {
+		msg.DeliveryMode = amqp.Persistent
+		if p.config.Transient {
+			msg.DeliveryMode = amqp.Transient
+		}
+	}
+
+	return nil
+}
+
+// injectTrace add the distributed trace of the context to the headers, the existing headers are kept
+func injectTrace(ctx context.Context, msg *amqp.Publishing) {
+	md := nr.GetMetadataFromContext(ctx)
+	if len(md) == 0 {
+		return
+	}
+
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+
+	for k := range md {
+		if _, ok := msg.Headers[k]; !ok {
+			msg.Headers[k] = md.Get(k)
+		}
+	}
+}
+
+// withChannel borrow a channel from the pool for the duration of fn. A publish interrupted by its context
+// leaves confirmations and returns pending on the channel, it is closed so acquire replaces it
+func (p *Publisher) withChannel(ctx context.Context, fn func(ctx context.Context, pc *confirmChannel) error) error {
+	pc, pool, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { pool <- pc }()
+
+	ctx, cancel := context.WithTimeout(ctx, p.confirmTimeout)
+	defer cancel()
+
+	err = fn(ctx, pc)
+	if err != nil && ctx.Err() != nil {
+		_ = pc.ch.Close()
+	}
+
+	return err
+}
+
+// waitQueueName is the wait queue of the delay tier
+func waitQueueName(exchange, topic string, tier time.Duration) string {
+	if exchange != "" {
+		return fmt.Sprintf("%s.%s.wait.%d", exchange, topic, tier.Milliseconds())
+	}
+
+	return fmt.Sprintf("%s.wait.%d", topic, tier.Milliseconds())
+}
+
+// declareWaitQueue declare the durable wait queue of the delay tier, its messages are dead-lettered
+// to the exchange with the topic as routing key once the tier ttl expired
+func declareWaitQueue(ch *amqp.Channel, exchange, topic string, tier time.Duration) (string, error) {
+	name := waitQueueName(exchange, topic, tier)
+
+	_, err := ch.QueueDeclare(
+		name,
+		true,  // durable
+		false, // auto-delete
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-message-ttl":             tier.Milliseconds(),
+			"x-dead-letter-exchange":    exchange,
+			"x-dead-letter-routing-key": topic,
+		},
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to declare wait queue %s: %w", name, err)
+	}
+
+	return name, nil
+}
+
+// Close will close every channel and the connection of the publisher
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.shutdown)
+
+	if p.pool != nil {
+		for n := len(p.pool); n > 0; n-- {
+			pc := <-p.pool
+			_ = pc.ch.Close()
+		}
+	}
+
+	if p.conn != nil {
+		return p.conn.Close()
+	}
+
+	return nil
+}
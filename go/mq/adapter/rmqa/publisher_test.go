@@ -0,0 +1,287 @@
+package rmqa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{name: "Test default content type", ctx: context.Background(), want: "application/octet-stream"},
+		{name: "Test content type of the context", ctx: adapter.WithContentType(context.Background(), "application/json"), want: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentType(tt.ctx); got != tt.want {
+				t.Errorf("contentType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPublisher(t *testing.T) {
+	tests := []struct {
+		name               string
+		config             string
+		wantPoolSize       int
+		wantConfirmTimeout time.Duration
+	}{
+		{
+			name:               "Test defaults",
+			config:             `{"url":"amqp://localhost"}`,
+			wantPoolSize:       4,
+			wantConfirmTimeout: 5 * time.Second,
+		}, {
+			name:               "Test confirm timeout in milliseconds",
+			config:             `{"url":"amqp://localhost","pool_size":2,"confirm_timeout":1500}`,
+			wantPoolSize:       2,
+			wantConfirmTimeout: 1500 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg PublisherConfig
+			if err := json.Unmarshal([]byte(tt.config), &cfg); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+
+			p := NewPublisher(cfg)
+			if p.config.PoolSize != tt.wantPoolSize {
+				t.Errorf("PoolSize = %d, want %d", p.config.PoolSize, tt.wantPoolSize)
+			}
+			if p.confirmTimeout != tt.wantConfirmTimeout {
+				t.Errorf("confirmTimeout = %s, want %s", p.confirmTimeout, tt.wantConfirmTimeout)
+			}
+		})
+	}
+}
+
+func TestPublisher_prepare(t *testing.T) {
+	sent := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		transient        bool
+		msg              amqp.Publishing
+		wantID           string
+		wantTimestamp    time.Time
+		wantDeliveryMode uint8
+	}{
+		{
+			name:             "Test persistent by default",
+			wantDeliveryMode: amqp.Persistent,
+		}, {
+			name:             "Test transient publisher",
+			transient:        true,
+			wantDeliveryMode: amqp.Transient,
+		}, {
+			name:             "Test fields of the message kept",
+			transient:        true,
+			msg:              amqp.Publishing{MessageId: "order-1", Timestamp: sent, DeliveryMode: amqp.Persistent},
+			wantID:           "order-1",
+			wantTimestamp:    sent,
+			wantDeliveryMode: amqp.Persistent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPublisher(PublisherConfig{Transient: tt.transient})
+
+			msg := tt.msg
+			if err := p.prepare(context.Background(), &msg); err != nil {
+				t.Fatalf("prepare() error = %v", err)
+			}
+
+			switch {
+			case tt.wantID == "" && len(msg.MessageId) != 32:
+				t.Errorf("prepare() MessageId = %q, want a generated id", msg.MessageId)
+			case tt.wantID != "" && msg.MessageId != tt.wantID:
+				t.Errorf("prepare() MessageId = %q, want %q", msg.MessageId, tt.wantID)
+			}
+
+			switch {
+			case tt.wantTimestamp.IsZero() && msg.Timestamp.IsZero():
+				t.Error("prepare() Timestamp is not set")
+			case !tt.wantTimestamp.IsZero() && !msg.Timestamp.Equal(tt.wantTimestamp):
+				t.Errorf("prepare() Timestamp = %s, want %s", msg.Timestamp, tt.wantTimestamp)
+			}
+			if msg.DeliveryMode != tt.wantDeliveryMode {
+				t.Errorf("prepare() DeliveryMode = %d, want %d", msg.DeliveryMode, tt.wantDeliveryMode)
+			}
+		})
+	}
+}
+
+func TestPublisher_acquire(t *testing.T) {
+	pc := newConfirmChannel(&fakePublishChannel{})
+
+	tests := []struct {
+		name    string
+		setup   func(p *Publisher)
+		want    *confirmChannel
+		wantErr error
+	}{
+		{
+			name: "Test channel of the pool",
+			setup: func(p *Publisher) {
+				p.pool = make(chan *confirmChannel, 1)
+				p.pool <- pc
+			},
+			want: pc,
+		}, {
+			name: "Test pool ready after the reconnect",
+			setup: func(p *Publisher) {
+				go func() {
+					time.Sleep(5 * time.Millisecond)
+
+					p.mu.Lock()
+					defer p.mu.Unlock()
+					p.pool = make(chan *confirmChannel, 1)
+					p.pool <- pc
+					close(p.ready)
+				}()
+			},
+			want: pc,
+		}, {
+			name:    "Test context done while reconnecting",
+			wantErr: context.DeadlineExceeded,
+		}, {
+			name: "Test context done while the pool is busy",
+			setup: func(p *Publisher) {
+				p.pool = make(chan *confirmChannel, 1)
+			},
+			wantErr: context.DeadlineExceeded,
+		}, {
+			name: "Test closed while reconnecting",
+			setup: func(p *Publisher) {
+				go func() {
+					time.Sleep(5 * time.Millisecond)
+
+					p.mu.Lock()
+					defer p.mu.Unlock()
+					p.closed = true
+					close(p.shutdown)
+				}()
+			},
+			wantErr: ErrPublisherClosed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPublisher(PublisherConfig{})
+			if tt.setup != nil {
+				tt.setup(p)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			got, _, err := p.acquire(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("acquire() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("acquire() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublisher_Connect(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  PublisherConfig
+		wantErr string
+	}{
+		{
+			name:    "Test invalid delay tiers",
+			config:  PublisherConfig{URL: unreachableURL, DelayTiers: []int64{-1}},
+			wantErr: "invalid publisher config",
+		}, {
+			name:    "Test unreachable broker",
+			config:  PublisherConfig{URL: unreachableURL},
+			wantErr: "failed to connect to RabbitMQ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewPublisher(tt.config).Connect()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Connect() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublisher_reconnect(t *testing.T) {
+	p := NewPublisher(PublisherConfig{URL: unreachableURL})
+	p.reconnectDelay = time.Millisecond
+	p.maxReconnectDelay = 2 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.reconnect()
+	}()
+
+	// the publish waits for the reconnect until its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Publish(ctx, "orders", []byte("1")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Publish() while reconnecting error = %v, want context.DeadlineExceeded", err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reconnect() kept running after Close()")
+	}
+
+	if err := p.Publish(context.Background(), "orders", []byte("1")); !errors.Is(err, ErrPublisherClosed) {
+		t.Errorf("Publish() after Close() error = %v, want ErrPublisherClosed", err)
+	}
+}
+
+func TestPublisher_PublishBatchTimeout(t *testing.T) {
+	stale := &fakePublishChannel{pending: true, returned: map[string]bool{}}
+	fresh := &fakePublishChannel{}
+
+	p := NewPublisher(PublisherConfig{Mandatory: true, ConfirmTimeout: 10})
+	p.pool = make(chan *confirmChannel, 1)
+	p.pool <- newConfirmChannel(stale)
+	p.newChannel = func() (*confirmChannel, error) {
+		return newConfirmChannel(fresh), nil
+	}
+
+	err := p.PublishBatch(context.Background(), "orders", [][]byte{[]byte("1"), []byte("2")})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("PublishBatch() error = %v, want context.DeadlineExceeded", err)
+	}
+	if !stale.IsClosed() {
+		t.Fatal("PublishBatch() kept the channel of the timed out batch open")
+	}
+
+	if err := p.Publish(context.Background(), "orders", []byte("3")); err != nil {
+		t.Fatalf("Publish() error = %v, want nil", err)
+	}
+
+	pc := <-p.pool
+	if pc.ch != fresh {
+		t.Error("Publish() reused the channel of the timed out batch")
+	}
+}
@@ -0,0 +1,385 @@
+package rmqa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/reyhanfahlevi/pkg/go/log"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/reyhanfahlevi/pkg/go/token"
+)
+
+const (
+	// directReplyTo is the pseudo queue of the RabbitMQ direct reply-to
+	directReplyTo = "amq.rabbitmq.reply-to"
+
+	// headerRPCError carry the error returned by the server handler
+	headerRPCError = "x-rpc-error"
+)
+
+var (
+	// ErrRPCClientClosed returned when calling through a closed client
+	ErrRPCClientClosed = errors.New("rpc client is closed")
+
+	// ErrRPCConnectionLost returned to the pending calls when the connection is lost before their reply
+	ErrRPCConnectionLost = errors.New("rpc connection lost before the reply")
+)
+
+// RPCError is the error returned by the server handler
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return "rpc: " + e.Message
+}
+
+// RPCClientConfig config for the rpc client instance
+type RPCClientConfig struct {
+	URL string `json:"url"`
+
+	// Exchange the requests are published to, empty means the default exchange where the topic is the queue name
+	Exchange string `json:"exchange,omitempty"`
+
+	// ExclusiveReplyQueue receive the replies on an exclusive queue declared by the client instead of direct reply-to
+	ExclusiveReplyQueue bool `json:"exclusive_reply_queue,omitempty"`
+
+	// Timeout is the maximum milliseconds of a call when the context has no deadline, default: 30000
+	Timeout int64 `json:"timeout,omitempty"`
+}
+
+func (c *RPCClientConfig) setDefaults() {
+	if c.Timeout <= 0 {
+		c.Timeout = 30000
+	}
+}
+
+// RPCClient publish requests and wait for their reply, matched by correlation id.
+// All the calls share one channel, the connection is dialed again on the next call once lost
+type RPCClient struct {
+	config  RPCClientConfig
+	timeout time.Duration
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	ch      *amqp.Channel
+	replyTo string
+	pending map[string]chan rpcResult
+	closed  bool
+}
+
+type rpcResult struct {
+	delivery amqp.Delivery
+	err      error
+}
+
+// NewRPCClient will instantiate the rabbitmq rpc client, it connects on the first call or on Connect
+func NewRPCClient(cfg RPCClientConfig) *RPCClient {
+	cfg.setDefaults()
+
+	return &RPCClient{
+		config:  cfg,
+		timeout: time.Duration(cfg.Timeout) * time.Millisecond,
+		pending: make(map[string]chan rpcResult),
+	}
+}
+
+// Connect will dial the broker and start consuming the replies
+func (c *RPCClient) Connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.connect()
+}
+
+// connect the lock must be held
+func (c *RPCClient) connect() error {
+	if c.closed {
+		return ErrRPCClientClosed
+	}
+
+	if c.ch != nil && !c.ch.IsClosed() {
+		return nil
+	}
+
+	conn, err := amqp.Dial(c.config.URL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+
+	ch, replyTo, deliveries, err := openReplyChannel(conn, c.config.ExclusiveReplyQueue)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	// a request routed to no queue is returned, the call fails right away instead of timing out
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	c.conn, c.ch, c.replyTo = conn, ch, replyTo
+	go c.dispatch(ch, deliveries, returns)
+
+	return nil
+}
+
+// openReplyChannel consume the replies, direct reply-to requires no-ack and the requests published on the same channel
+func openReplyChannel(conn *amqp.Connection, exclusive bool) (*amqp.Channel, string, <-chan amqp.Delivery, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	replyTo := directReplyTo
+	if exclusive {
+		q, err := ch.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("failed to declare reply queue: %w", err)
+		}
+		replyTo = q.Name
+	}
+
+	deliveries, err := ch.Consume(replyTo, "", true, exclusive, false, false, nil)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to consume replies: %w", err)
+	}
+
+	return ch, replyTo, deliveries, nil
+}
+
+// dispatch hand the replies to the waiting calls until the channel is closed
+func (c *RPCClient) dispatch(ch *amqp.Channel, deliveries <-chan amqp.Delivery, returns <-chan amqp.Return) {
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				c.lost(ch)
+				return
+			}
+			c.resolve(d.CorrelationId, rpcResult{delivery: d})
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.resolve(ret.CorrelationId, rpcResult{err: &ReturnError{Return: ret}})
+		}
+	}
+}
+
+// resolve give the result to the call waiting for the correlation id, late replies are dropped
+func (c *RPCClient) resolve(correlationID string, result rpcResult) {
+	c.mu.Lock()
+	wait, ok := c.pending[correlationID]
+	delete(c.pending, correlationID)
+	c.mu.Unlock()
+
+	if !ok {
+		log.DebugWithFields("rpc: reply without pending call", map[string]interface{}{"correlation_id": correlationID})
+		return
+	}
+
+	wait <- result
+}
+
+// lost fail the pending calls, their replies would come to a reply queue that doesn't exist anymore
+func (c *RPCClient) lost(ch *amqp.Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ch != ch {
+		return
+	}
+
+	if c.conn != nil && !c.conn.IsClosed() {
+		_ = c.conn.Close()
+	}
+	c.conn, c.ch = nil, nil
+
+	err := ErrRPCConnectionLost
+	if c.closed {
+		err = ErrRPCClientClosed
+	}
+	c.failPending(err)
+}
+
+// failPending the lock must be held
+func (c *RPCClient) failPending(err error) {
+	for id, wait := range c.pending {
+		wait <- rpcResult{err: err}
+		delete(c.pending, id)
+	}
+}
+
+// Call publish the body to the topic through the configured exchange and return the reply body.
+// A server handler error is returned as *RPCError
+func (c *RPCClient) Call(ctx context.Context, topic string, body []byte) ([]byte, error) {
+	reply, err := c.CallRaw(ctx, c.config.Exchange, topic, amqp.Publishing{
+		ContentType: "application/octet-stream",
+		Body:        body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Body, nil
+}
+
+// CallRaw publish the request to the exchange with the routing key and wait for the reply until the context is done.
+// Correlation id and timestamp are filled when empty, and the request expires with the context deadline
+func (c *RPCClient) CallRaw(ctx context.Context, exchange, key string, msg amqp.Publishing) (amqp.Delivery, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	if err := c.prepare(ctx, &msg); err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	wait := make(chan rpcResult, 1)
+
+	c.mu.Lock()
+	if err := c.connect(); err != nil {
+		c.mu.Unlock()
+		return amqp.Delivery{}, err
+	}
+	ch := c.ch
+	msg.ReplyTo = c.replyTo
+	c.pending[msg.CorrelationId] = wait
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, msg.CorrelationId)
+		c.mu.Unlock()
+	}()
+
+	if err := ch.PublishWithContext(ctx, exchange, key, true, false, msg); err != nil {
+		return amqp.Delivery{}, fmt.Errorf("failed to publish rpc request: %w", err)
+	}
+
+	select {
+	case result := <-wait:
+		if result.err != nil {
+			return amqp.Delivery{}, result.err
+		}
+		return result.delivery, replyError(result.delivery)
+	case <-ctx.Done():
+		return amqp.Delivery{}, ctx.Err()
+	}
+}
+
+func (c *RPCClient) prepare(ctx context.Context, msg *amqp.Publishing) error {
+	injectTrace(ctx, msg)
+
+	if msg.CorrelationId == "" {
+		id, err := token.GenerateString(32)
+		if err != nil {
+			return err
+		}
+		msg.CorrelationId = id
+	}
+
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	// nobody waits for the reply after the deadline, the server doesn't need to handle the request
+	if deadline, ok := ctx.Deadline(); ok && msg.Expiration == "" {
+		ms := time.Until(deadline).Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		msg.Expiration = strconv.FormatInt(ms, 10)
+	}
+
+	return nil
+}
+
+// replyError return the server handler error carried by the reply
+func replyError(d amqp.Delivery) error {
+	if msg, ok := d.Headers[headerRPCError].(string); ok {
+		return &RPCError{Message: msg}
+	}
+
+	return nil
+}
+
+// Close close the connection, the pending calls fail with ErrRPCClientClosed
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.failPending(ErrRPCClientClosed)
+
+	var err error
+	if c.conn != nil && !c.conn.IsClosed() {
+		err = c.conn.Close()
+	}
+	c.conn, c.ch = nil, nil
+
+	return err
+}
+
+// RPCHandler handle the request and return the reply body
+type RPCHandler func(ctx context.Context, message adapter.IMessage) ([]byte, error)
+
+// RawPublisher publish the message as is, it is implemented by *Publisher
+type RawPublisher interface {
+	PublishRaw(ctx context.Context, exchange, key string, msg amqp.Publishing) error
+}
+
+// NewRPCHandler will wrap the rpc handler into adapter.Handler, the reply is published to the request ReplyTo
+// with its CorrelationId. A handler error is sent back to the client as *RPCError and the request is acknowledged,
+// the request is only retried when the reply can't be published. A request without ReplyTo is handled as a normal message
+func NewRPCHandler(publisher RawPublisher, handler RPCHandler) adapter.Handler {
+	return func(ctx context.Context, message adapter.IMessage) error {
+		body, err := handler(ctx, message)
+
+		replyTo := ""
+		if r, ok := message.(interface{ GetReplyTo() string }); ok {
+			replyTo = r.GetReplyTo()
+		}
+		if replyTo == "" {
+			return err
+		}
+
+		reply := amqp.Publishing{
+			CorrelationId: message.GetCorrelationID(),
+			ContentType:   "application/octet-stream",
+			Body:          body,
+		}
+		if err != nil {
+			reply.Headers = amqp.Table{headerRPCError: err.Error()}
+		}
+
+		// the reply is sent even when the handler context timed out, the client may still wait for it
+		pubErr := publisher.PublishRaw(context.WithoutCancel(ctx), "", replyTo, reply)
+
+		var returned *ReturnError
+		if errors.As(pubErr, &returned) {
+			// the client is gone, handling the request again won't bring it back
+			log.ErrorWithFields("rpc: reply returned by the broker", map[string]interface{}{
+				"reply_to":       replyTo,
+				"correlation_id": reply.CorrelationId,
+			})
+			return nil
+		}
+
+		if pubErr != nil {
+			return fmt.Errorf("failed to publish rpc reply: %w", pubErr)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,226 @@
+package rmqa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+// rpcRequest is a request carrying ReplyTo and CorrelationId
+type rpcRequest struct {
+	stubMessage
+	replyTo       string
+	correlationID string
+}
+
+func (m rpcRequest) GetReplyTo() string       { return m.replyTo }
+func (m rpcRequest) GetCorrelationID() string { return m.correlationID }
+
+type replyRecorder struct {
+	err     error
+	key     string
+	replies []amqp.Publishing
+}
+
+func (r *replyRecorder) PublishRaw(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	r.key = key
+	r.replies = append(r.replies, msg)
+	return nil
+}
+
+func TestNewRPCHandler(t *testing.T) {
+	errFailed := errors.New("order not found")
+
+	tests := []struct {
+		name       string
+		message    adapter.IMessage
+		body       []byte
+		handlerErr error
+		publishErr error
+		wantErr    bool
+		wantReply  *amqp.Publishing
+	}{
+		{
+			name:      "Test reply sent to reply to",
+			message:   rpcRequest{replyTo: directReplyTo, correlationID: "42"},
+			body:      []byte("ok"),
+			wantReply: &amqp.Publishing{CorrelationId: "42", ContentType: "application/octet-stream", Body: []byte("ok")},
+		}, {
+			name:       "Test handler error sent back",
+			message:    rpcRequest{replyTo: directReplyTo, correlationID: "42"},
+			handlerErr: errFailed,
+			wantReply: &amqp.Publishing{
+				CorrelationId: "42",
+				ContentType:   "application/octet-stream",
+				Headers:       amqp.Table{headerRPCError: "order not found"},
+			},
+		}, {
+			name:       "Test message without reply to",
+			message:    stubMessage{},
+			handlerErr: errFailed,
+			wantErr:    true,
+		}, {
+			name:       "Test reply publish failure retried",
+			message:    rpcRequest{replyTo: directReplyTo, correlationID: "42"},
+			publishErr: errors.New("connection closed"),
+			wantErr:    true,
+		}, {
+			name:       "Test reply returned since the client is gone",
+			message:    rpcRequest{replyTo: directReplyTo, correlationID: "42"},
+			publishErr: &ReturnError{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub := &replyRecorder{err: tt.publishErr}
+			handler := NewRPCHandler(pub, func(ctx context.Context, message adapter.IMessage) ([]byte, error) {
+				return tt.body, tt.handlerErr
+			})
+
+			err := handler(context.Background(), tt.message)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantReply == nil {
+				if len(pub.replies) != 0 {
+					t.Errorf("replies = %v, want none", pub.replies)
+				}
+				return
+			}
+
+			if len(pub.replies) != 1 || pub.key != directReplyTo {
+				t.Fatalf("replies = %v to %q, want one to %q", pub.replies, pub.key, directReplyTo)
+			}
+			got := pub.replies[0]
+			if got.CorrelationId != tt.wantReply.CorrelationId || string(got.Body) != string(tt.wantReply.Body) ||
+				got.Headers[headerRPCError] != tt.wantReply.Headers[headerRPCError] {
+				t.Errorf("reply = %+v, want %+v", got, *tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestRPCClient_resolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   rpcResult
+		wantBody string
+		wantErr  error
+	}{
+		{
+			name:     "Test reply",
+			result:   rpcResult{delivery: amqp.Delivery{CorrelationId: "1", Body: []byte("ok")}},
+			wantBody: "ok",
+		}, {
+			name: "Test server error",
+			result: rpcResult{delivery: amqp.Delivery{
+				CorrelationId: "1",
+				Headers:       amqp.Table{headerRPCError: "order not found"},
+			}},
+			wantErr: &RPCError{Message: "order not found"},
+		}, {
+			name:    "Test request returned",
+			result:  rpcResult{err: &ReturnError{Return: amqp.Return{CorrelationId: "1", ReplyText: "NO_ROUTE"}}},
+			wantErr: &ReturnError{Return: amqp.Return{CorrelationId: "1", ReplyText: "NO_ROUTE"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewRPCClient(RPCClientConfig{})
+			wait := make(chan rpcResult, 1)
+			c.pending["1"] = wait
+
+			c.resolve("1", tt.result)
+			// a late duplicate is dropped
+			c.resolve("1", tt.result)
+
+			result := <-wait
+			err := result.err
+			if err == nil {
+				err = replyError(result.delivery)
+			}
+
+			if (err == nil) != (tt.wantErr == nil) || (err != nil && err.Error() != tt.wantErr.Error()) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if string(result.delivery.Body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", result.delivery.Body, tt.wantBody)
+			}
+			if len(c.pending) != 0 {
+				t.Errorf("pending = %d, want 0", len(c.pending))
+			}
+		})
+	}
+}
+
+func TestNewRPCClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		wantTimeout time.Duration
+	}{
+		{
+			name:        "Test default timeout",
+			config:      `{"url":"amqp://localhost"}`,
+			wantTimeout: 30 * time.Second,
+		}, {
+			name:        "Test timeout in milliseconds",
+			config:      `{"url":"amqp://localhost","timeout":5000}`,
+			wantTimeout: 5 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg RPCClientConfig
+			if err := json.Unmarshal([]byte(tt.config), &cfg); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+
+			if c := NewRPCClient(cfg); c.timeout != tt.wantTimeout {
+				t.Errorf("timeout = %s, want %s", c.timeout, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestRPCClient_Call(t *testing.T) {
+	c := NewRPCClient(RPCClientConfig{URL: unreachableURL, Timeout: 1000})
+
+	if _, err := c.Call(context.Background(), "orders", nil); err == nil {
+		t.Error("Call() on unreachable broker error = nil, want error")
+	}
+
+	_ = c.Close()
+	if _, err := c.Call(context.Background(), "orders", nil); !errors.Is(err, ErrRPCClientClosed) {
+		t.Errorf("Call() after Close error = %v, want %v", err, ErrRPCClientClosed)
+	}
+}
+
+func TestRPCClient_prepare(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c := NewRPCClient(RPCClientConfig{})
+	msg := amqp.Publishing{}
+	if err := c.prepare(ctx, &msg); err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+
+	if msg.CorrelationId == "" {
+		t.Error("correlation id not generated")
+	}
+	if ms, err := strconv.Atoi(msg.Expiration); err != nil || ms < 59000 || ms > 60000 {
+		t.Errorf("expiration = %q, want about 60000", msg.Expiration)
+	}
+}
@@ -0,0 +1,74 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// AbandonedMessage is an in-flight message still being handled when the shutdown deadline passed
+type AbandonedMessage struct {
+	Topic     string
+	MessageID string
+	Attempts  int32
+}
+
+// ShutdownError report the messages abandoned by a shutdown,
+// they are given back to the broker so they are delivered again
+type ShutdownError struct {
+	Abandoned []AbandonedMessage
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("shutdown abandoned %d in-flight messages", len(e.Abandoned))
+}
+
+// Shutdowner is anything that can be shut down gracefully
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// ShutdownAll shuts down all the targets concurrently and merge the abandoned messages into one *ShutdownError.
+// When nothing is abandoned the first other error is returned
+func ShutdownAll(ctx context.Context, targets ...Shutdowner) error {
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		abandoned []AbandonedMessage
+		firstErr  error
+	)
+
+	for _, target := range targets {
+		wg.Add(1)
+		target := target
+		go func() { // use goroutines to stop all of them ASAP
+			defer wg.Done()
+
+			err := target.Shutdown(ctx)
+			if err == nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			var shutdownErr *ShutdownError
+			if errors.As(err, &shutdownErr) {
+				abandoned = append(abandoned, shutdownErr.Abandoned...)
+				return
+			}
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(abandoned) > 0 {
+		return &ShutdownError{Abandoned: abandoned}
+	}
+
+	return firstErr
+}
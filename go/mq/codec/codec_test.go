@@ -0,0 +1,64 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type order struct {
+	ID    int64  `json:"id" msgpack:"id"`
+	Buyer string `json:"buyer" msgpack:"buyer"`
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+	}{
+		{name: "Test json", codec: JSON},
+		{name: "Test msgpack", codec: Msgpack},
+		{name: "Test gzip json", codec: Gzip(JSON)},
+		{name: "Test gzip msgpack", codec: Gzip(Msgpack)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := order{ID: 1, Buyer: "reyhan"}
+
+			data, err := tt.codec.Marshal(want)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			var got order
+			if err := tt.codec.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Unmarshal() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	data, err := Protobuf.Marshal(wrapperspb.String("reyhan"))
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	got := &wrapperspb.StringValue{}
+	if err := Protobuf.Unmarshal(data, got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !proto.Equal(got, wrapperspb.String("reyhan")) {
+		t.Errorf("Unmarshal() = %v, want reyhan", got)
+	}
+
+	if _, err := Protobuf.Marshal(order{}); err == nil {
+		t.Error("Marshal() of non proto.Message error = nil, want error")
+	}
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"expvar"
+)
+
+// ExpvarSink publish the metrics in an expvar map as "<topic>.<name>",
+// observations are published as "<topic>.<name>_sum" and "<topic>.<name>_count"
+type ExpvarSink struct {
+	vars *expvar.Map
+}
+
+// NewExpvarSink will publish the expvar map with the name, the existing map is reused
+func NewExpvarSink(name string) *ExpvarSink {
+	if vars, ok := expvar.Get(name).(*expvar.Map); ok {
+		return &ExpvarSink{vars: vars}
+	}
+
+	return &ExpvarSink{vars: expvar.NewMap(name)}
+}
+
+// Add increase the counter
+func (s *ExpvarSink) Add(name, topic string, delta float64) {
+	s.vars.AddFloat(topic+"."+name, delta)
+}
+
+// Set replace the gauge value
+func (s *ExpvarSink) Set(name, topic string, value float64) {
+	v := new(expvar.Float)
+	v.Set(value)
+	s.vars.Set(topic+"."+name, v)
+}
+
+// Observe record a sample
+func (s *ExpvarSink) Observe(name, topic string, value float64) {
+	s.vars.AddFloat(topic+"."+name+"_sum", value)
+	s.vars.AddFloat(topic+"."+name+"_count", 1)
+}
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HealthHandler report the consumer stats as json, with 200 when every consumer is connected
+// and 503 otherwise, so it can be used as readiness probe
+func HealthHandler(stats func() []ConsumerStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot := stats()
+
+		status := http.StatusOK
+		for _, s := range snapshot {
+			if !s.Connected {
+				status = http.StatusServiceUnavailable
+				break
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"ready":     status == http.StatusOK,
+			"consumers": snapshot,
+		})
+	})
+}
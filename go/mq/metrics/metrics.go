@@ -0,0 +1,175 @@
+// Package metrics contains the consumer statistics, the metrics sinks and the health handler of mq consumers
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metric names reported to the Sink, every metric is labelled by topic
+const (
+	MetricSucceeded    = "mq_messages_succeeded_total"
+	MetricFailed       = "mq_messages_failed_total"
+	MetricRequeued     = "mq_messages_requeued_total"
+	MetricDeadLettered = "mq_messages_dead_lettered_total"
+	MetricReconnects   = "mq_reconnects_total"
+	MetricInFlight     = "mq_messages_in_flight"
+	MetricConnected    = "mq_connected"
+	MetricHandleTime   = "mq_handle_seconds"
+)
+
+// Sink receive the consumer metrics
+type Sink interface {
+	// Add increase the counter
+	Add(name, topic string, delta float64)
+	// Set replace the gauge value
+	Set(name, topic string, value float64)
+	// Observe record a sample, e.g. the handle time in seconds
+	Observe(name, topic string, value float64)
+}
+
+type nopSink struct{}
+
+func (nopSink) Add(name, topic string, delta float64)     {}
+func (nopSink) Set(name, topic string, value float64)     {}
+func (nopSink) Observe(name, topic string, value float64) {}
+
+// Nop is the sink used when none is configured
+var Nop Sink = nopSink{}
+
+// ConsumerStats is a snapshot of a consumer
+type ConsumerStats struct {
+	Topic        string        `json:"topic"`
+	Channel      string        `json:"channel,omitempty"`
+	Connected    bool          `json:"connected"`
+	Reconnects   int64         `json:"reconnects"`
+	InFlight     int           `json:"in_flight"`
+	Succeeded    int64         `json:"succeeded"`
+	Failed       int64         `json:"failed"`
+	Requeued     int64         `json:"requeued"`
+	DeadLettered int64         `json:"dead_lettered"`
+	AvgLatency   time.Duration `json:"avg_latency"`
+	MaxLatency   time.Duration `json:"max_latency"`
+}
+
+// Counters keep the counters of a consumer for its stats and forward them to the sink,
+// it is safe for concurrent use and a nil Counters records nothing
+type Counters struct {
+	topic string
+	sink  Sink
+
+	succeeded    int64
+	failed       int64
+	requeued     int64
+	deadLettered int64
+	reconnects   int64
+	handled      int64
+	latencyTotal int64
+	latencyMax   int64
+}
+
+// NewCounters will create the counters of the topic, a nil sink is replaced by Nop
+func NewCounters(topic string, sink Sink) *Counters {
+	if sink == nil {
+		sink = Nop
+	}
+
+	return &Counters{topic: topic, sink: sink}
+}
+
+// Handled record the handler result and latency
+func (c *Counters) Handled(latency time.Duration, err error) {
+	if c == nil {
+		return
+	}
+
+	atomic.AddInt64(&c.handled, 1)
+	atomic.AddInt64(&c.latencyTotal, int64(latency))
+	for {
+		max := atomic.LoadInt64(&c.latencyMax)
+		if int64(latency) <= max || atomic.CompareAndSwapInt64(&c.latencyMax, max, int64(latency)) {
+			break
+		}
+	}
+	c.sink.Observe(MetricHandleTime, c.topic, latency.Seconds())
+
+	if err != nil {
+		atomic.AddInt64(&c.failed, 1)
+		c.sink.Add(MetricFailed, c.topic, 1)
+		return
+	}
+
+	atomic.AddInt64(&c.succeeded, 1)
+	c.sink.Add(MetricSucceeded, c.topic, 1)
+}
+
+// Requeued record a requeued message
+func (c *Counters) Requeued() {
+	if c == nil {
+		return
+	}
+
+	atomic.AddInt64(&c.requeued, 1)
+	c.sink.Add(MetricRequeued, c.topic, 1)
+}
+
+// DeadLettered record a dead-lettered message
+func (c *Counters) DeadLettered() {
+	if c == nil {
+		return
+	}
+
+	atomic.AddInt64(&c.deadLettered, 1)
+	c.sink.Add(MetricDeadLettered, c.topic, 1)
+}
+
+// Reconnected record a successful reconnection
+func (c *Counters) Reconnected() {
+	if c == nil {
+		return
+	}
+
+	atomic.AddInt64(&c.reconnects, 1)
+	c.sink.Add(MetricReconnects, c.topic, 1)
+}
+
+// SetInFlight report the number of messages being handled
+func (c *Counters) SetInFlight(n int) {
+	if c == nil {
+		return
+	}
+
+	c.sink.Set(MetricInFlight, c.topic, float64(n))
+}
+
+// SetConnected report the connection state
+func (c *Counters) SetConnected(connected bool) {
+	if c == nil {
+		return
+	}
+
+	v := 0.0
+	if connected {
+		v = 1
+	}
+	c.sink.Set(MetricConnected, c.topic, v)
+}
+
+// Snapshot fill the counters into the stats, the connection state and in-flight are set by the consumer
+func (c *Counters) Snapshot() ConsumerStats {
+	stats := ConsumerStats{
+		Topic:        c.topic,
+		Reconnects:   atomic.LoadInt64(&c.reconnects),
+		Succeeded:    atomic.LoadInt64(&c.succeeded),
+		Failed:       atomic.LoadInt64(&c.failed),
+		Requeued:     atomic.LoadInt64(&c.requeued),
+		DeadLettered: atomic.LoadInt64(&c.deadLettered),
+		MaxLatency:   time.Duration(atomic.LoadInt64(&c.latencyMax)),
+	}
+
+	if handled := atomic.LoadInt64(&c.handled); handled > 0 {
+		stats.AvgLatency = time.Duration(atomic.LoadInt64(&c.latencyTotal) / handled)
+	}
+
+	return stats
+}
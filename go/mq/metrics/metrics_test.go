@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounters_Snapshot(t *testing.T) {
+	sink := NewPrometheusSink()
+	c := NewCounters("orders", sink)
+
+	c.Handled(10*time.Millisecond, nil)
+	c.Handled(30*time.Millisecond, errors.New("failing"))
+	c.Requeued()
+	c.DeadLettered()
+	c.Reconnected()
+
+	got := c.Snapshot()
+	want := ConsumerStats{
+		Topic:        "orders",
+		Reconnects:   1,
+		Succeeded:    1,
+		Failed:       1,
+		Requeued:     1,
+		DeadLettered: 1,
+		AvgLatency:   20 * time.Millisecond,
+		MaxLatency:   30 * time.Millisecond,
+	}
+	if got != want {
+		t.Errorf("Snapshot() = %+v, want %+v", got, want)
+	}
+
+	for _, line := range []string{
+		"# TYPE mq_messages_succeeded_total counter",
+		`mq_messages_failed_total{topic="orders"} 1`,
+		`mq_handle_seconds_count{topic="orders"} 2`,
+	} {
+		if !strings.Contains(sink.String(), line) {
+			t.Errorf("prometheus output missing %q:\n%s", line, sink.String())
+		}
+	}
+}
+
+func TestPrometheusSink_escapeLabel(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		want  string
+	}{
+		{
+			name:  "Test plain topic",
+			topic: "orders",
+			want:  `mq_messages_requeued_total{topic="orders"} 1`,
+		}, {
+			name:  "Test escaped characters",
+			topic: "a\\b\"c\nd",
+			want:  `mq_messages_requeued_total{topic="a\\b\"c\nd"} 1`,
+		}, {
+			name:  "Test characters kept as is",
+			topic: "tab\tcafé",
+			want:  "mq_messages_requeued_total{topic=\"tab\tcafé\"} 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := NewPrometheusSink()
+			NewCounters(tt.topic, sink).Requeued()
+
+			if !strings.Contains(sink.String(), tt.want) {
+				t.Errorf("prometheus output missing %q:\n%s", tt.want, sink.String())
+			}
+		})
+	}
+}
+
+func TestCounters_Nil(t *testing.T) {
+	var c *Counters
+	c.Handled(time.Second, nil)
+	c.Requeued()
+	c.SetConnected(true)
+}
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		stats      []ConsumerStats
+		wantStatus int
+	}{
+		{
+			name:       "Test all connected",
+			stats:      []ConsumerStats{{Topic: "orders", Connected: true}, {Topic: "payments", Connected: true}},
+			wantStatus: http.StatusOK,
+		}, {
+			name:       "Test one disconnected",
+			stats:      []ConsumerStats{{Topic: "orders", Connected: true}, {Topic: "payments"}},
+			wantStatus: http.StatusServiceUnavailable,
+		}, {
+			name:       "Test no consumer",
+			stats:      nil,
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			HealthHandler(func() []ConsumerStats { return tt.stats }).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
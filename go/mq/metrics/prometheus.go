@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type series struct {
+	name  string
+	topic string
+}
+
+// PrometheusSink keep the metrics in memory and serve them in the Prometheus text exposition format,
+// observations are exposed as a summary without quantiles (_sum and _count)
+type PrometheusSink struct {
+	mu       sync.Mutex
+	counters map[series]float64
+	gauges   map[series]float64
+	sums     map[series]float64
+	counts   map[series]float64
+}
+
+// NewPrometheusSink will create the Prometheus text sink
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		counters: map[series]float64{},
+		gauges:   map[series]float64{},
+		sums:     map[series]float64{},
+		counts:   map[series]float64{},
+	}
+}
+
+// Add increase the counter
+func (s *PrometheusSink) Add(name, topic string, delta float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[series{name, topic}] += delta
+}
+
+// Set replace the gauge value
+func (s *PrometheusSink) Set(name, topic string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gauges[series{name, topic}] = value
+}
+
+// Observe record a sample
+func (s *PrometheusSink) Observe(name, topic string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sums[series{name, topic}] += value
+	s.counts[series{name, topic}]++
+}
+
+// ServeHTTP write the metrics in the Prometheus text format
+func (s *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(s.String()))
+}
+
+// String return the metrics in the Prometheus text format
+func (s *PrometheusSink) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b strings.Builder
+	writeFamily(&b, "counter", "", s.counters)
+	writeFamily(&b, "gauge", "", s.gauges)
+	writeFamily(&b, "summary", "_sum", s.sums)
+	writeFamily(&b, "", "_count", s.counts)
+
+	return b.String()
+}
+
+// writeFamily write the series grouped by name, typ is empty when the TYPE line was already written
+func writeFamily(b *strings.Builder, typ, suffix string, values map[series]float64) {
+	keys := make([]series, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].topic < keys[j].topic
+	})
+
+	last := ""
+	for _, k := range keys {
+		if typ != "" && k.name != last {
+			fmt.Fprintf(b, "# TYPE %s %s\n", k.name, typ)
+			last = k.name
+		}
+		fmt.Fprintf(b, "%s%s{topic=%s} %s\n", k.name, suffix, escapeLabel(k.topic), strconv.FormatFloat(values[k], 'g', -1, 64))
+	}
+}
+
+// labelEscaper escape a label value of the text exposition format, only backslash, double quote and line feed are escaped
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
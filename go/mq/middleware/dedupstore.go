@@ -0,0 +1,306 @@
+package middleware
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryDedupStore keep the keys in memory for ttl, the least recently used keys are evicted beyond size
+type MemoryDedupStore struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+	now   func() time.Time
+}
+
+type dedupEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// NewMemoryDedupStore will create the in-memory store, size <= 0 means no limit and ttl <= 0 means no expiry
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+		now:   time.Now,
+	}
+}
+
+// Seen report whether the key was completed and is not expired yet
+func (s *MemoryDedupStore) Seen(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return false, nil
+	}
+
+	if s.expired(el.Value.(*dedupEntry)) {
+		s.remove(el)
+		return false, nil
+	}
+
+	s.ll.MoveToFront(el)
+	return true, nil
+}
+
+// Complete record the key until the ttl passed
+func (s *MemoryDedupStore) Complete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expiresAt time.Time
+	if s.ttl > 0 {
+		expiresAt = s.now().Add(s.ttl)
+	}
+
+	if el, ok := s.items[key]; ok {
+		el.Value.(*dedupEntry).expiresAt = expiresAt
+		s.ll.MoveToFront(el)
+		return nil
+	}
+
+	s.items[key] = s.ll.PushFront(&dedupEntry{key: key, expiresAt: expiresAt})
+	for s.size > 0 && s.ll.Len() > s.size {
+		s.remove(s.ll.Back())
+	}
+
+	return nil
+}
+
+// Len return the number of keys kept, including the expired ones not evicted yet
+func (s *MemoryDedupStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ll.Len()
+}
+
+func (s *MemoryDedupStore) expired(e *dedupEntry) bool {
+	return !e.expiresAt.IsZero() && !s.now().Before(e.expiresAt)
+}
+
+func (s *MemoryDedupStore) remove(el *list.Element) {
+	s.ll.Remove(el)
+	delete(s.items, el.Value.(*dedupEntry).key)
+}
+
+// FileDedupStore keep the keys in an append-only file so they survive a restart,
+// the file is compacted each time its records doubled since the last compaction,
+// dropping the expired keys and the overwritten records
+type FileDedupStore struct {
+	mu      sync.Mutex
+	path    string
+	ttl     time.Duration
+	file    *os.File
+	keys    map[string]time.Time
+	records int
+	// compactAt is the number of records triggering the next compaction
+	compactAt int
+	now       func() time.Time
+}
+
+type fileDedupRecord struct {
+	Key       string `json:"k"`
+	ExpiresAt int64  `json:"e,omitempty"`
+}
+
+// minCompactRecords avoid rewriting small files
+const minCompactRecords = 1024
+
+// NewFileDedupStore will open or create the store file, ttl <= 0 means no expiry
+func NewFileDedupStore(path string, ttl time.Duration) (*FileDedupStore, error) {
+	s := &FileDedupStore{
+		path: path,
+		ttl:  ttl,
+		keys: map[string]time.Time{},
+		now:  time.Now,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.scheduleCompaction()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dedup store: %w", err)
+	}
+	s.file = file
+
+	return s, nil
+}
+
+// load read the records of the file, a truncated last record is ignored
+func (s *FileDedupStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open dedup store: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r fileDedupRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+
+		s.records++
+		s.keys[r.Key] = unixTime(r.ExpiresAt)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read dedup store: %w", err)
+	}
+
+	return nil
+}
+
+// Seen report whether the key was completed and is not expired yet
+func (s *FileDedupStore) Seen(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiresAt, ok := s.keys[key]
+	if !ok {
+		return false, nil
+	}
+
+	if !expiresAt.IsZero() && !s.now().Before(expiresAt) {
+		delete(s.keys, key)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Complete append the key to the file
+func (s *FileDedupStore) Complete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("dedup store is closed")
+	}
+
+	r := fileDedupRecord{Key: key}
+	if s.ttl > 0 {
+		r.ExpiresAt = s.now().Add(s.ttl).UnixNano()
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write dedup store: %w", err)
+	}
+
+	s.records++
+	s.keys[key] = unixTime(r.ExpiresAt)
+
+	if s.records >= s.compactAt {
+		return s.compact()
+	}
+
+	return nil
+}
+
+// compact rewrite the file with the live keys only, the lock must be held.
+// The rewritten file is opened for append before it replaces the store file, so when the compaction fails
+// the store keeps appending to the old file and the compaction is tried again once the records doubled
+func (s *FileDedupStore) compact() error {
+	now := s.now()
+	tmp := s.path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		s.scheduleCompaction()
+		return fmt.Errorf("failed to compact dedup store: %w", err)
+	}
+
+	w := bufio.NewWriter(file)
+	records := 0
+	for key, expiresAt := range s.keys {
+		if !expiresAt.IsZero() && !now.Before(expiresAt) {
+			delete(s.keys, key)
+			continue
+		}
+
+		r := fileDedupRecord{Key: key}
+		if !expiresAt.IsZero() {
+			r.ExpiresAt = expiresAt.UnixNano()
+		}
+
+		line, _ := json.Marshal(r)
+		_, _ = w.Write(append(line, '\n'))
+		records++
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+		s.scheduleCompaction()
+		return fmt.Errorf("failed to compact dedup store: %w", err)
+	}
+
+	// the old descriptor points to the replaced file
+	_ = s.file.Close()
+	s.file = file
+	s.records = records
+	s.scheduleCompaction()
+
+	return nil
+}
+
+// scheduleCompaction compact the file again once its records doubled, so it stays
+// within twice the keys completed during the ttl, the lock must be held
+func (s *FileDedupStore) scheduleCompaction() {
+	s.compactAt = 2 * s.records
+	if s.compactAt < minCompactRecords {
+		s.compactAt = minCompactRecords
+	}
+}
+
+// Close close the file, the store can't record keys anymore
+func (s *FileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func unixTime(nano int64) time.Time {
+	if nano == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nano)
+}
@@ -0,0 +1,225 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s := NewMemoryDedupStore(2, time.Minute)
+	s.now = func() time.Time { return now }
+
+	_ = s.Complete(ctx, "a")
+	_ = s.Complete(ctx, "b")
+
+	// a is used recently, b is evicted by c
+	if seen, _ := s.Seen(ctx, "a"); !seen {
+		t.Error("a not seen")
+	}
+	_ = s.Complete(ctx, "c")
+
+	tests := []struct {
+		name     string
+		advance  time.Duration
+		key      string
+		wantSeen bool
+	}{
+		{name: "Test recently used kept", key: "a", wantSeen: true},
+		{name: "Test least recently used evicted", key: "b", wantSeen: false},
+		{name: "Test last key kept", key: "c", wantSeen: true},
+		{name: "Test expired after ttl", advance: time.Minute, key: "c", wantSeen: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			if seen, err := s.Seen(ctx, tt.key); err != nil || seen != tt.wantSeen {
+				t.Errorf("Seen(%s) = %v, %v, want %v", tt.key, seen, err, tt.wantSeen)
+			}
+		})
+	}
+}
+
+func TestFileDedupStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dedup.log")
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s, err := NewFileDedupStore(path, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFileDedupStore() error = %v", err)
+	}
+	s.now = func() time.Time { return now }
+
+	_ = s.Complete(ctx, "a")
+	now = now.Add(30 * time.Second)
+	_ = s.Complete(ctx, "b")
+	_ = s.Close()
+
+	// the keys survive reopening the file
+	s, err = NewFileDedupStore(path, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFileDedupStore() error = %v", err)
+	}
+	defer s.Close()
+	now = now.Add(45 * time.Second)
+	s.now = func() time.Time { return now }
+
+	tests := []struct {
+		key      string
+		wantSeen bool
+	}{
+		{key: "a", wantSeen: false},
+		{key: "b", wantSeen: true},
+		{key: "c", wantSeen: false},
+	}
+	for _, tt := range tests {
+		t.Run("Test key "+tt.key, func(t *testing.T) {
+			if seen, err := s.Seen(ctx, tt.key); err != nil || seen != tt.wantSeen {
+				t.Errorf("Seen(%s) = %v, %v, want %v", tt.key, seen, err, tt.wantSeen)
+			}
+		})
+	}
+}
+
+func TestFileDedupStore_compact(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dedup.log")
+
+	s, err := NewFileDedupStore(path, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFileDedupStore() error = %v", err)
+	}
+	defer s.Close()
+
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < minCompactRecords-1; i++ {
+		_ = s.Complete(ctx, "old")
+	}
+	now = now.Add(time.Hour)
+	_ = s.Complete(ctx, "new")
+
+	if s.records != 1 {
+		t.Errorf("records after compaction = %d, want 1", s.records)
+	}
+	if seen, _ := s.Seen(ctx, "new"); !seen {
+		t.Error("new not seen after compaction")
+	}
+	if seen, _ := s.Seen(ctx, "old"); seen {
+		t.Error("old seen after compaction")
+	}
+
+	// the store keeps appending to the compacted file
+	_ = s.Complete(ctx, "next")
+	s2, err := NewFileDedupStore(path, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFileDedupStore() error = %v", err)
+	}
+	defer s2.Close()
+	s2.now = s.now
+	if seen, _ := s2.Seen(ctx, "next"); !seen {
+		t.Error("next not seen after reopening the compacted file")
+	}
+}
+
+func TestFileDedupStore_compactUniqueKeys(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dedup.log")
+
+	s, err := NewFileDedupStore(path, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFileDedupStore() error = %v", err)
+	}
+	defer s.Close()
+
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	// a key per second, at most 60 of them are live at once
+	for i := 0; i < 10*minCompactRecords; i++ {
+		now = now.Add(time.Second)
+		if err := s.Complete(ctx, fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatalf("Complete() error = %v", err)
+		}
+	}
+
+	if s.records > minCompactRecords {
+		t.Errorf("records = %d, want at most %d", s.records, minCompactRecords)
+	}
+	if len(s.keys) > minCompactRecords {
+		t.Errorf("keys = %d, want at most %d", len(s.keys), minCompactRecords)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if max := int64(minCompactRecords * 64); info.Size() > max {
+		t.Errorf("file size = %d, want at most %d", info.Size(), max)
+	}
+}
+
+func TestFileDedupStore_compactFailure(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dedup.log")
+
+	s, err := NewFileDedupStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileDedupStore() error = %v", err)
+	}
+	defer s.Close()
+
+	// the rewritten file can't be created
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+
+	var compactErr error
+	for i := 0; i < minCompactRecords; i++ {
+		if err := s.Complete(ctx, fmt.Sprintf("key-%d", i)); err != nil {
+			compactErr = err
+		}
+	}
+	if compactErr == nil {
+		t.Fatal("Complete() error = nil, want the compaction error")
+	}
+
+	// the store keeps recording the keys in the old file
+	if err := s.Complete(ctx, "after"); err != nil {
+		t.Fatalf("Complete() after the failed compaction error = %v", err)
+	}
+
+	_ = os.Remove(path + ".tmp")
+	for i := 0; i < minCompactRecords; i++ {
+		if err := s.Complete(ctx, fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatalf("Complete() error = %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	reopened, err := NewFileDedupStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileDedupStore() error = %v", err)
+	}
+	defer reopened.Close()
+
+	for _, key := range []string{"key-0", "after"} {
+		if seen, _ := reopened.Seen(ctx, key); !seen {
+			t.Errorf("Seen(%q) after reopen = false, want true", key)
+		}
+	}
+	// compacted once the directory is gone, the duplicated records are dropped
+	if reopened.records >= 2*minCompactRecords {
+		t.Errorf("records after reopen = %d, want the file compacted", reopened.records)
+	}
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/reyhanfahlevi/pkg/go/log"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+// DedupStore remember the keys of the messages already handled
+type DedupStore interface {
+	// Seen report whether the key was completed and is not expired yet
+	Seen(ctx context.Context, key string) (bool, error)
+	// Complete record the key as handled
+	Complete(ctx context.Context, key string) error
+}
+
+// KeyFunc extract the deduplication key of the message, an empty key skip the deduplication
+type KeyFunc func(ctx context.Context, message adapter.IMessage) string
+
+type idempotency struct {
+	store DedupStore
+	key   KeyFunc
+
+	mu       sync.Mutex
+	inFlight map[string]chan struct{}
+}
+
+// IdempotencyOptions option to modify the idempotency middleware
+type IdempotencyOptions func(*idempotency)
+
+// WithDedupKey set the key of the message, default: the message id
+func WithDedupKey(key KeyFunc) IdempotencyOptions {
+	return func(i *idempotency) {
+		i.key = key
+	}
+}
+
+// Idempotency will skip the messages whose key was already handled, e.g. redelivered or republished duplicates.
+// The key is recorded only after the handler succeeded, so a failed message is retried normally.
+// Keys are scoped by topic and channel so consumers sharing the store don't skip each other messages,
+// and duplicates handled concurrently by the same process wait for the first one to finish
+func Idempotency(store DedupStore, opt ...IdempotencyOptions) adapter.Middleware {
+	i := &idempotency{
+		store:    store,
+		key:      messageID,
+		inFlight: map[string]chan struct{}{},
+	}
+
+	for _, opt := range opt {
+		opt(i)
+	}
+
+	return func(next adapter.Handler) adapter.Handler {
+		return func(ctx context.Context, message adapter.IMessage) error {
+			key := i.key(ctx, message)
+			if key == "" {
+				return next(ctx, message)
+			}
+
+			md, _ := adapter.MetadataFromContext(ctx)
+			key = md.Topic + "/" + md.Channel + "/" + key
+
+			release, err := i.acquire(ctx, key)
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			seen, err := i.store.Seen(ctx, key)
+			if err != nil {
+				return fmt.Errorf("failed to check duplicate %s: %w", key, err)
+			}
+			if seen {
+				log.DebugWithFields("mq: duplicate message skipped", map[string]interface{}{"key": key})
+				return nil
+			}
+
+			if err := next(ctx, message); err != nil {
+				return err
+			}
+
+			// the message is handled already, failing it now would handle it twice
+			if err := i.store.Complete(ctx, key); err != nil {
+				log.Error(fmt.Errorf("failed to record handled message %s: %w", key, err))
+			}
+
+			return nil
+		}
+	}
+}
+
+// acquire wait until no other message with the key is handled by this process
+func (i *idempotency) acquire(ctx context.Context, key string) (func(), error) {
+	for {
+		i.mu.Lock()
+		wait, busy := i.inFlight[key]
+		if !busy {
+			done := make(chan struct{})
+			i.inFlight[key] = done
+			i.mu.Unlock()
+
+			return func() {
+				i.mu.Lock()
+				delete(i.inFlight, key)
+				i.mu.Unlock()
+				close(done)
+			}, nil
+		}
+		i.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func messageID(_ context.Context, message adapter.IMessage) string {
+	return message.GetID()
+}
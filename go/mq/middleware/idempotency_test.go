@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+// idMessage only implement GetID, the other methods are not used by the middleware
+type idMessage struct {
+	adapter.IMessage
+	id string
+}
+
+func (m idMessage) GetID() string {
+	return m.id
+}
+
+func TestIdempotency(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name      string
+		opt       []IdempotencyOptions
+		messages  []idMessage
+		results   []error
+		wantCalls int32
+		wantErrs  int
+	}{
+		{
+			name:      "Test duplicate skipped",
+			messages:  []idMessage{{id: "1"}, {id: "1"}, {id: "2"}},
+			wantCalls: 2,
+		}, {
+			name:      "Test failed message handled again",
+			messages:  []idMessage{{id: "1"}, {id: "1"}, {id: "1"}},
+			results:   []error{errFailed, nil, nil},
+			wantCalls: 2,
+			wantErrs:  1,
+		}, {
+			name:      "Test message without id not deduplicated",
+			messages:  []idMessage{{}, {}},
+			wantCalls: 2,
+		}, {
+			name: "Test custom key",
+			opt: []IdempotencyOptions{WithDedupKey(func(ctx context.Context, message adapter.IMessage) string {
+				return "order-1"
+			})},
+			messages:  []idMessage{{id: "1"}, {id: "2"}},
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			handler := Idempotency(NewMemoryDedupStore(10, time.Hour), tt.opt...)(
+				func(ctx context.Context, message adapter.IMessage) error {
+					n := atomic.AddInt32(&calls, 1)
+					if int(n) <= len(tt.results) {
+						return tt.results[n-1]
+					}
+					return nil
+				})
+
+			errs := 0
+			for _, m := range tt.messages {
+				if err := handler(context.Background(), m); err != nil {
+					errs++
+				}
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("handler calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if errs != tt.wantErrs {
+				t.Errorf("errors = %d, want %d", errs, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func TestIdempotency_scopedByTopic(t *testing.T) {
+	var calls int32
+	handler := Idempotency(NewMemoryDedupStore(10, time.Hour))(func(ctx context.Context, message adapter.IMessage) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+
+	for _, topic := range []string{"orders", "payments", "orders"} {
+		ctx := adapter.WithMetadata(context.Background(), adapter.Metadata{Topic: topic})
+		_ = handler(ctx, idMessage{id: "1"})
+	}
+
+	if calls != 2 {
+		t.Errorf("handler calls = %d, want 2", calls)
+	}
+}
+
+func TestIdempotency_concurrentDuplicates(t *testing.T) {
+	var (
+		calls   int32
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	handler := Idempotency(NewMemoryDedupStore(10, time.Hour))(func(ctx context.Context, message adapter.IMessage) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = handler(context.Background(), idMessage{id: "1"})
+	}()
+
+	<-started
+	go func() {
+		defer wg.Done()
+		_ = handler(context.Background(), idMessage{id: "1"})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("handler calls = %d, want 1", calls)
+	}
+}
@@ -0,0 +1,92 @@
+// Package middleware contains the common adapter.Middleware: panic recovery, logging, tracing and idempotency
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/reyhanfahlevi/pkg/go/log"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/reyhanfahlevi/pkg/go/tracer"
+	"github.com/reyhanfahlevi/pkg/go/tracer/nr"
+)
+
+// Recover will recover the handler panic and return it as *adapter.PanicError,
+// so the message follows the normal requeue path instead of killing the worker
+func Recover() adapter.Middleware {
+	return func(next adapter.Handler) adapter.Handler {
+		return func(ctx context.Context, message adapter.IMessage) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = &adapter.PanicError{Value: r, Stack: debug.Stack()}
+				}
+			}()
+
+			return next(ctx, message)
+		}
+	}
+}
+
+// Logging will log every handled message with its metadata, duration and error
+func Logging() adapter.Middleware {
+	return func(next adapter.Handler) adapter.Handler {
+		return func(ctx context.Context, message adapter.IMessage) error {
+			start := time.Now()
+			err := next(ctx, message)
+
+			fields := map[string]interface{}{}
+			if md, ok := adapter.MetadataFromContext(ctx); ok {
+				fields = md.Fields()
+			}
+			fields["duration"] = time.Since(start).String()
+
+			if err != nil {
+				fields["error"] = err.Error()
+				log.ErrorWithFields("mq: failed to handle message", fields)
+				return err
+			}
+
+			log.DebugWithFields("mq: message handled", fields)
+			return nil
+		}
+	}
+}
+
+// Tracing will start a tracer transaction named mq/<topic> for every message,
+// linked to the publisher trace carried by the message headers
+func Tracing() adapter.Middleware {
+	return func(next adapter.Handler) adapter.Handler {
+		return func(ctx context.Context, message adapter.IMessage) (err error) {
+			md, _ := adapter.MetadataFromContext(ctx)
+
+			txn, ctx := tracer.StartTransactionFromContext(ctx, "mq/"+md.Topic)
+			defer txn.Finish(&err)
+
+			if trace := traceMetadata(message.GetHeaders()); len(trace) > 0 {
+				ctx = nr.SetMetadataToTransaction(ctx, trace)
+			}
+
+			ctx = nr.AddAttribute(ctx, "mq.topic", md.Topic)
+			ctx = nr.AddAttribute(ctx, "mq.channel", md.Channel)
+			ctx = nr.AddAttribute(ctx, "mq.message_id", md.MessageID)
+			ctx = nr.AddAttribute(ctx, "mq.attempts", md.Attempts)
+
+			return next(ctx, message)
+		}
+	}
+}
+
+// traceMetadata convert the string headers into the distributed trace metadata,
+// the keys are canonicalized since brokers keep the case they received
+func traceMetadata(headers map[string]interface{}) http.Header {
+	md := http.Header{}
+	for k, v := range headers {
+		if s, ok := v.(string); ok {
+			md.Set(k, s)
+		}
+	}
+
+	return md
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   adapter.Handler
+		wantPanic bool
+		wantErr   bool
+	}{
+		{
+			name: "Test no panic",
+			handler: func(ctx context.Context, message adapter.IMessage) error {
+				return nil
+			},
+		}, {
+			name: "Test error is kept",
+			handler: func(ctx context.Context, message adapter.IMessage) error {
+				return errors.New("failing")
+			},
+			wantErr: true,
+		}, {
+			name: "Test panic is recovered",
+			handler: func(ctx context.Context, message adapter.IMessage) error {
+				panic("boom")
+			},
+			wantPanic: true,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Recover()(tt.handler)(context.Background(), nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Recover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var panicErr *adapter.PanicError
+			if errors.As(err, &panicErr) != tt.wantPanic {
+				t.Errorf("Recover() error = %v, wantPanic %v", err, tt.wantPanic)
+			}
+			if tt.wantPanic && len(panicErr.Stack) == 0 {
+				t.Error("Recover() panic error without stack")
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mark := func(name string) adapter.Middleware {
+		return func(next adapter.Handler) adapter.Handler {
+			return func(ctx context.Context, message adapter.IMessage) error {
+				calls = append(calls, name)
+				return next(ctx, message)
+			}
+		}
+	}
+
+	handler := adapter.Chain(func(ctx context.Context, message adapter.IMessage) error {
+		calls = append(calls, "handler")
+		return nil
+	}, mark("global"), mark("consumer"))
+
+	_ = handler(context.Background(), nil)
+
+	if want := []string{"global", "consumer", "handler"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
@@ -1,9 +1,25 @@
 package mq
 
-import "github.com/reyhanfahlevi/pkg/go/mq/adapter"
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+)
+
+var (
+	// ErrNoConsumer returned when consuming without consumer adapter
+	ErrNoConsumer = errors.New("mq: no consumer adapter configured")
+
+	// ErrNoPublisher returned when publishing without publisher adapter
+	ErrNoPublisher = errors.New("mq: no publisher adapter configured")
+)
 
 type MessageQueue struct {
-	consumer adapter.IConsumerAdapter
+	consumer    adapter.IConsumerAdapter
+	publisher   adapter.IPublisherAdapter
+	middlewares []adapter.Middleware
 }
 
 type ConsumerConfig struct {
@@ -14,31 +30,138 @@ type ConsumerConfig struct {
 	MaxInFlight int    `json:"max_in_flight,omitempty"`
 	Enable      bool   `json:"enable,omitempty"`
 	URL         string `json:"url"`
+
+	// Timeout of a single handler call in milliseconds, zero means no timeout
+	Timeout int64 `json:"timeout,omitempty"`
+
+	// BatchSize is the max messages of a batch handler call, default: 100
+	BatchSize int `json:"batch_size,omitempty"`
+	// BatchWait is the max milliseconds a batch waits to be full after its first message, zero hands the messages ready
+	BatchWait int64 `json:"batch_wait,omitempty"`
+
 	ExtraConfig map[string]interface{}
 }
 
+// Options option to modify the mq client
+type Options func(*MessageQueue)
+
+// WithPublisher set the publisher adapter used by Publish, PublishWithDelay and PublishBatch
+func WithPublisher(publisher adapter.IPublisherAdapter) Options {
+	return func(mq *MessageQueue) {
+		mq.publisher = publisher
+	}
+}
+
+// WithMiddleware add middlewares wrapping every registered consumer handler,
+// they run before the per-consumer middlewares
+func WithMiddleware(middlewares ...adapter.Middleware) Options {
+	return func(mq *MessageQueue) {
+		mq.middlewares = append(mq.middlewares, middlewares...)
+	}
+}
+
 // New will create mq client that can receive consumer
-// the consumer can be rmq, nsq, or kafka if needed
-func New(consumer adapter.IConsumerAdapter) *MessageQueue {
-	return &MessageQueue{consumer: consumer}
+// the consumer can be rmq, nsq, or kafka if needed.
+// consumer can be nil when the client is only used to publish
+func New(consumer adapter.IConsumerAdapter, opt ...Options) *MessageQueue {
+	mq := &MessageQueue{consumer: consumer}
+
+	for _, opt := range opt {
+		opt(mq)
+	}
+
+	return mq
 }
 
-func (mq *MessageQueue) RegisterConsumerHandler(consumerConfig ConsumerConfig, handler adapter.Handler) error {
-	cfg := adapter.ConsumerHandler{
-		Topic:       consumerConfig.Topic,
-		Channel:     consumerConfig.Channel,
-		Concurrent:  consumerConfig.Concurrent,
-		MaxAttempts: consumerConfig.MaxAttempts,
-		MaxInFlight: consumerConfig.MaxInFlight,
-		Enable:      consumerConfig.Enable,
-		URL:         consumerConfig.URL,
+// RegisterConsumerHandler register the handler to the consumer adapter,
+// wrapped by the global middlewares then by the given middlewares
+func (mq *MessageQueue) RegisterConsumerHandler(consumerConfig ConsumerConfig, handler adapter.Handler, middlewares ...adapter.Middleware) error {
+	if mq.consumer == nil {
+		return ErrNoConsumer
+	}
 
-		Handler: handler,
+	chain := make([]adapter.Middleware, 0, len(mq.middlewares)+len(middlewares))
+	chain = append(chain, mq.middlewares...)
+	chain = append(chain, middlewares...)
+	handler = adapter.Chain(handler, chain...)
+
+	cfg := consumerConfig.consumerHandler()
+	cfg.Handler = handler
+	return mq.consumer.RegisterConsumerHandler(cfg)
+}
+
+// RegisterBatchConsumerHandler register the batch handler to the consumer adapter, it receives up to BatchSize messages
+// at once and each message is acknowledged or requeued with its own result, see adapter.BatchError.
+// The middlewares wrap a single message handler so they don't apply to batch handlers
+func (mq *MessageQueue) RegisterBatchConsumerHandler(consumerConfig ConsumerConfig, handler adapter.BatchHandler) error {
+	if mq.consumer == nil {
+		return ErrNoConsumer
 	}
-	cfg.SetExtraConfig(consumerConfig.ExtraConfig)
+
+	cfg := consumerConfig.consumerHandler()
+	cfg.BatchHandler = handler
 	return mq.consumer.RegisterConsumerHandler(cfg)
 }
 
+func (c ConsumerConfig) consumerHandler() adapter.ConsumerHandler {
+	cfg := adapter.ConsumerHandler{
+		Topic:       c.Topic,
+		Channel:     c.Channel,
+		Concurrent:  c.Concurrent,
+		MaxAttempts: c.MaxAttempts,
+		MaxInFlight: c.MaxInFlight,
+		Enable:      c.Enable,
+		URL:         c.URL,
+		Timeout:     time.Duration(c.Timeout) * time.Millisecond,
+		BatchSize:   c.BatchSize,
+		BatchWait:   time.Duration(c.BatchWait) * time.Millisecond,
+	}
+	cfg.SetExtraConfig(c.ExtraConfig)
+
+	return cfg
+}
+
 func (mq *MessageQueue) RunConsumer() error {
+	if mq.consumer == nil {
+		return ErrNoConsumer
+	}
+
 	return mq.consumer.Run()
 }
+
+// Shutdown stop the consumer adapter and wait for the in-flight handlers until the context is done,
+// unfinished messages are given back to the broker and reported in *adapter.ShutdownError
+func (mq *MessageQueue) Shutdown(ctx context.Context) error {
+	if mq.consumer == nil {
+		return nil
+	}
+
+	return mq.consumer.Shutdown(ctx)
+}
+
+// Publish will publish the body to the topic using the publisher adapter
+func (mq *MessageQueue) Publish(ctx context.Context, topic string, body []byte) error {
+	if mq.publisher == nil {
+		return ErrNoPublisher
+	}
+
+	return mq.publisher.Publish(ctx, topic, body)
+}
+
+// PublishWithDelay will publish the body to the topic, the message is delivered after the delay passed
+func (mq *MessageQueue) PublishWithDelay(ctx context.Context, topic string, body []byte, delay time.Duration) error {
+	if mq.publisher == nil {
+		return ErrNoPublisher
+	}
+
+	return mq.publisher.PublishWithDelay(ctx, topic, body, delay)
+}
+
+// PublishBatch will publish all the bodies to the topic at once
+func (mq *MessageQueue) PublishBatch(ctx context.Context, topic string, bodies [][]byte) error {
+	if mq.publisher == nil {
+		return ErrNoPublisher
+	}
+
+	return mq.publisher.PublishBatch(ctx, topic, bodies)
+}
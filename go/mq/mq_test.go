@@ -0,0 +1,130 @@
+package mq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// stubPublisher record the calls of the mq client, every call fails with err when set
+type stubPublisher struct {
+	err   error
+	calls []string
+}
+
+func (p *stubPublisher) Publish(ctx context.Context, topic string, body []byte) error {
+	p.calls = append(p.calls, fmt.Sprintf("publish %s %s", topic, body))
+	return p.err
+}
+
+func (p *stubPublisher) PublishWithDelay(ctx context.Context, topic string, body []byte, delay time.Duration) error {
+	p.calls = append(p.calls, fmt.Sprintf("publish %s %s after %s", topic, body, delay))
+	return p.err
+}
+
+func (p *stubPublisher) PublishBatch(ctx context.Context, topic string, bodies [][]byte) error {
+	p.calls = append(p.calls, fmt.Sprintf("publish %s %q", topic, bodies))
+	return p.err
+}
+
+func TestMessageQueue_Publish(t *testing.T) {
+	errPublish := errors.New("broker down")
+
+	publish := func(ctx context.Context, mq *MessageQueue) error {
+		return mq.Publish(ctx, "orders", []byte("1"))
+	}
+	publishWithDelay := func(ctx context.Context, mq *MessageQueue) error {
+		return mq.PublishWithDelay(ctx, "orders", []byte("1"), time.Second)
+	}
+	publishBatch := func(ctx context.Context, mq *MessageQueue) error {
+		return mq.PublishBatch(ctx, "orders", [][]byte{[]byte("1"), []byte("2")})
+	}
+
+	tests := []struct {
+		name      string
+		publisher *stubPublisher
+		publish   func(ctx context.Context, mq *MessageQueue) error
+		wantErr   error
+		wantCalls []string
+	}{
+		{
+			name:      "Test publish",
+			publisher: &stubPublisher{},
+			publish:   publish,
+			wantCalls: []string{"publish orders 1"},
+		}, {
+			name:      "Test publish with delay",
+			publisher: &stubPublisher{},
+			publish:   publishWithDelay,
+			wantCalls: []string{"publish orders 1 after 1s"},
+		}, {
+			name:      "Test publish batch",
+			publisher: &stubPublisher{},
+			publish:   publishBatch,
+			wantCalls: []string{`publish orders ["1" "2"]`},
+		}, {
+			name:      "Test publish error of the adapter",
+			publisher: &stubPublisher{err: errPublish},
+			publish:   publish,
+			wantErr:   errPublish,
+			wantCalls: []string{"publish orders 1"},
+		}, {
+			name:    "Test publish without publisher",
+			publish: publish,
+			wantErr: ErrNoPublisher,
+		}, {
+			name:    "Test publish with delay without publisher",
+			publish: publishWithDelay,
+			wantErr: ErrNoPublisher,
+		}, {
+			name:    "Test publish batch without publisher",
+			publish: publishBatch,
+			wantErr: ErrNoPublisher,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opt []Options
+			if tt.publisher != nil {
+				opt = append(opt, WithPublisher(tt.publisher))
+			}
+			mq := New(nil, opt...)
+
+			if err := tt.publish(context.Background(), mq); !errors.Is(err, tt.wantErr) {
+				t.Errorf("publish error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.publisher == nil {
+				return
+			}
+			if fmt.Sprint(tt.publisher.calls) != fmt.Sprint(tt.wantCalls) {
+				t.Errorf("publisher calls = %v, want %v", tt.publisher.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestConsumerConfig_Timeout(t *testing.T) {
+	var cfg ConsumerConfig
+	if err := json.Unmarshal([]byte(`{"topic":"orders","timeout":1500}`), &cfg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	if got := cfg.consumerHandler().Timeout; got != 1500*time.Millisecond {
+		t.Errorf("Timeout = %s, want 1.5s", got)
+	}
+}
+
+func TestConsumerConfig_BatchWait(t *testing.T) {
+	var cfg ConsumerConfig
+	if err := json.Unmarshal([]byte(`{"topic":"orders","batch_size":10,"batch_wait":250}`), &cfg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	if got := cfg.consumerHandler().BatchWait; got != 250*time.Millisecond {
+		t.Errorf("BatchWait = %s, want 250ms", got)
+	}
+}
@@ -0,0 +1,283 @@
+// Package outbox publish mq messages only when the database transaction writing them commits:
+// Add writes the message into the outbox table within the caller transaction,
+// and the Relay polls the table, publishes the pending messages and marks them sent
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialect describe the SQL differences between the databases
+type Dialect struct {
+	// Placeholder return the bind parameter n starting at 1, nil means "?"
+	Placeholder func(n int) string
+
+	// Lock is appended to the select of the pending messages so concurrent relays skip the rows locked by each other
+	Lock string
+
+	// Schema create the outbox table when it doesn't exist, %[1]s is the table name
+	Schema []string
+}
+
+var (
+	// SQLite dialect, a single relay must run since SQLite has no row lock
+	SQLite = Dialect{
+		Schema: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				topic TEXT NOT NULL,
+				body BLOB NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				last_error TEXT NOT NULL DEFAULT '',
+				created_at BIGINT NOT NULL,
+				available_at BIGINT NOT NULL,
+				sent_at BIGINT,
+				failed_at BIGINT
+			)`,
+			`CREATE INDEX IF NOT EXISTS %[1]s_pending_idx ON %[1]s (sent_at, available_at)`,
+		},
+	}
+
+	// MySQL dialect, row lock requires MySQL 8
+	MySQL = Dialect{
+		Lock: "FOR UPDATE SKIP LOCKED",
+		Schema: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s (
+				id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				topic VARCHAR(255) NOT NULL,
+				body LONGBLOB NOT NULL,
+				attempts INT NOT NULL DEFAULT 0,
+				last_error VARCHAR(1024) NOT NULL DEFAULT '',
+				created_at BIGINT NOT NULL,
+				available_at BIGINT NOT NULL,
+				sent_at BIGINT NULL,
+				failed_at BIGINT NULL,
+				INDEX %[1]s_pending_idx (sent_at, available_at)
+			)`,
+		},
+	}
+
+	// Postgres dialect
+	Postgres = Dialect{
+		Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		Lock:        "FOR UPDATE SKIP LOCKED",
+		Schema: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s (
+				id BIGSERIAL PRIMARY KEY,
+				topic TEXT NOT NULL,
+				body BYTEA NOT NULL,
+				attempts INT NOT NULL DEFAULT 0,
+				last_error TEXT NOT NULL DEFAULT '',
+				created_at BIGINT NOT NULL,
+				available_at BIGINT NOT NULL,
+				sent_at BIGINT,
+				failed_at BIGINT
+			)`,
+			`CREATE INDEX IF NOT EXISTS %[1]s_pending_idx ON %[1]s (sent_at, available_at)`,
+		},
+	}
+)
+
+// maxLastErrorLength fit the last_error column of every dialect
+const maxLastErrorLength = 1024
+
+// Execer is implemented by *sql.Tx, *sql.DB and *sql.Conn
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Outbox is the outbox table, the times are stored as unix milliseconds so every dialect works the same
+type Outbox struct {
+	db      *sql.DB
+	table   string
+	dialect Dialect
+	now     func() time.Time
+}
+
+// Options option to modify the outbox
+type Options func(*Outbox)
+
+// WithTable set the outbox table name, default: mq_outbox
+func WithTable(table string) Options {
+	return func(o *Outbox) {
+		o.table = table
+	}
+}
+
+// WithDialect set the database dialect, default: SQLite
+func WithDialect(dialect Dialect) Options {
+	return func(o *Outbox) {
+		o.dialect = dialect
+	}
+}
+
+// New will create the outbox on the database
+func New(db *sql.DB, opt ...Options) *Outbox {
+	o := &Outbox{
+		db:      db,
+		table:   "mq_outbox",
+		dialect: SQLite,
+		now:     time.Now,
+	}
+
+	for _, opt := range opt {
+		opt(o)
+	}
+
+	return o
+}
+
+// Migrate create the outbox table when it doesn't exist
+func (o *Outbox) Migrate(ctx context.Context) error {
+	for _, schema := range o.dialect.Schema {
+		if _, err := o.db.ExecContext(ctx, fmt.Sprintf(schema, o.table)); err != nil {
+			return fmt.Errorf("failed to create outbox table %s: %w", o.table, err)
+		}
+	}
+
+	return nil
+}
+
+// Add write the message in the caller transaction, the relay publishes it once the transaction committed
+func (o *Outbox) Add(ctx context.Context, tx Execer, topic string, body []byte) error {
+	return o.AddWithDelay(ctx, tx, topic, body, 0)
+}
+
+// AddWithDelay write the message in the caller transaction, the relay publishes it once the delay passed
+func (o *Outbox) AddWithDelay(ctx context.Context, tx Execer, topic string, body []byte, delay time.Duration) error {
+	now := o.now()
+	if body == nil {
+		body = []byte{}
+	}
+
+	_, err := tx.ExecContext(ctx,
+		o.query("INSERT INTO %s (topic, body, created_at, available_at) VALUES (?, ?, ?, ?)"),
+		topic, body, now.UnixMilli(), now.Add(delay).UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add %s message to the outbox: %w", topic, err)
+	}
+
+	return nil
+}
+
+// Pending return the number of messages not sent yet, including the ones waiting for their retry,
+// the messages that failed for good are counted by Failed
+func (o *Outbox) Pending(ctx context.Context) (int, error) {
+	var n int
+	err := o.db.QueryRowContext(ctx, o.query("SELECT COUNT(*) FROM %s WHERE sent_at IS NULL AND failed_at IS NULL")).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count pending outbox messages: %w", err)
+	}
+
+	return n, nil
+}
+
+// Failed return the number of messages the relay gave up on after the max attempts
+func (o *Outbox) Failed(ctx context.Context) (int, error) {
+	var n int
+	err := o.db.QueryRowContext(ctx, o.query("SELECT COUNT(*) FROM %s WHERE failed_at IS NOT NULL")).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count failed outbox messages: %w", err)
+	}
+
+	return n, nil
+}
+
+// FailedMessage is a message the relay gave up on after the max attempts
+type FailedMessage struct {
+	ID        int64
+	Topic     string
+	Body      []byte
+	Attempts  int32
+	LastError string
+	FailedAt  time.Time
+}
+
+// ListFailed return up to limit failed messages, oldest first, limit <= 0 return all of them
+func (o *Outbox) ListFailed(ctx context.Context, limit int) ([]FailedMessage, error) {
+	query := "SELECT id, topic, body, attempts, last_error, failed_at FROM %s WHERE failed_at IS NOT NULL ORDER BY id"
+	var args []interface{}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := o.db.QueryContext(ctx, o.query(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read failed outbox messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []FailedMessage
+	for rows.Next() {
+		var (
+			m        FailedMessage
+			failedAt int64
+		)
+		if err := rows.Scan(&m.ID, &m.Topic, &m.Body, &m.Attempts, &m.LastError, &failedAt); err != nil {
+			return nil, fmt.Errorf("failed to read failed outbox messages: %w", err)
+		}
+		m.FailedAt = time.UnixMilli(failedAt)
+		messages = append(messages, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read failed outbox messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// RetryFailed put the failed messages back to pending with fresh attempts, it return the number of messages retried
+func (o *Outbox) RetryFailed(ctx context.Context) (int64, error) {
+	res, err := o.db.ExecContext(ctx,
+		o.query("UPDATE %s SET failed_at = NULL, attempts = 0, available_at = ? WHERE failed_at IS NOT NULL"),
+		o.now().UnixMilli(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retry failed outbox messages: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// Purge delete the messages sent before the retention, it return the number of deleted messages
+func (o *Outbox) Purge(ctx context.Context, retention time.Duration) (int64, error) {
+	res, err := o.db.ExecContext(ctx,
+		o.query("DELETE FROM %s WHERE sent_at IS NOT NULL AND sent_at < ?"),
+		o.now().Add(-retention).UnixMilli(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge outbox: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// query put the table name and the dialect placeholders into the query written with "?"
+func (o *Outbox) query(query string) string {
+	query = fmt.Sprintf(query, o.table)
+	if o.dialect.Placeholder == nil {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+
+		n++
+		b.WriteString(o.dialect.Placeholder(n))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,399 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	_ "modernc.org/sqlite"
+)
+
+func newTestOutbox(t *testing.T) (*Outbox, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	// SQLite allows a single writer
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	o := New(db)
+	if err := o.Migrate(context.Background()); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	return o, db
+}
+
+// recorder is a Publisher recording the published messages, failing the topics in fail
+type recorder struct {
+	mu        sync.Mutex
+	fail      map[string]bool
+	published []string
+}
+
+func (r *recorder) Publish(ctx context.Context, topic string, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fail[topic] {
+		return errors.New("broker unavailable")
+	}
+
+	r.published = append(r.published, topic+":"+string(body))
+	return nil
+}
+
+func (r *recorder) Published() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.published...)
+}
+
+func TestOutbox_Add(t *testing.T) {
+	tests := []struct {
+		name        string
+		commit      bool
+		wantPending int
+	}{
+		{
+			name:        "Test message added on commit",
+			commit:      true,
+			wantPending: 1,
+		}, {
+			name:        "Test message dropped on rollback",
+			commit:      false,
+			wantPending: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			o, db := newTestOutbox(t)
+
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if err := o.Add(ctx, tx, "orders", []byte("1")); err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+
+			if tt.commit {
+				err = tx.Commit()
+			} else {
+				err = tx.Rollback()
+			}
+			if err != nil {
+				t.Fatalf("end transaction error = %v", err)
+			}
+
+			if pending, _ := o.Pending(ctx); pending != tt.wantPending {
+				t.Errorf("Pending() = %d, want %d", pending, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestRelay_Relay(t *testing.T) {
+	ctx := context.Background()
+	o, db := newTestOutbox(t)
+
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	o.now = func() time.Time { return now }
+
+	for _, topic := range []string{"orders", "payments", "orders"} {
+		if err := o.Add(ctx, db, topic, []byte("1")); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	_ = o.AddWithDelay(ctx, db, "orders", []byte("delayed"), time.Minute)
+
+	pub := &recorder{fail: map[string]bool{"payments": true}}
+	r := NewRelay(o, pub, WithRetryPolicy(adapter.FixedBackoff{Delay: 10 * time.Second}))
+
+	n, err := r.Relay(ctx)
+	if err != nil || n != 3 {
+		t.Fatalf("Relay() = %d, %v, want 3 processed", n, err)
+	}
+	if got := pub.Published(); len(got) != 2 {
+		t.Errorf("published = %v, want the 2 orders", got)
+	}
+
+	var (
+		attempts  int
+		lastError string
+	)
+	err = db.QueryRow("SELECT attempts, last_error FROM mq_outbox WHERE topic = 'payments'").Scan(&attempts, &lastError)
+	if err != nil || attempts != 1 || lastError != "broker unavailable" {
+		t.Errorf("failed message attempts = %d, last error = %q, err = %v", attempts, lastError, err)
+	}
+
+	// the failed message waits for its backoff, the delayed one for its delay
+	if n, _ := r.Relay(ctx); n != 0 {
+		t.Errorf("Relay() before backoff = %d, want 0", n)
+	}
+
+	now = now.Add(time.Minute)
+	pub.fail = nil
+	if n, _ := r.Relay(ctx); n != 2 {
+		t.Errorf("Relay() after backoff = %d, want 2", n)
+	}
+	if pending, _ := o.Pending(ctx); pending != 0 {
+		t.Errorf("Pending() = %d, want 0", pending)
+	}
+
+	now = now.Add(time.Hour)
+	if purged, err := o.Purge(ctx, time.Minute); err != nil || purged != 4 {
+		t.Errorf("Purge() = %d, %v, want 4", purged, err)
+	}
+}
+
+func TestRelay_Run(t *testing.T) {
+	ctx := context.Background()
+	o, db := newTestOutbox(t)
+
+	pub := &recorder{}
+	r := NewRelay(o, pub, WithInterval(10*time.Millisecond), WithBatchSize(2))
+	if err := r.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		_ = o.Add(ctx, db, "orders", []byte("1"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pub.Published()) < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := r.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if got := len(pub.Published()); got != 5 {
+		t.Errorf("published = %d, want 5", got)
+	}
+	if err := r.Run(); err == nil {
+		t.Error("Run() after Shutdown error = nil, want error")
+	}
+}
+
+func TestRelay_MaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	o, db := newTestOutbox(t)
+
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	o.now = func() time.Time { return now }
+
+	_ = o.Add(ctx, db, "payments", []byte("1"))
+	_ = o.Add(ctx, db, "orders", []byte("2"))
+
+	pub := &recorder{fail: map[string]bool{"payments": true}}
+	r := NewRelay(o, pub, WithRetryPolicy(adapter.FixedBackoff{Delay: 10 * time.Second}), WithMaxAttempts(2))
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.Relay(ctx); err != nil {
+			t.Fatalf("Relay() error = %v", err)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	if pending, _ := o.Pending(ctx); pending != 0 {
+		t.Errorf("Pending() = %d, want 0", pending)
+	}
+	if failed, _ := o.Failed(ctx); failed != 1 {
+		t.Errorf("Failed() = %d, want 1", failed)
+	}
+
+	failed, err := o.ListFailed(ctx, 10)
+	if err != nil || len(failed) != 1 {
+		t.Fatalf("ListFailed() = %+v, %v, want the payments message", failed, err)
+	}
+	if got := failed[0]; got.Topic != "payments" || got.Attempts != 2 || got.LastError != "broker unavailable" || got.FailedAt.IsZero() {
+		t.Errorf("ListFailed() = %+v, want payments failed after 2 attempts", got)
+	}
+
+	// the failed message is published again only once retried
+	pub.fail = nil
+	if n, _ := r.Relay(ctx); n != 0 {
+		t.Errorf("Relay() of a failed message = %d, want 0", n)
+	}
+	if retried, err := o.RetryFailed(ctx); err != nil || retried != 1 {
+		t.Errorf("RetryFailed() = %d, %v, want 1", retried, err)
+	}
+	if n, _ := r.Relay(ctx); n != 1 {
+		t.Errorf("Relay() after RetryFailed() = %d, want 1", n)
+	}
+	if got := pub.Published(); len(got) != 2 || got[1] != "payments:1" {
+		t.Errorf("published = %v, want payments published last", got)
+	}
+}
+
+// blockingPublisher block every publish until its context is done
+type blockingPublisher struct {
+	started chan struct{}
+	once    sync.Once
+}
+
+func (p *blockingPublisher) Publish(ctx context.Context, topic string, body []byte) error {
+	p.once.Do(func() { close(p.started) })
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRelay_ShutdownInterruptsPublish(t *testing.T) {
+	ctx := context.Background()
+	o, db := newTestOutbox(t)
+	_ = o.Add(ctx, db, "orders", []byte("1"))
+
+	pub := &blockingPublisher{started: make(chan struct{})}
+	r := NewRelay(o, pub, WithInterval(10*time.Millisecond))
+	if err := r.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	select {
+	case <-pub.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the relay didn't publish")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want context.DeadlineExceeded", err)
+	}
+
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the publish in progress was not cancelled")
+	}
+
+	// the interrupted publish is not counted as an attempt
+	var attempts int
+	if err := db.QueryRow("SELECT attempts FROM mq_outbox").Scan(&attempts); err != nil || attempts != 0 {
+		t.Errorf("attempts = %d, %v, want 0", attempts, err)
+	}
+	if pending, _ := o.Pending(ctx); pending != 1 {
+		t.Errorf("Pending() = %d, want 1", pending)
+	}
+}
+
+func TestRelay_PublishOutsideTransaction(t *testing.T) {
+	ctx := context.Background()
+	o, db := newTestOutbox(t)
+	_ = o.Add(ctx, db, "orders", []byte("1"))
+
+	// SQLite has a single connection, an Add during the publish blocks while the relay holds a transaction
+	pub := PublisherFunc(func(ctx context.Context, topic string, body []byte) error {
+		addCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+
+		return o.Add(addCtx, db, "payments", body)
+	})
+
+	n, err := NewRelay(o, pub).Relay(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("Relay() = %d, %v, want 1 processed", n, err)
+	}
+
+	var sent, added int
+	err = db.QueryRow("SELECT COUNT(sent_at), COUNT(CASE WHEN topic = 'payments' THEN 1 END) FROM mq_outbox").Scan(&sent, &added)
+	if err != nil || sent != 1 || added != 1 {
+		t.Errorf("sent = %d, added = %d, err = %v, want the orders message sent and the payments one added", sent, added, err)
+	}
+}
+
+func TestRelay_CancelledAfterPublish(t *testing.T) {
+	o, db := newTestOutbox(t)
+	_ = o.Add(context.Background(), db, "orders", []byte("1"))
+	_ = o.Add(context.Background(), db, "orders", []byte("2"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pub := &recorder{}
+	first := PublisherFunc(func(ctx context.Context, topic string, body []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// cancelled right after the broker took the message
+		defer cancel()
+		return pub.Publish(ctx, topic, body)
+	})
+
+	r := NewRelay(o, first)
+	if n, err := r.Relay(ctx); !errors.Is(err, context.Canceled) || n != 1 {
+		t.Fatalf("Relay() = %d, %v, want 1 processed and context.Canceled", n, err)
+	}
+
+	// the published message stays sent, the other one is released right away
+	if n, err := NewRelay(o, pub).Relay(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Relay() after cancel = %d, %v, want 1 processed", n, err)
+	}
+	if got := pub.Published(); len(got) != 2 || got[0] != "orders:1" || got[1] != "orders:2" {
+		t.Errorf("published = %v, want each message once", got)
+	}
+}
+
+func TestRelay_Lease(t *testing.T) {
+	ctx := context.Background()
+	o, db := newTestOutbox(t)
+
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	o.now = func() time.Time { return now }
+	_ = o.Add(ctx, db, "orders", []byte("1"))
+
+	r := NewRelay(o, &recorder{}, WithLease(time.Minute))
+	messages, err := r.claim(ctx)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("claim() = %v, %v, want the message", messages, err)
+	}
+
+	// another relay skips the claimed message until the lease expired
+	if n, _ := r.Relay(ctx); n != 0 {
+		t.Errorf("Relay() of a claimed message = %d, want 0", n)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if n, _ := r.Relay(ctx); n != 1 {
+		t.Errorf("Relay() after the lease = %d, want 1", n)
+	}
+}
+
+func TestOutbox_query(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		want    string
+	}{
+		{
+			name:    "Test question mark placeholders",
+			dialect: SQLite,
+			want:    "UPDATE mq_outbox SET sent_at = ? WHERE id = ?",
+		}, {
+			name:    "Test postgres placeholders",
+			dialect: Postgres,
+			want:    "UPDATE mq_outbox SET sent_at = $1 WHERE id = $2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := New(nil, WithDialect(tt.dialect))
+			if got := o.query("UPDATE %s SET sent_at = ? WHERE id = ?"); got != tt.want {
+				t.Errorf("query() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
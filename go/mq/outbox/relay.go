@@ -0,0 +1,355 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/reyhanfahlevi/pkg/go/log"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/reyhanfahlevi/pkg/go/nsq"
+)
+
+// Publisher publish the outbox messages, it is implemented by mq.MessageQueue and every adapter.IPublisherAdapter
+type Publisher interface {
+	Publish(ctx context.Context, topic string, body []byte) error
+}
+
+// PublisherFunc adapt a function into Publisher
+type PublisherFunc func(ctx context.Context, topic string, body []byte) error
+
+// Publish call the function
+func (f PublisherFunc) Publish(ctx context.Context, topic string, body []byte) error {
+	return f(ctx, topic, body)
+}
+
+// NSQPublisher adapt nsq.Publisher, the body and the topic are published as is without the publisher prefix
+func NSQPublisher(p *nsq.Publisher) Publisher {
+	return PublisherFunc(func(ctx context.Context, topic string, body []byte) error {
+		return p.PublishRaw(topic, body)
+	})
+}
+
+// Relay publish the pending outbox messages, a failed message is retried later following the retry policy
+// until the max attempts, then it is marked failed
+type Relay struct {
+	outbox    *Outbox
+	publisher Publisher
+
+	interval    time.Duration
+	batchSize   int
+	lease       time.Duration
+	retryPolicy adapter.RetryPolicy
+	maxAttempts int32
+
+	// ctx is passed to the publisher by Run, cancelled once the shutdown gave up waiting
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	running  bool
+	closed   bool
+	shutdown chan struct{}
+	done     chan struct{}
+}
+
+// RelayOptions option to modify the relay
+type RelayOptions func(*Relay)
+
+// WithInterval set how often the outbox is polled, default: 1 second
+func WithInterval(interval time.Duration) RelayOptions {
+	return func(r *Relay) {
+		r.interval = interval
+	}
+}
+
+// WithBatchSize set the number of messages published per poll, default: 100
+func WithBatchSize(size int) RelayOptions {
+	return func(r *Relay) {
+		r.batchSize = size
+	}
+}
+
+// WithLease set how long the messages claimed by a poll are hidden from the other relays while they are published,
+// it must be longer than publishing a batch. A message not recorded when it expired is published again, default: 1 minute
+func WithLease(lease time.Duration) RelayOptions {
+	return func(r *Relay) {
+		r.lease = lease
+	}
+}
+
+// WithRetryPolicy set the delay before publishing a failed message again,
+// default: exponential from 1 second up to 5 minutes with jitter
+func WithRetryPolicy(policy adapter.RetryPolicy) RelayOptions {
+	return func(r *Relay) {
+		r.retryPolicy = policy
+	}
+}
+
+// WithMaxAttempts set the publish attempts of a message before it is marked failed,
+// default: 20, about an hour with the default retry policy. n <= 0 retries forever
+func WithMaxAttempts(n int32) RelayOptions {
+	return func(r *Relay) {
+		r.maxAttempts = n
+	}
+}
+
+// NewRelay will create the relay of the outbox
+func NewRelay(outbox *Outbox, publisher Publisher, opt ...RelayOptions) *Relay {
+	r := &Relay{
+		outbox:    outbox,
+		publisher: publisher,
+		interval:  time.Second,
+		batchSize: 100,
+		lease:     time.Minute,
+		retryPolicy: adapter.ExponentialBackoff{
+			Base:   time.Second,
+			Max:    5 * time.Minute,
+			Jitter: true,
+		},
+		maxAttempts: 20,
+		shutdown:    make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opt {
+		opt(r)
+	}
+
+	if r.batchSize < 1 {
+		r.batchSize = 1
+	}
+
+	return r
+}
+
+// Run start polling the outbox in background until Shutdown
+func (r *Relay) Run() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return fmt.Errorf("relay is shut down")
+	}
+	if r.running {
+		return fmt.Errorf("relay already running")
+	}
+	r.running = true
+
+	go r.loop()
+	return nil
+}
+
+func (r *Relay) loop() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.drain()
+
+		select {
+		case <-r.shutdown:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain relay full batches until the ready messages are exhausted or the relay shuts down
+func (r *Relay) drain() {
+	for {
+		select {
+		case <-r.shutdown:
+			return
+		default:
+		}
+
+		n, err := r.Relay(r.ctx)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+
+		if n < r.batchSize {
+			return
+		}
+	}
+}
+
+// Relay publish one batch of the ready messages, it return the number of messages processed.
+// The batch is claimed for the lease in a short transaction, then each message is published
+// and its result recorded on its own, no transaction is held while publishing.
+// A message failing to publish is kept with its error and retried once the retry policy delay passed,
+// it is marked failed once it reached the max attempts. When ctx is done the messages not published yet are released
+func (r *Relay) Relay(ctx context.Context) (int, error) {
+	messages, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// the result of a publish is recorded even once ctx is done, a published message must be marked sent
+	recordCtx := context.WithoutCancel(ctx)
+
+	for i, m := range messages {
+		pubErr := r.publisher.Publish(ctx, m.topic, m.body)
+		if pubErr != nil && ctx.Err() != nil {
+			// the publish was interrupted, not a failure of the message
+			r.release(recordCtx, messages[i:])
+			return i, fmt.Errorf("outbox relay interrupted: %w", ctx.Err())
+		}
+
+		if err := r.record(recordCtx, m, pubErr); err != nil {
+			// the claim of the messages left expire with the lease
+			return i, err
+		}
+	}
+
+	return len(messages), nil
+}
+
+// claim read the ready messages and hide them from the other relays until the lease expired
+func (r *Relay) claim(ctx context.Context) ([]message, error) {
+	o := r.outbox
+
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin outbox transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	messages, err := r.ready(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseEnd := o.now().Add(r.lease).UnixMilli()
+	for _, m := range messages {
+		if _, err := tx.ExecContext(ctx, o.query("UPDATE %s SET available_at = ? WHERE id = ?"), leaseEnd, m.id); err != nil {
+			return nil, fmt.Errorf("failed to claim outbox message %d: %w", m.id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit outbox transaction: %w", err)
+	}
+
+	return messages, nil
+}
+
+// record mark the message sent, or keep its error and schedule the next attempt until the max attempts
+func (r *Relay) record(ctx context.Context, m message, pubErr error) error {
+	o := r.outbox
+	now := o.now()
+
+	var err error
+	if pubErr == nil {
+		_, err = o.db.ExecContext(ctx, o.query("UPDATE %s SET sent_at = ? WHERE id = ?"), now.UnixMilli(), m.id)
+	} else {
+		attempts := m.attempts + 1
+		log.Error(fmt.Errorf("failed to publish outbox message %d to %s, attempts %d: %w", m.id, m.topic, attempts, pubErr))
+
+		lastError := pubErr.Error()
+		if len(lastError) > maxLastErrorLength {
+			lastError = lastError[:maxLastErrorLength]
+		}
+
+		if r.maxAttempts > 0 && attempts >= r.maxAttempts {
+			log.Error(fmt.Errorf("outbox message %d to %s failed after %d attempts", m.id, m.topic, attempts))
+			_, err = o.db.ExecContext(ctx,
+				o.query("UPDATE %s SET attempts = ?, last_error = ?, failed_at = ? WHERE id = ?"),
+				attempts, lastError, now.UnixMilli(), m.id,
+			)
+		} else {
+			_, err = o.db.ExecContext(ctx,
+				o.query("UPDATE %s SET attempts = ?, last_error = ?, available_at = ? WHERE id = ?"),
+				attempts, lastError, now.Add(r.retryPolicy.Backoff(attempts)).UnixMilli(), m.id,
+			)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to update outbox message %d: %w", m.id, err)
+	}
+
+	return nil
+}
+
+// release make the claimed messages ready again without counting an attempt
+func (r *Relay) release(ctx context.Context, messages []message) {
+	o := r.outbox
+
+	for _, m := range messages {
+		_, err := o.db.ExecContext(ctx, o.query("UPDATE %s SET available_at = ? WHERE id = ?"), o.now().UnixMilli(), m.id)
+		if err != nil {
+			log.Error(fmt.Errorf("failed to release outbox message %d: %w", m.id, err))
+		}
+	}
+}
+
+type message struct {
+	id       int64
+	topic    string
+	body     []byte
+	attempts int32
+}
+
+func (r *Relay) ready(ctx context.Context, tx *sql.Tx) ([]message, error) {
+	o := r.outbox
+
+	query := o.query("SELECT id, topic, body, attempts FROM %s WHERE sent_at IS NULL AND failed_at IS NULL AND available_at <= ? ORDER BY id LIMIT ?")
+	if o.dialect.Lock != "" {
+		query += " " + o.dialect.Lock
+	}
+
+	rows, err := tx.QueryContext(ctx, query, o.now().UnixMilli(), r.batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []message
+	for rows.Next() {
+		var m message
+		if err := rows.Scan(&m.id, &m.topic, &m.body, &m.attempts); err != nil {
+			return nil, fmt.Errorf("failed to read outbox: %w", err)
+		}
+		messages = append(messages, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+
+	return messages, nil
+}
+
+// Shutdown stop polling and wait for the current batch until the context is done,
+// then the publish in progress is cancelled and the messages not published yet released. The relay can't run again
+func (r *Relay) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	running := r.running
+	if !r.closed {
+		r.closed = true
+		close(r.shutdown)
+	}
+	r.mu.Unlock()
+
+	if !running {
+		r.cancel()
+		return nil
+	}
+
+	select {
+	case <-r.done:
+		r.cancel()
+		return nil
+	case <-ctx.Done():
+		r.cancel()
+		return fmt.Errorf("outbox relay shutdown: %w", ctx.Err())
+	}
+}
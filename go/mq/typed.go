@@ -0,0 +1,58 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/reyhanfahlevi/pkg/go/mq/codec"
+)
+
+// TypedHandler will decode the body into T before calling fn.
+// A body that can't be decoded will never succeed, so it is dead-lettered through adapter.Permanent
+// instead of being retried until MaxAttempts
+func TypedHandler[T any](c codec.Codec, fn func(ctx context.Context, payload T, message adapter.IMessage) error) adapter.Handler {
+	return func(ctx context.Context, message adapter.IMessage) error {
+		payload, err := decode[T](c, message.GetBody())
+		if err != nil {
+			return adapter.Permanent(fmt.Errorf("mq: failed to decode message: %w", err))
+		}
+
+		return fn(ctx, payload, message)
+	}
+}
+
+// decode unmarshal into a new T, a pointer T like *pb.Order is allocated so protobuf messages work
+func decode[T any](c codec.Codec, body []byte) (T, error) {
+	var payload T
+
+	if t := reflect.TypeOf(payload); t != nil && t.Kind() == reflect.Ptr {
+		payload = reflect.New(t.Elem()).Interface().(T)
+		return payload, c.Unmarshal(body, payload)
+	}
+
+	return payload, c.Unmarshal(body, &payload)
+}
+
+// PublishTyped will encode the payload with the codec and publish it to the topic,
+// the codec content type is sent by the adapters supporting it
+func PublishTyped[T any](ctx context.Context, mq *MessageQueue, c codec.Codec, topic string, payload T) error {
+	body, err := c.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("mq: failed to encode message: %w", err)
+	}
+
+	return mq.Publish(adapter.WithContentType(ctx, c.ContentType()), topic, body)
+}
+
+// PublishTypedWithDelay will encode the payload with the codec and publish it to the topic after the delay
+func PublishTypedWithDelay[T any](ctx context.Context, mq *MessageQueue, c codec.Codec, topic string, payload T, delay time.Duration) error {
+	body, err := c.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("mq: failed to encode message: %w", err)
+	}
+
+	return mq.PublishWithDelay(adapter.WithContentType(ctx, c.ContentType()), topic, body, delay)
+}
@@ -0,0 +1,55 @@
+package mq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter/mema"
+	"github.com/reyhanfahlevi/pkg/go/mq/codec"
+)
+
+type order struct {
+	ID int64 `json:"id"`
+}
+
+func TestTypedHandler(t *testing.T) {
+	broker := mema.NewBroker()
+	client := New(broker, WithPublisher(broker))
+
+	var got []int64
+	var contentTypes []string
+	err := client.RegisterConsumerHandler(ConsumerConfig{Topic: "orders", MaxAttempts: 5, Enable: true},
+		TypedHandler(codec.JSON, func(ctx context.Context, payload *order, message adapter.IMessage) error {
+			got = append(got, payload.ID)
+			contentTypes = append(contentTypes, message.GetContentType())
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("RegisterConsumerHandler() error = %v", err)
+	}
+
+	if err := client.RunConsumer(); err != nil {
+		t.Fatalf("RunConsumer() error = %v", err)
+	}
+	defer broker.Close()
+
+	if err := PublishTyped(context.Background(), client, codec.JSON, "orders", order{ID: 7}); err != nil {
+		t.Fatalf("PublishTyped() error = %v", err)
+	}
+	_ = client.Publish(context.Background(), "orders", []byte("not json"))
+	broker.Flush()
+
+	if len(got) != 1 || got[0] != 7 {
+		t.Errorf("handled = %v, want [7]", got)
+	}
+	if len(contentTypes) != 1 || contentTypes[0] != "application/json" {
+		t.Errorf("content types = %v, want [application/json]", contentTypes)
+	}
+
+	dead := broker.DeadLettered("orders")
+	if len(dead) != 1 || dead[0].Attempts != 1 {
+		t.Errorf("dead lettered = %+v, want the invalid message after 1 attempt", dead)
+	}
+}
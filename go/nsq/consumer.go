@@ -10,6 +10,10 @@ import (
 	"time"
 
 	"github.com/nsqio/go-nsq"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/reyhanfahlevi/pkg/go/mq/metrics"
+	"github.com/reyhanfahlevi/pkg/go/tracer"
+	"github.com/reyhanfahlevi/pkg/go/tracer/nr"
 )
 
 // Consumer instance
@@ -18,8 +22,11 @@ type Consumer struct {
 	prefix        string
 
 	handlers     []ConsumerHandler
+	counters     []*metrics.Counters
 	nsqConsumers []*nsq.Consumer
 	stopTimeout  time.Duration
+	failFast     bool
+	sink         metrics.Sink
 }
 
 // ConsumerConfig config for the consumer instance
@@ -27,6 +34,12 @@ type ConsumerConfig struct {
 	ListenAddress []string
 	Prefix        string
 	StopTimeout   time.Duration
+
+	// FailFast raise the handler panic again after logging it instead of requeueing the message
+	FailFast bool
+
+	// Metrics receive the handler metrics, optional
+	Metrics metrics.Sink
 }
 
 // ConsumerHandler handler for consumer
@@ -46,6 +59,8 @@ func NewConsumer(cfg ConsumerConfig) *Consumer {
 	return &Consumer{
 		listenAddress: cfg.ListenAddress,
 		prefix:        cfg.Prefix,
+		failFast:      cfg.FailFast,
+		sink:          cfg.Metrics,
 	}
 }
 
@@ -53,12 +68,13 @@ func NewConsumer(cfg ConsumerConfig) *Consumer {
 func (c *Consumer) RegisterHandler(handler ConsumerHandler) {
 	if handler.Enable {
 		c.handlers = append(c.handlers, handler)
+		c.counters = append(c.counters, metrics.NewCounters(handler.Topic, c.sink))
 	}
 }
 
 // Run will connecting all registered consumer handlers to the nsqlookupd address
 func (c *Consumer) Run() error {
-	for _, h := range c.handlers {
+	for i, h := range c.handlers {
 		cfg := nsq.NewConfig()
 		cfg.MaxAttempts = h.MaxAttempts
 		cfg.MaxInFlight = h.MaxInFlight
@@ -68,9 +84,9 @@ func (c *Consumer) Run() error {
 		}
 
 		if h.Concurrent != 0 {
-			q.AddConcurrentHandlers(c.handle(h.Handler), h.Concurrent)
+			q.AddConcurrentHandlers(c.handle(h, c.counters[i]), h.Concurrent)
 		} else {
-			q.AddHandler(c.handle(h.Handler))
+			q.AddHandler(c.handle(h, c.counters[i]))
 		}
 
 		err = q.ConnectToNSQLookupds(c.listenAddress)
@@ -89,7 +105,7 @@ func (c *Consumer) Run() error {
 
 // RunDirect will connecting all registered consumer handlers directly to the nsqd address
 func (c *Consumer) RunDirect() error {
-	for _, h := range c.handlers {
+	for i, h := range c.handlers {
 		cfg := nsq.NewConfig()
 		cfg.MaxAttempts = h.MaxAttempts
 		cfg.MaxInFlight = h.MaxInFlight
@@ -99,9 +115,9 @@ func (c *Consumer) RunDirect() error {
 		}
 
 		if h.Concurrent != 0 {
-			q.AddConcurrentHandlers(c.handle(h.Handler), h.Concurrent)
+			q.AddConcurrentHandlers(c.handle(h, c.counters[i]), h.Concurrent)
 		} else {
-			q.AddHandler(c.handle(h.Handler))
+			q.AddHandler(c.handle(h, c.counters[i]))
 		}
 
 		err = q.ConnectToNSQDs(c.listenAddress)
@@ -115,15 +131,63 @@ func (c *Consumer) RunDirect() error {
 	return nil
 }
 
-// handle will convert the func(msg Message) error into nsq.HandlerFunc
-func (c *Consumer) handle(fn func(IMessage) error) nsq.HandlerFunc {
-	return func(message *nsq.Message) error {
-		msg := &Message{
-			message,
+// handle will convert the handler func(msg Message) error into nsq.HandlerFunc,
+// a handler panic is returned as *adapter.PanicError so the message is requeued with backoff
+func (c *Consumer) handle(h ConsumerHandler, counters *metrics.Counters) nsq.HandlerFunc {
+	return func(message *nsq.Message) (err error) {
+		trace, body := UnwrapTrace(message.Body)
+		message.Body = body
+
+		txn, ctx := tracer.StartTransactionFromContext(context.Background(), "nsq/"+h.Topic)
+		if trace != nil {
+			ctx = nr.SetMetadataToTransaction(ctx, trace)
+		}
+		defer txn.Finish(&err)
+
+		start := time.Now()
+		defer func() {
+			counters.Handled(time.Since(start), err)
+		}()
+
+		msg := &TracedMessage{
+			Message: &Message{message},
+			ctx:     ctx,
+			trace:   trace,
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				err = adapter.Recovered(r, c.failFast, map[string]interface{}{
+					"topic":    h.Topic,
+					"channel":  h.Channel,
+					"attempts": message.Attempts,
+				})
+			}
+		}()
+
+		return h.Handler(msg)
+	}
+}
+
+// Stats return a snapshot of every running handler,
+// requeued and in-flight come from the go-nsq consumer stats
+func (c *Consumer) Stats() []metrics.ConsumerStats {
+	stats := make([]metrics.ConsumerStats, 0, len(c.nsqConsumers))
+	for i, q := range c.nsqConsumers {
+		s := c.counters[i].Snapshot()
+		s.Channel = c.handlers[i].Channel
+
+		qs := q.Stats()
+		s.Connected = qs.Connections > 0
+		s.Requeued = int64(qs.MessagesRequeued)
+		if inFlight := int64(qs.MessagesReceived) - int64(qs.MessagesFinished) - int64(qs.MessagesRequeued); inFlight > 0 {
+			s.InFlight = int(inFlight)
 		}
 
-		return fn(msg)
+		stats = append(stats, s)
 	}
+
+	return stats
 }
 
 // Wait waits for the stop/restart signal and shutdown the NSQ consumers
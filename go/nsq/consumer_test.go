@@ -0,0 +1,119 @@
+package nsq
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/reyhanfahlevi/pkg/go/mq/adapter"
+	"github.com/reyhanfahlevi/pkg/go/mq/metrics"
+)
+
+func newTestMessage(body []byte) *nsq.Message {
+	var id nsq.MessageID
+	copy(id[:], "0123456789abcdef")
+
+	msg := nsq.NewMessage(id, body)
+	msg.Attempts = 1
+
+	return msg
+}
+
+func TestConsumer_handle(t *testing.T) {
+	failing := errors.New("failing")
+
+	tests := []struct {
+		name         string
+		failFast     bool
+		handler      func(message IMessage) error
+		wantErr      error
+		wantPanicErr bool
+		wantPanic    bool
+	}{
+		{
+			name:    "Test handled",
+			handler: func(message IMessage) error { return nil },
+		}, {
+			name:    "Test handler error",
+			handler: func(message IMessage) error { return failing },
+			wantErr: failing,
+		}, {
+			name:         "Test handler panic recovered",
+			handler:      func(message IMessage) error { panic("boom") },
+			wantPanicErr: true,
+		}, {
+			name:      "Test handler panic with fail fast",
+			failFast:  true,
+			handler:   func(message IMessage) error { panic("boom") },
+			wantPanic: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConsumer(ConsumerConfig{FailFast: tt.failFast})
+			h := ConsumerHandler{Topic: "orders", Channel: "billing", Enable: true, Handler: tt.handler}
+			c.RegisterHandler(h)
+
+			defer func() {
+				if r := recover(); (r != nil) != tt.wantPanic {
+					t.Errorf("handle() panic = %v, want panic %v", r, tt.wantPanic)
+				}
+			}()
+
+			err := c.handle(h, c.counters[0])(newTestMessage([]byte(`{"id":1}`)))
+
+			var panicErr *adapter.PanicError
+			switch {
+			case tt.wantPanicErr:
+				if !errors.As(err, &panicErr) || panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+					t.Errorf("handle() error = %v, want *adapter.PanicError", err)
+				}
+			case !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil):
+				t.Errorf("handle() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConsumer_Stats(t *testing.T) {
+	c := NewConsumer(ConsumerConfig{})
+	handlers := []ConsumerHandler{
+		{Topic: "orders", Channel: "billing", Enable: true, Handler: func(message IMessage) error { return nil }},
+		{Topic: "refunds", Channel: "billing", Enable: false},
+		{Topic: "payments", Channel: "audit", Enable: true, Handler: func(message IMessage) error { return errors.New("failing") }},
+	}
+	for _, h := range handlers {
+		c.RegisterHandler(h)
+	}
+
+	// the go-nsq consumers are created by Run, they are never connected here
+	for _, h := range c.handlers {
+		q, err := nsq.NewConsumer(h.Topic, h.Channel, nsq.NewConfig())
+		if err != nil {
+			t.Fatalf("nsq.NewConsumer() error = %v", err)
+		}
+		t.Cleanup(q.Stop)
+		c.nsqConsumers = append(c.nsqConsumers, q)
+	}
+
+	for i, h := range c.handlers {
+		_ = c.handle(h, c.counters[i])(newTestMessage(nil))
+	}
+
+	want := []metrics.ConsumerStats{
+		{Topic: "orders", Channel: "billing", Succeeded: 1},
+		{Topic: "payments", Channel: "audit", Failed: 1},
+	}
+
+	got := c.Stats()
+	if len(got) != len(want) {
+		t.Fatalf("Stats() = %d handlers, want %d", len(got), len(want))
+	}
+	for i := range want {
+		// the latency depends on the run, only the counters are compared
+		got[i].AvgLatency, got[i].MaxLatency = 0, 0
+		if got[i] != want[i] {
+			t.Errorf("Stats()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package nsq
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+
+	"github.com/reyhanfahlevi/pkg/go/tracer/nr"
+)
+
+// envelopeMagic start every enveloped body, a NUL byte never starts a json or text payload
+var envelopeMagic = []byte("\x00nqe")
+
+// WrapTrace put the distributed trace metadata of the context and the body into an envelope,
+// the body is returned as is when the context has no trace
+func WrapTrace(ctx context.Context, body []byte) []byte {
+	md := nr.GetMetadataFromContext(ctx)
+	if len(md) == 0 {
+		return body
+	}
+
+	return wrap(md, body)
+}
+
+func wrap(md http.Header, body []byte) []byte {
+	header, err := json.Marshal(md)
+	if err != nil {
+		return body
+	}
+
+	buf := make([]byte, 0, len(envelopeMagic)+4+len(header)+len(body))
+	buf = append(buf, envelopeMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(header)))
+	buf = append(buf, header...)
+	buf = append(buf, body...)
+
+	return buf
+}
+
+// UnwrapTrace return the trace metadata and the original body of an enveloped body,
+// a body without envelope is returned as is with nil metadata
+func UnwrapTrace(body []byte) (http.Header, []byte) {
+	if !bytes.HasPrefix(body, envelopeMagic) || len(body) < len(envelopeMagic)+4 {
+		return nil, body
+	}
+
+	rest := body[len(envelopeMagic):]
+	size := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+	if uint64(size) > uint64(len(rest)) {
+		return nil, body
+	}
+
+	var md http.Header
+	if err := json.Unmarshal(rest[:size], &md); err != nil {
+		return nil, body
+	}
+
+	return md, rest[size:]
+}
@@ -0,0 +1,94 @@
+package nsq
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestUnwrapTrace(t *testing.T) {
+	md := http.Header{"Traceparent": []string{"00-abc-def-01"}}
+
+	tests := []struct {
+		name     string
+		body     []byte
+		wantMD   http.Header
+		wantBody []byte
+	}{
+		{
+			name:     "Test enveloped body",
+			body:     wrap(md, []byte(`{"id":1}`)),
+			wantMD:   md,
+			wantBody: []byte(`{"id":1}`),
+		}, {
+			name:     "Test plain body",
+			body:     []byte(`{"id":1}`),
+			wantMD:   nil,
+			wantBody: []byte(`{"id":1}`),
+		}, {
+			name:     "Test truncated envelope",
+			body:     []byte("\x00nqe\x00\x00\x00\xff{}"),
+			wantMD:   nil,
+			wantBody: []byte("\x00nqe\x00\x00\x00\xff{}"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotMD, gotBody := UnwrapTrace(tt.body)
+			if !reflect.DeepEqual(gotMD, tt.wantMD) {
+				t.Errorf("UnwrapTrace() md = %v, want %v", gotMD, tt.wantMD)
+			}
+			if string(gotBody) != string(tt.wantBody) {
+				t.Errorf("UnwrapTrace() body = %q, want %q", gotBody, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestPublisher_Envelope(t *testing.T) {
+	tests := []struct {
+		name         string
+		opt          []PublisherOptions
+		wantEnvelope bool
+	}{
+		{name: "Test envelope disabled by default"},
+		{name: "Test envelope enabled", opt: []PublisherOptions{WithTraceEnvelope()}, wantEnvelope: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPublisher("127.0.0.1:4150", "", tt.opt...)
+			if err != nil {
+				t.Fatalf("NewPublisher() error = %v", err)
+			}
+
+			if p.envelope != tt.wantEnvelope {
+				t.Errorf("envelope = %v, want %v", p.envelope, tt.wantEnvelope)
+			}
+
+			// without trace in the context the body is never wrapped
+			if got := p.Envelope(context.Background(), []byte(`{"id":1}`)); string(got) != `{"id":1}` {
+				t.Errorf("Envelope() = %q, want the body as is", got)
+			}
+		})
+	}
+}
+
+func TestTracedMessage_Context(t *testing.T) {
+	md := http.Header{"Traceparent": []string{"00-abc-def-01"}}
+
+	// the handlers reach the context and the trace with a type assertion
+	var msg IMessage = &TracedMessage{Message: &Message{nsq.NewMessage(nsq.MessageID{}, nil)}, trace: md}
+	m, ok := msg.(ContextMessage)
+	if !ok {
+		t.Fatal("TracedMessage doesn't implement ContextMessage")
+	}
+	if m.Context() == nil {
+		t.Error("Context() = nil, want the background context")
+	}
+	if !reflect.DeepEqual(m.TraceMetadata(), md) {
+		t.Errorf("TraceMetadata() = %v, want %v", m.TraceMetadata(), md)
+	}
+}
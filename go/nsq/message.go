@@ -1,6 +1,8 @@
 package nsq
 
 import (
+	"context"
+	"net/http"
 	"time"
 
 	"github.com/nsqio/go-nsq"
@@ -26,11 +28,47 @@ type IMessage interface {
 	GetBody() []byte
 }
 
+// ContextMessage is implemented by the messages the Consumer hands to the handlers,
+// a handler reach the context of the message with a type assertion:
+//
+//	if m, ok := msg.(nsq.ContextMessage); ok {
+//		ctx = m.Context()
+//	}
+type ContextMessage interface {
+	IMessage
+	// Context return the context of the tracer transaction started for the message
+	Context() context.Context
+	// TraceMetadata return the distributed trace metadata sent by the publisher, nil when there is none
+	TraceMetadata() http.Header
+}
+
 // Message alias for built in nsq message
 type Message struct {
 	*nsq.Message
 }
 
+// TracedMessage is the message with the context of the tracer transaction started for it
+type TracedMessage struct {
+	*Message
+
+	ctx   context.Context
+	trace http.Header
+}
+
+// Context return the context of the tracer transaction started for the message
+func (m *TracedMessage) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+
+	return m.ctx
+}
+
+// TraceMetadata return the distributed trace metadata sent by the publisher, nil when there is none
+func (m *TracedMessage) TraceMetadata() http.Header {
+	return m.trace
+}
+
 // GetAttempts return number of how many this message enter the consumer
 func (m *Message) GetAttempts() uint16 {
 	return m.Attempts
@@ -1,8 +1,10 @@
 package nsq
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
+	"time"
 
 	"github.com/nsqio/go-nsq"
 )
@@ -11,11 +13,34 @@ import (
 type Publisher struct {
 	producer *nsq.Producer
 	prefix   string
+	marshal  func(v interface{}) ([]byte, error)
+
+	// envelope send the distributed trace in an envelope, only the consumers of this package can read it
+	envelope bool
+}
+
+// PublisherOptions option to modify the publisher
+type PublisherOptions func(*Publisher)
+
+// WithMarshaler replace json.Marshal used to encode the published data, e.g. codec.Msgpack.Marshal
+func WithMarshaler(marshal func(v interface{}) ([]byte, error)) PublisherOptions {
+	return func(p *Publisher) {
+		p.marshal = marshal
+	}
+}
+
+// WithTraceEnvelope send the distributed trace of the publish context in an envelope around the body,
+// every consumer of the topic must unwrap it: nsq.Consumer and the nsqa adapter do, other consumers
+// would receive the envelope as the body
+func WithTraceEnvelope() PublisherOptions {
+	return func(p *Publisher) {
+		p.envelope = true
+	}
 }
 
 // NewPublisher will create new publisher instance
 // leaf the prefix empty
-func NewPublisher(publishAddress, prefix string) (*Publisher, error) {
+func NewPublisher(publishAddress, prefix string, opt ...PublisherOptions) (*Publisher, error) {
 
 	config := nsq.NewConfig()
 	prod, err := nsq.NewProducer(publishAddress, config)
@@ -23,24 +48,69 @@ func NewPublisher(publishAddress, prefix string) (*Publisher, error) {
 		return nil, err
 	}
 
-	return &Publisher{
+	p := &Publisher{
 		producer: prod,
 		prefix:   prefix,
-	}, nil
+		marshal:  json.Marshal,
+	}
+
+	for _, opt := range opt {
+		opt(p)
+	}
+
+	return p, nil
 }
 
-// Publish will publish the data using json format, by default will always use the prefix in the topic
+// Publish will publish the data using json format or the marshaler option, by default will always use the prefix in the topic
 func (p *Publisher) Publish(topic string, data interface{}) error {
 	topic = strings.Join([]string{p.prefix, topic}, "_")
 	return p.PublishWithoutPrefix(topic, data)
 }
 
-// PublishWithoutPrefix will publish the data using json format without prefix in the topic
+// PublishWithContext will publish the data like Publish,
+// with WithTraceEnvelope the distributed trace of the context is sent in an envelope read by the Consumer
+func (p *Publisher) PublishWithContext(ctx context.Context, topic string, data interface{}) error {
+	payload, err := p.marshal(data)
+	if err != nil {
+		return err
+	}
+
+	topic = strings.Join([]string{p.prefix, topic}, "_")
+	return p.producer.Publish(topic, p.Envelope(ctx, payload))
+}
+
+// Envelope put the distributed trace of the context and the body into an envelope when WithTraceEnvelope is set,
+// otherwise the body is returned as is
+func (p *Publisher) Envelope(ctx context.Context, body []byte) []byte {
+	if !p.envelope {
+		return body
+	}
+
+	return WrapTrace(ctx, body)
+}
+
+// PublishWithoutPrefix will publish the data using json format or the marshaler option without prefix in the topic
 func (p *Publisher) PublishWithoutPrefix(topic string, data interface{}) error {
-	payload, err := json.Marshal(data)
+	payload, err := p.marshal(data)
 	if err != nil {
 		return err
 	}
 
 	return p.producer.Publish(topic, payload)
 }
+
+// PublishRaw will publish the body as is without prefix in the topic
+func (p *Publisher) PublishRaw(topic string, body []byte) error {
+	return p.producer.Publish(topic, body)
+}
+
+// DeferredPublishRaw will publish the body as is without prefix in the topic,
+// the message will be delivered to the consumer after the delay passed
+func (p *Publisher) DeferredPublishRaw(topic string, delay time.Duration, body []byte) error {
+	return p.producer.DeferredPublish(topic, delay, body)
+}
+
+// MultiPublishRaw will publish all the bodies as is at once without prefix in the topic
+func (p *Publisher) MultiPublishRaw(topic string, bodies [][]byte) error {
+	return p.producer.MultiPublish(topic, bodies)
+}